@@ -0,0 +1,268 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// Audit log rotation defaults
+const (
+	DefaultAuditMaxSize  = 100 << 20
+	DefaultAuditMaxFiles = 10
+)
+
+// ErrAuditLogClosed is returned when writing to a closed audit log
+var ErrAuditLogClosed = errors.New("audit log is closed")
+
+// MutatingMethods are the RPC methods, and UploadVolumeMethod for volume
+// uploads, recorded in the audit log
+var MutatingMethods = map[string]bool{
+	"Libvirt.Create":           true,
+	"Libvirt.CreateGuest":      true,
+	"Libvirt.Delete":           true,
+	"Libvirt.Run":              true,
+	"Libvirt.Restart":          true,
+	"Libvirt.Reboot":           true,
+	"Libvirt.Poweroff":         true,
+	"Libvirt.Shutdown":         true,
+	"Libvirt.GracefulShutdown": true,
+	"Libvirt.Pause":            true,
+	"Libvirt.Resume":           true,
+	"Libvirt.CreateSnapshot":   true,
+	"Libvirt.RevertSnapshot":   true,
+	"Libvirt.DeleteSnapshot":   true,
+	"Libvirt.Migrate":          true,
+	"Libvirt.Reconcile":        true,
+	"Libvirt.CancelJob":        true,
+	"Libvirt.CreateVolume":     true,
+	"Libvirt.ResizeVolume":     true,
+	"Libvirt.DeleteVolume":     true,
+	UploadVolumeMethod:         true,
+	"Libvirt.AttachDisk":       true,
+	"Libvirt.DetachDisk":       true,
+}
+
+type (
+	// AuditLog appends a JSON line for each mutating RPC call to a file,
+	// rotating it when it grows too large
+	AuditLog struct {
+		lv       *Libvirt
+		filename string
+		maxSize  int64
+		maxFiles int
+
+		lock sync.Mutex
+		file *os.File
+		size int64
+	}
+
+	// AuditEntry is a record of a mutating RPC call or volume upload. States
+	// are empty when the guest's domain does not exist.
+	AuditEntry struct {
+		Time        time.Time `json:"time"`
+		Caller      string    `json:"caller,omitempty"`
+		Remote      string    `json:"remote"`
+		Method      string    `json:"method"`
+		Guest       string    `json:"guest,omitempty"`
+		Volume      string    `json:"volume,omitempty"`
+		StateBefore string    `json:"state_before,omitempty"`
+		StateAfter  string    `json:"state_after,omitempty"`
+		Duration    int64     `json:"duration_ms"`
+		Error       string    `json:"error,omitempty"`
+	}
+)
+
+// NewAuditLog opens an audit log. The file is rotated to filename.1 and so on
+// when it reaches maxSize bytes, keeping at most maxFiles old files.
+func (lv *Libvirt) NewAuditLog(filename string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if filename == "" || maxSize <= 0 || maxFiles < 0 {
+		return nil, fmt.Errorf("invalid audit log settings: %s %d %d", filename, maxSize, maxFiles)
+	}
+
+	a := &AuditLog{
+		lv:       lv,
+		filename: filename,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		logx.LogReturnedErr(file.Close, log.Fields{"filename": a.filename}, "failed to close audit log")
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file to filename.1, shifting older files up and
+// removing the oldest
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	if a.maxFiles == 0 {
+		if err := os.Remove(a.filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return a.open()
+	}
+
+	for i := a.maxFiles - 1; i > 0; i-- {
+		old := fmt.Sprintf("%s.%d", a.filename, i)
+		if err := os.Rename(old, fmt.Sprintf("%s.%d", a.filename, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.filename, a.filename+".1"); err != nil {
+		return err
+	}
+
+	return a.open()
+}
+
+// Write appends an entry to the log
+func (a *AuditLog) Write(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return ErrAuditLogClosed
+	}
+
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the log file
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// guestState returns the state name of a guest's domain, or an empty string if
+// it does not exist or can't be looked up
+func (a *AuditLog) guestState(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	domain, err := a.lv.LookupDomainByName(id)
+	if err != nil {
+		if virError, ok := err.(libvirt.VirError); !ok || virError.Code != libvirt.VIR_ERR_NO_DOMAIN {
+			log.WithFields(log.Fields{
+				"guest": id,
+				"error": err,
+			}).Error("failed to look up domain for audit log")
+		}
+		return ""
+	}
+	defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": id}, "failed to free domain")
+
+	state, err := GetState(domain)
+	if err != nil {
+		return ""
+	}
+	return StateNames[state]
+}
+
+// Handler wraps an HTTP handler to record calls to MutatingMethods and volume
+// uploads at VolumesPath, by pool and volume name. The caller is the one set by
+// a Policy handler in front of it, or the client certificate subject.
+func (a *AuditLog) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &AuditEntry{
+			Time:   time.Now().UTC(),
+			Caller: Caller(r),
+			Remote: r.RemoteAddr,
+		}
+
+		switch {
+		case r.URL.Path == rpc.RPCPath:
+			request, err := readRPCRequest(w, r)
+			if err != nil || !MutatingMethods[request.Method] {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			entry.Method = request.Method
+			entry.Guest = request.guest()
+		case r.URL.Path == VolumesPath && r.Method == "PUT" && MutatingMethods[UploadVolumeMethod]:
+			query := r.URL.Query()
+			entry.Method = UploadVolumeMethod
+			entry.Volume = query.Get("pool") + "/" + query.Get("volume")
+		default:
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if entry.Caller == "" {
+			entry.Caller = ClientSubject(r)
+		}
+		entry.StateBefore = a.guestState(entry.Guest)
+
+		rw := newRecordingResponseWriter(w)
+		handler.ServeHTTP(rw, r)
+
+		entry.Duration = int64(time.Since(entry.Time) / time.Millisecond)
+		entry.StateAfter = a.guestState(entry.Guest)
+		if entry.Volume == "" {
+			_, entry.Error = rw.outcome()
+		} else if rw.status >= http.StatusBadRequest {
+			entry.Error = strings.TrimSpace(rw.body.String())
+		}
+
+		if err := a.Write(entry); err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"method": entry.Method,
+				"guest":  entry.Guest,
+			}).Error("failed to write audit log")
+		}
+	})
+}
@@ -0,0 +1,303 @@
+package libvirt_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// rpcHandler is a minimal JSON-RPC handler for guest methods
+func rpcHandler(methods map[string]guestRPC) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			Method string             `json:"method"`
+			Params []rpc.GuestRequest `json:"params"`
+			ID     int                `json:"id"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response := struct {
+			Result interface{} `json:"result"`
+			Error  interface{} `json:"error"`
+			ID     int         `json:"id"`
+		}{ID: request.ID}
+		result := &rpc.GuestResponse{}
+		if err := methods[request.Method](r, &request.Params[0], result); err != nil {
+			response.Error = err.Error()
+		} else {
+			response.Result = result
+		}
+		_ = json.NewEncoder(w).Encode(&response)
+	})
+}
+
+func readAudit(t *testing.T, filename string) []mlibvirt.AuditEntry {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("can't open audit log: %s\n", err.Error())
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	entries := make([]mlibvirt.AuditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := mlibvirt.AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid audit log line %s: %s\n", scanner.Text(), err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	lv, _, guest := fakeSetup(t)
+
+	dir, err := ioutil.TempDir("", "mistify-libvirt-audit")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s\n", err.Error())
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	filename := filepath.Join(dir, "audit.log")
+	audit, err := lv.NewAuditLog(filename, 1<<20, 2)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %s\n", err.Error())
+	}
+	defer func() {
+		_ = audit.Close()
+	}()
+
+	handler := audit.Handler(rpcHandler(map[string]guestRPC{
+		"Libvirt.Run":    lv.Run,
+		"Libvirt.Status": lv.Status,
+		"Libvirt.Delete": lv.Delete,
+	}))
+
+	do := func(method string) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"method": method,
+			"params": []interface{}{rpc.GuestRequest{Guest: guest}},
+			"id":     1,
+		})
+		r, err := http.NewRequest("POST", "http://localhost"+rpc.RPCPath, strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatalf("can't create request: %s\n", err.Error())
+		}
+		r.Header.Set(mlibvirt.CallerHeader, "orchestrator")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	do("Libvirt.Run")
+	do("Libvirt.Status")
+	do("Libvirt.Delete")
+	do("Libvirt.Delete")
+
+	entries := readAudit(t, filename)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 audit entries, got %d: %+v\n", len(entries), entries)
+	}
+
+	expected := []struct {
+		method, before, after string
+		failed                bool
+	}{
+		{"Libvirt.Run", "shutoff", "running", false},
+		{"Libvirt.Delete", "running", "", false},
+		{"Libvirt.Delete", "", "", true},
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if entry.Method != e.method || entry.Guest != guest.ID || entry.Caller != "orchestrator" {
+			t.Fatalf("entry %d: expected %s of %s by orchestrator, got %+v\n", i, e.method, guest.ID, entry)
+		}
+		if entry.StateBefore != e.before || entry.StateAfter != e.after {
+			t.Fatalf("entry %d: expected states %q -> %q, got %q -> %q\n", i, e.before, e.after, entry.StateBefore, entry.StateAfter)
+		}
+		if (entry.Error != "") != e.failed {
+			t.Fatalf("entry %d: expected failure %t, got error %q\n", i, e.failed, entry.Error)
+		}
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	lv, _, _ := fakeSetup(t)
+
+	dir, err := ioutil.TempDir("", "mistify-libvirt-audit")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s\n", err.Error())
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	filename := filepath.Join(dir, "audit.log")
+	audit, err := lv.NewAuditLog(filename, 200, 2)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %s\n", err.Error())
+	}
+	defer func() {
+		_ = audit.Close()
+	}()
+
+	// each entry is over 100 bytes, so each file holds one
+	for i := 0; i < 5; i++ {
+		if err := audit.Write(&mlibvirt.AuditEntry{Method: "Libvirt.Delete", Guest: strings.Repeat("x", 40)}); err != nil {
+			t.Fatalf("Write failed: %s\n", err.Error())
+		}
+	}
+
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		if entries := readAudit(t, name); len(entries) != 1 {
+			t.Fatalf("expected 1 entry in %s, got %d\n", name, len(entries))
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 rotated files to be kept\n")
+	}
+}
+
+func TestAuditLogUploads(t *testing.T) {
+	lv := storageSetup(t)
+	createVolume(t, lv, &mlibvirt.VolumeRequest{Pool: "default", Name: "disk.img", Capacity: 16})
+
+	dir, err := ioutil.TempDir("", "mistify-libvirt-audit")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s\n", err.Error())
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	filename := filepath.Join(dir, "audit.log")
+	audit, err := lv.NewAuditLog(filename, 1<<20, 2)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %s\n", err.Error())
+	}
+	defer func() {
+		_ = audit.Close()
+	}()
+
+	handler := audit.Handler(lv.VolumeHandler())
+	transfers := []struct {
+		method, body string
+	}{
+		{"PUT", "mistify"},
+		{"GET", ""},
+		{"PUT", "far too long for the volume"},
+	}
+	for _, transfer := range transfers {
+		r, err := http.NewRequest(transfer.method, "http://localhost"+mlibvirt.VolumesPath+"?pool=default&volume=disk.img", strings.NewReader(transfer.body))
+		if err != nil {
+			t.Fatalf("can't create request: %s\n", err.Error())
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	entries := readAudit(t, filename)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %d: %+v\n", len(entries), entries)
+	}
+	for i, entry := range entries {
+		if entry.Method != mlibvirt.UploadVolumeMethod || entry.Volume != "default/disk.img" {
+			t.Fatalf("entry %d: expected upload of default/disk.img, got %+v\n", i, entry)
+		}
+		if failed := entry.Error != ""; failed != (i == 1) {
+			t.Fatalf("entry %d: unexpected error %q\n", i, entry.Error)
+		}
+	}
+}
+
+func TestRunServer(t *testing.T) {
+	lv, _, guest := fakeSetup(t)
+
+	dir, err := ioutil.TempDir("", "mistify-libvirt-server")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s\n", err.Error())
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	filename := filepath.Join(dir, "audit.log")
+	audit, err := lv.NewAuditLog(filename, 1<<20, 2)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %s\n", err.Error())
+	}
+	defer func() {
+		_ = audit.Close()
+	}()
+	policy, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %s\n", err.Error())
+	}
+
+	config := &mlibvirt.ServerConfig{
+		Address: "127.0.0.1",
+		Port:    9007,
+		Policy:  policy,
+		Audit:   audit,
+	}
+	go func() {
+		_ = lv.RunServer(config)
+	}()
+	time.Sleep(time.Second)
+
+	call := func(token string, method string) int {
+		body, _ := json.Marshal(map[string]interface{}{
+			"method": method,
+			"params": []*rpc.GuestRequest{{Guest: guest}},
+			"id":     1,
+		})
+		request, err := http.NewRequest("POST", "http://127.0.0.1:9007"+rpc.RPCPath, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("can't create request: %s\n", err.Error())
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set(mlibvirt.CallerHeader, "orchestrator")
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("%s failed: %s\n", method, err.Error())
+		}
+		_ = response.Body.Close()
+		return response.StatusCode
+	}
+
+	// the server has the policy, and a client can't name itself
+	if status := call("", "Libvirt.Run"); status != http.StatusForbidden {
+		t.Fatalf("expected a call without a token to be forbidden, got %d\n", status)
+	}
+	if status := call("monitor-token", "Libvirt.Run"); status != http.StatusForbidden {
+		t.Fatalf("expected monitoring to be forbidden from Run, got %d\n", status)
+	}
+	if status := call("orchestrator-token", "Libvirt.Run"); status != http.StatusOK {
+		t.Fatalf("expected Run to succeed, got %d\n", status)
+	}
+
+	// and the audit log
+	entries := readAudit(t, filename)
+	if len(entries) != 1 || entries[0].Caller != "orchestrator" || entries[0].Method != "Libvirt.Run" || entries[0].StateAfter != "running" {
+		t.Fatalf("expected one audited Run by orchestrator, got %+v\n", entries)
+	}
+}
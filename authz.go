@@ -0,0 +1,228 @@
+package libvirt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// CallerHeader is set on authorized requests to the name of the caller. Any
+// value sent by the client is removed by CallerHandler and Policy.Handler.
+const CallerHeader = "X-Mistify-Caller"
+
+// EventsMethod is the method name used to authorize the events endpoint
+const EventsMethod = "Libvirt.Events"
+
+// ErrPermissionDenied is returned for calls the caller is not allowed to make
+var ErrPermissionDenied = errors.New("permission denied")
+
+type (
+	// Policy maps callers, identified by bearer token or client certificate
+	// common name, to the RPC methods they may call
+	Policy struct {
+		Callers []*PolicyCaller `json:"callers"`
+	}
+
+	// PolicyCaller is a named caller and the methods it may call. Methods are
+	// patterns such as "Status", "*Metrics" or "Libvirt.*"; patterns without a
+	// service match any service.
+	PolicyCaller struct {
+		Name     string   `json:"name"`
+		Tokens   []string `json:"tokens,omitempty"`
+		Subjects []string `json:"subjects,omitempty"`
+		Methods  []string `json:"methods"`
+	}
+)
+
+// LoadPolicy reads an authorization policy from a JSON file
+func LoadPolicy(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := &Policy{}
+	if err := json.NewDecoder(f).Decode(policy); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return policy, nil
+}
+
+// Validate checks that callers are named, identifiable and have valid method
+// patterns
+func (p *Policy) Validate() error {
+	names := make(map[string]bool)
+	for _, caller := range p.Callers {
+		if caller.Name == "" {
+			return errors.New("caller without a name")
+		}
+		if names[caller.Name] {
+			return fmt.Errorf("duplicate caller %s", caller.Name)
+		}
+		names[caller.Name] = true
+
+		if len(caller.Tokens) == 0 && len(caller.Subjects) == 0 {
+			return fmt.Errorf("caller %s has no tokens or subjects", caller.Name)
+		}
+		for _, token := range caller.Tokens {
+			if token == "" {
+				return fmt.Errorf("caller %s has an empty token", caller.Name)
+			}
+		}
+		for _, pattern := range caller.Methods {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("caller %s method %s: %s", caller.Name, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Identify returns the caller making a request, or nil if it is not known. A
+// bearer token takes precedence over the client certificate.
+func (p *Policy) Identify(r *http.Request) *PolicyCaller {
+	if token := bearerToken(r); token != "" {
+		for _, caller := range p.Callers {
+			for _, t := range caller.Tokens {
+				if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+					return caller
+				}
+			}
+		}
+		return nil
+	}
+
+	if subject := ClientSubject(r); subject != "" {
+		for _, caller := range p.Callers {
+			for _, s := range caller.Subjects {
+				if s == subject {
+					return caller
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Allowed returns whether the caller may call a method, such as
+// "Libvirt.Status"
+func (c *PolicyCaller) Allowed(method string) bool {
+	name := method
+	if i := strings.LastIndex(method, "."); i >= 0 {
+		name = method[i+1:]
+	}
+
+	for _, pattern := range c.Methods {
+		target := method
+		if !strings.Contains(pattern, ".") {
+			target = name
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler wraps an HTTP handler to only pass on RPC calls, event polls, and
+// volume transfers the caller is allowed to make. Denied RPC calls get a
+// JSON-RPC error response with ErrPermissionDenied and a 403 status.
+func (p *Policy) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(CallerHeader)
+
+		request := &jsonRPCRequest{}
+		switch r.URL.Path {
+		case rpc.RPCPath:
+			var err error
+			if request, err = readRPCRequest(w, r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case EventsPath:
+			request.Method = EventsMethod
+		case VolumesPath:
+			request.Method = DownloadVolumeMethod
+			if r.Method == "PUT" {
+				request.Method = UploadVolumeMethod
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		caller := p.Identify(r)
+		if caller == nil || !caller.Allowed(request.Method) {
+			name := ""
+			if caller != nil {
+				name = caller.Name
+			}
+			log.WithFields(log.Fields{
+				"caller":  name,
+				"subject": ClientSubject(r),
+				"method":  request.Method,
+				"remote":  r.RemoteAddr,
+			}).Warn("permission denied")
+
+			denied(w, r, request)
+			return
+		}
+
+		r.Header.Set(CallerHeader, caller.Name)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CallerHandler wraps an HTTP handler to remove any CallerHeader sent by the
+// client, so that only a Policy can name the caller of a request. It must be
+// the outermost handler, around the policy handler if one is in use.
+func CallerHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(CallerHeader)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Caller returns the name of the authorized caller of a request, or an empty
+// string if no policy is in use. The request must have passed through
+// CallerHandler, or clients could name themselves.
+func Caller(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return r.Header.Get(CallerHeader)
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// denied writes a permission denied response
+func denied(w http.ResponseWriter, r *http.Request, request *jsonRPCRequest) {
+	if r.URL.Path != rpc.RPCPath {
+		http.Error(w, ErrPermissionDenied.Error(), http.StatusForbidden)
+		return
+	}
+
+	writeRPCResponse(w, http.StatusForbidden, nil, fmt.Sprintf("%s: %s", ErrPermissionDenied, request.Method), request.ID)
+}
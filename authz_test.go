@@ -0,0 +1,178 @@
+package libvirt_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+const testPolicy = `{
+	"callers": [
+		{"name": "monitoring", "tokens": ["monitor-token"], "methods": ["Status", "*Metrics", "Events"]},
+		{"name": "orchestrator", "tokens": ["orchestrator-token"], "methods": ["Libvirt.*"]}
+	]
+}`
+
+func loadTestPolicy(t *testing.T, policy string) (*libvirt.Policy, error) {
+	f, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatalf("can't create temp file: %s\n", err.Error())
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err = f.WriteString(policy); err != nil {
+		t.Fatalf("can't write temp file: %s\n", err.Error())
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("can't close temp file: %s\n", err.Error())
+	}
+
+	return libvirt.LoadPolicy(f.Name())
+}
+
+func TestLoadPolicy(t *testing.T) {
+	invalid := []string{
+		`{"callers": [{"tokens": ["a"], "methods": ["*"]}]}`,
+		`{"callers": [{"name": "a", "methods": ["*"]}]}`,
+		`{"callers": [{"name": "a", "tokens": [""], "methods": ["*"]}]}`,
+		`{"callers": [{"name": "a", "tokens": ["a"], "methods": ["["]}]}`,
+		`{"callers": [{"name": "a", "tokens": ["a"]}, {"name": "a", "tokens": ["b"]}]}`,
+		`{"callers": `,
+	}
+	for _, policy := range invalid {
+		if _, err := loadTestPolicy(t, policy); err == nil {
+			t.Fatalf("expected policy %s to be invalid\n", policy)
+		}
+	}
+
+	if _, err := loadTestPolicy(t, testPolicy); err != nil {
+		t.Fatalf("LoadPolicy failed: %s\n", err.Error())
+	}
+}
+
+func TestPolicyHandler(t *testing.T) {
+	policy, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %s\n", err.Error())
+	}
+
+	var called string
+	handler := policy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = libvirt.Caller(r)
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+
+	tests := []struct {
+		token  string
+		path   string
+		method string
+		caller string
+	}{
+		{"monitor-token", rpc.RPCPath, "Libvirt.Status", "monitoring"},
+		{"monitor-token", rpc.RPCPath, "Libvirt.CPUMetrics", "monitoring"},
+		{"monitor-token", libvirt.EventsPath, "", "monitoring"},
+		{"monitor-token", rpc.RPCPath, "Libvirt.Delete", ""},
+		{"monitor-token", rpc.RPCPath, "Libvirt.Poweroff", ""},
+		{"orchestrator-token", rpc.RPCPath, "Libvirt.Delete", "orchestrator"},
+		{"orchestrator-token", rpc.RPCPath, "Other.Delete", ""},
+		{"orchestrator-token", libvirt.VolumesPath, "", "orchestrator"},
+		{"monitor-token", libvirt.VolumesPath, "", ""},
+		{"unknown-token", rpc.RPCPath, "Libvirt.Status", ""},
+		{"", rpc.RPCPath, "Libvirt.Status", ""},
+	}
+
+	for _, test := range tests {
+		called = ""
+		body := `{"method": "` + test.method + `", "params": [{}], "id": 7}`
+		r, err := http.NewRequest("POST", "http://localhost"+test.path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("can't create request: %s\n", err.Error())
+		}
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		// clients can't claim to be someone else
+		r.Header.Set(libvirt.CallerHeader, "orchestrator")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if test.caller != "" {
+			if w.Code != http.StatusOK || called != test.caller {
+				t.Fatalf("%s %s %s: expected call by %s, got %d %q\n", test.token, test.path, test.method, test.caller, w.Code, called)
+			}
+			if test.path == rpc.RPCPath && w.Body.String() != body {
+				t.Fatalf("%s %s: request body not passed on: %s\n", test.token, test.method, w.Body.String())
+			}
+			continue
+		}
+
+		if w.Code != http.StatusForbidden || called != "" {
+			t.Fatalf("%s %s %s: expected denial, got %d %q\n", test.token, test.path, test.method, w.Code, called)
+		}
+		if test.path != rpc.RPCPath {
+			continue
+		}
+
+		response := struct {
+			Error string `json:"error"`
+			ID    int    `json:"id"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: invalid response %s: %s\n", test.token, test.method, w.Body.String(), err.Error())
+		}
+		if !strings.HasPrefix(response.Error, libvirt.ErrPermissionDenied.Error()) || response.ID != 7 {
+			t.Fatalf("%s %s: expected permission denied error for id 7, got %+v\n", test.token, test.method, response)
+		}
+	}
+}
+
+func TestCallerHandler(t *testing.T) {
+	policy, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %s\n", err.Error())
+	}
+
+	var called string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = libvirt.Caller(r)
+	})
+
+	tests := []struct {
+		handler http.Handler
+		token   string
+		caller  string
+	}{
+		// without a policy, clients can't name themselves
+		{libvirt.CallerHandler(inner), "", ""},
+		{libvirt.CallerHandler(inner), "orchestrator-token", ""},
+		{libvirt.CallerHandler(policy.Handler(inner)), "orchestrator-token", "orchestrator"},
+	}
+
+	for i, test := range tests {
+		called = "unset"
+		r, err := http.NewRequest("POST", "http://localhost"+rpc.RPCPath, strings.NewReader(`{"method": "Libvirt.Status", "params": [{}], "id": 1}`))
+		if err != nil {
+			t.Fatalf("can't create request: %s\n", err.Error())
+		}
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		r.Header.Set(libvirt.CallerHeader, "monitoring")
+
+		test.handler.ServeHTTP(httptest.NewRecorder(), r)
+		if called != test.caller {
+			t.Fatalf("test %d: expected caller %q, got %q\n", i, test.caller, called)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package libvirt
+
+import (
+	"io"
+
+	"github.com/alexzorin/libvirt-go"
+)
+
+type (
+	// Backend opens connections to a hypervisor. LibvirtBackend talks to
+	// libvirtd; FakeBackend keeps everything in memory for tests.
+	Backend interface {
+		Connect(uri string) (BackendConnection, error)
+		// StartEventLoop starts delivering events to registered callbacks. It
+		// must be called before connecting for events and may be called more
+		// than once.
+		StartEventLoop()
+	}
+
+	// DomainEventCallback receives domain lifecycle events with libvirt's
+	// VIR_DOMAIN_EVENT_* event and detail codes
+	DomainEventCallback func(domain BackendDomain, event int, detail int)
+
+	// BackendConnection is a hypervisor connection
+	// https://libvirt.org/html/libvirt-libvirt-host.html
+	BackendConnection interface {
+		Close() error
+		IsAlive() (bool, error)
+
+		LookupDomainByName(name string) (BackendDomain, error)
+		DomainDefineXML(xml string) (BackendDomain, error)
+		ListAllDomains(flags uint32) ([]BackendDomain, error)
+
+		LookupNetworkByName(name string) (BackendNetwork, error)
+		NetworkDefineXML(xml string) (BackendNetwork, error)
+		ListAllNetworks(flags uint32) ([]BackendNetwork, error)
+
+		LookupStoragePoolByName(name string) (BackendStoragePool, error)
+		ListAllStoragePools(flags uint32) ([]BackendStoragePool, error)
+		NewStream(flags uint32) (BackendStream, error)
+
+		DomainEventLifecycleRegister(callback DomainEventCallback) (int, error)
+		DomainEventDeregister(callbackID int) error
+	}
+
+	// BackendDomain is a hypervisor domain
+	// https://libvirt.org/html/libvirt-libvirt-domain.html
+	BackendDomain interface {
+		Free() error
+		GetName() (string, error)
+		GetState() ([]int, error)
+		GetXMLDesc(flags uint32) (string, error)
+		IsActive() (bool, error)
+		IsPersistent() (bool, error)
+		SetMetadata(metadataType int, metadata, key, uri string, flags uint32) error
+
+		Create() error
+		Destroy() error
+		Shutdown() error
+		Reboot(flags uint32) error
+		Suspend() error
+		Resume() error
+		Undefine() error
+		UndefineFlags(flags uint32) error
+
+		GetCPUStats(params *libvirt.VirTypedParameters, nParams int, startCPU int, nCPUs uint32, flags uint32) (int, error)
+		BlockStatsFlags(disk string, params *libvirt.VirTypedParameters, nParams int, flags uint32) (int, error)
+		InterfaceStats(path string) (libvirt.VirDomainInterfaceStats, error)
+
+		CreateSnapshotXML(xml string, flags uint32) (BackendSnapshot, error)
+		ListAllSnapshots(flags uint32) ([]BackendSnapshot, error)
+		SnapshotLookupByName(name string, flags uint32) (BackendSnapshot, error)
+
+		Migrate(dconn BackendConnection, flags uint32, dname string, uri string, bandwidth uint64) (BackendDomain, error)
+		MigrateSetMaxDowntime(downtime uint64, flags uint32) error
+		GetJobProgress() (*JobProgress, error)
+		AbortJob() error
+
+		AttachDeviceFlags(xml string, flags uint32) error
+		DetachDeviceFlags(xml string, flags uint32) error
+	}
+
+	// BackendNetwork is a hypervisor virtual network
+	// https://libvirt.org/html/libvirt-libvirt-network.html
+	BackendNetwork interface {
+		Free() error
+		GetName() (string, error)
+		GetXMLDesc(flags uint32) (string, error)
+		IsActive() (bool, error)
+		SetAutostart(autostart bool) error
+		Create() error
+		Destroy() error
+		Undefine() error
+	}
+
+	// BackendSnapshot is a hypervisor domain snapshot
+	// https://libvirt.org/html/libvirt-libvirt-domain-snapshot.html
+	BackendSnapshot interface {
+		Free() error
+		GetXMLDesc(flags uint32) (string, error)
+		RevertToSnapshot(flags uint32) error
+		Delete(flags uint32) error
+	}
+
+	// BackendStoragePool is a hypervisor storage pool
+	// https://libvirt.org/html/libvirt-libvirt-storage.html
+	BackendStoragePool interface {
+		Free() error
+		GetName() (string, error)
+		GetXMLDesc(flags uint32) (string, error)
+		IsActive() (bool, error)
+		Refresh(flags uint32) error
+
+		LookupStorageVolByName(name string) (BackendStorageVol, error)
+		StorageVolCreateXML(xml string, flags uint32) (BackendStorageVol, error)
+		ListAllStorageVolumes(flags uint32) ([]BackendStorageVol, error)
+	}
+
+	// BackendStorageVol is a volume in a hypervisor storage pool
+	// https://libvirt.org/html/libvirt-libvirt-storage.html
+	BackendStorageVol interface {
+		Free() error
+		GetName() (string, error)
+		GetXMLDesc(flags uint32) (string, error)
+		Delete(flags uint32) error
+		Resize(capacity uint64, flags uint32) error
+		// Upload and Download start a transfer of length bytes, or to the
+		// end of the volume if 0, from offset through a stream
+		Upload(stream BackendStream, offset uint64, length uint64, flags uint32) error
+		Download(stream BackendStream, offset uint64, length uint64, flags uint32) error
+	}
+
+	// BackendStream is a data stream to or from the hypervisor. Read returns
+	// io.EOF at the end of the data, and a transfer is completed with Finish
+	// or cancelled with Abort.
+	// https://libvirt.org/html/libvirt-libvirt-stream.html
+	BackendStream interface {
+		io.Reader
+		io.Writer
+		Finish() error
+		Abort() error
+		Free() error
+	}
+)
@@ -0,0 +1,2122 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexzorin/libvirt-go"
+	"github.com/pborman/uuid"
+)
+
+// userMetadataNamespace is understood by the fake backend's SetMetadata, along
+// with SnapshotNamespace and DeviceNamespace
+const userMetadataNamespace = "http://mistify.io/xml/user_metadata/1"
+
+// fakeDomainTypes are the virtualization types the fake backend accepts
+var fakeDomainTypes = map[string]bool{
+	"kvm":  true,
+	"qemu": true,
+	"test": true,
+}
+
+// fakeSnapshotStates maps domain states to libvirt snapshot state strings
+var fakeSnapshotStates = map[int]string{
+	libvirt.VIR_DOMAIN_RUNNING: "running",
+	libvirt.VIR_DOMAIN_PAUSED:  "paused",
+	libvirt.VIR_DOMAIN_SHUTOFF: "shutoff",
+}
+
+type (
+	// FakeBackend is an in-memory Backend for tests. Each uri is a separate
+	// hypervisor whose domains, networks, and snapshots go through the same
+	// state transitions, and fail with the same libvirt.VirError codes, as
+	// their libvirt counterparts. Events are delivered synchronously once
+	// StartEventLoop has been called.
+	FakeBackend struct {
+		mu             sync.Mutex
+		hypervisors    map[string]*fakeHypervisor
+		connections    []*fakeConnection
+		failures       map[string]error
+		ignoreShutdown map[string]bool
+		holdDisks      map[string]bool
+		eventLoop      bool
+		nextCallbackID int
+		pending        []fakeEvent
+	}
+
+	fakeHypervisor struct {
+		domains   map[string]*fakeDomainState
+		networks  map[string]*fakeNetworkState
+		pools     map[string]*fakePoolState
+		callbacks map[int]DomainEventCallback
+		nextVnet  int
+	}
+
+	fakeDomainState struct {
+		def        *VirDomain
+		state      int
+		persistent bool
+		autostart  bool
+		snapshots  []*fakeSnapshotState
+		current    string
+		// disks detached from the running domain but still in its config,
+		// and disks whose detach the guest has not acted on yet, mapped to
+		// whether the detach also removes them from the config
+		unplugged  map[string]bool
+		unplugging map[string]bool
+	}
+
+	fakeSnapshotState struct {
+		def    VirDomainSnapshot
+		domain *VirDomain
+		state  int
+	}
+
+	fakeNetworkState struct {
+		def        *VirNetwork
+		active     bool
+		persistent bool
+		autostart  bool
+	}
+
+	fakePoolState struct {
+		def     *VirStoragePool
+		active  bool
+		volumes map[string]*fakeVolumeState
+	}
+
+	fakeVolumeState struct {
+		def  *VirStorageVol
+		data []byte
+	}
+
+	fakeEvent struct {
+		callback DomainEventCallback
+		domain   BackendDomain
+		event    int
+		detail   int
+	}
+
+	fakeConnection struct {
+		b         *FakeBackend
+		h         *fakeHypervisor
+		closed    bool
+		callbacks []int
+	}
+
+	fakeDomain struct {
+		b    *FakeBackend
+		h    *fakeHypervisor
+		name string
+		uuid string
+	}
+
+	fakeNetwork struct {
+		b    *FakeBackend
+		h    *fakeHypervisor
+		name string
+		uuid string
+	}
+
+	fakeSnapshot struct {
+		d    *fakeDomain
+		name string
+	}
+
+	fakeStoragePool struct {
+		b    *FakeBackend
+		h    *fakeHypervisor
+		name string
+		uuid string
+	}
+
+	fakeStorageVol struct {
+		p    *fakeStoragePool
+		name string
+		key  string
+	}
+
+	// fakeStream buffers the data of a volume transfer. Uploads are written
+	// to the volume when finished.
+	fakeStream struct {
+		b      *FakeBackend
+		vol    *fakeStorageVol
+		upload bool
+		offset uint64
+		length uint64
+		buf    bytes.Buffer
+		done   bool
+	}
+)
+
+// NewFakeBackend creates a new FakeBackend with no hypervisors
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		hypervisors:    make(map[string]*fakeHypervisor),
+		failures:       make(map[string]error),
+		ignoreShutdown: make(map[string]bool),
+		holdDisks:      make(map[string]bool),
+	}
+}
+
+// FailOn makes every call of a method return err until it is cleared with a
+// nil err. Methods are named by interface and method, e.g. "Backend.Connect",
+// "Connection.DomainDefineXML", "Domain.Create", "Network.SetAutostart",
+// "Domain.AttachDeviceFlags", "Snapshot.Delete", "StoragePool.Refresh",
+// "StorageVol.Upload", or "Stream.Finish".
+func (b *FakeBackend) FailOn(method string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		delete(b.failures, method)
+		return
+	}
+	b.failures[method] = err
+}
+
+// IgnoreShutdown makes a domain ignore shutdown requests, like a guest without
+// ACPI support
+func (b *FakeBackend) IgnoreShutdown(name string, ignore bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ignoreShutdown[name] = ignore
+}
+
+// HoldDisks makes a running domain's guest hold on to disks detached from it,
+// like a guest that is slow to release them. The disks stay in the domain's
+// live definition until hold is cleared, which releases them.
+func (b *FakeBackend) HoldDisks(name string, hold bool) {
+	b.lock()
+	defer b.unlock()
+
+	b.holdDisks[name] = hold
+	if hold {
+		return
+	}
+	for _, h := range b.hypervisors {
+		if s, ok := h.domains[name]; ok {
+			s.releaseDisks()
+		}
+	}
+}
+
+// Disconnect closes every open connection, like a libvirtd restart
+func (b *FakeBackend) Disconnect() {
+	b.lock()
+	defer b.unlock()
+
+	for _, conn := range b.connections {
+		conn.close()
+	}
+	b.connections = nil
+}
+
+// Connect opens a connection to the hypervisor for a uri, creating it if needed
+func (b *FakeBackend) Connect(uri string) (BackendConnection, error) {
+	b.lock()
+	defer b.unlock()
+
+	if err := b.failures["Backend.Connect"]; err != nil {
+		return nil, err
+	}
+
+	h := b.hypervisor(uri)
+	conn := &fakeConnection{b: b, h: h}
+	b.connections = append(b.connections, conn)
+
+	return conn, nil
+}
+
+// hypervisor returns the hypervisor for a uri, creating it if needed. It must
+// be called with the backend locked.
+func (b *FakeBackend) hypervisor(uri string) *fakeHypervisor {
+	h, ok := b.hypervisors[uri]
+	if !ok {
+		h = &fakeHypervisor{
+			domains:   make(map[string]*fakeDomainState),
+			networks:  make(map[string]*fakeNetworkState),
+			pools:     make(map[string]*fakePoolState),
+			callbacks: make(map[int]DomainEventCallback),
+		}
+		b.hypervisors[uri] = h
+	}
+	return h
+}
+
+// DefineStoragePool adds a storage pool to the hypervisor for a uri. Volumes
+// of dir, fs, and netfs pools are sparse files; others are fully allocated
+// block devices that must fit in the pool's capacity.
+func (b *FakeBackend) DefineStoragePool(uri string, pool *VirStoragePool, active bool) {
+	b.lock()
+	defer b.unlock()
+
+	def := *pool
+	if def.UUID == "" {
+		def.UUID = uuid.New()
+	}
+	b.hypervisor(uri).pools[def.Name] = &fakePoolState{
+		def:     &def,
+		active:  active,
+		volumes: make(map[string]*fakeVolumeState),
+	}
+}
+
+// StartEventLoop starts delivering events to registered callbacks
+func (b *FakeBackend) StartEventLoop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.eventLoop = true
+}
+
+// lock and unlock guard all fake state. Events emitted while locked are
+// delivered by unlock so callbacks may call back into the backend.
+func (b *FakeBackend) lock() {
+	b.mu.Lock()
+}
+
+func (b *FakeBackend) unlock() {
+	events := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	for _, e := range events {
+		e.callback(e.domain, e.event, e.detail)
+	}
+}
+
+func (b *FakeBackend) emit(h *fakeHypervisor, def *VirDomain, event int, detail int) {
+	if !b.eventLoop {
+		return
+	}
+
+	ids := make([]int, 0, len(h.callbacks))
+	for id := range h.callbacks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		b.pending = append(b.pending, fakeEvent{
+			callback: h.callbacks[id],
+			domain:   &fakeDomain{b: b, h: h, name: def.Name, uuid: def.UUID},
+			event:    event,
+			detail:   detail,
+		})
+	}
+}
+
+func fakeError(code int, format string, args ...interface{}) error {
+	return libvirt.VirError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Level:   2,
+	}
+}
+
+// copyDomain deep copies a domain definition
+func copyDomain(v *VirDomain) (*VirDomain, error) {
+	x, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &VirDomain{}
+	if err = xml.Unmarshal(x, c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func matchFlags(flags, yes, no uint32, value bool) bool {
+	if flags&(yes|no) == 0 {
+		return true
+	}
+	return (flags&yes != 0 && value) || (flags&no != 0 && !value)
+}
+
+func (s *fakeDomainState) active() bool {
+	return s.state != libvirt.VIR_DOMAIN_SHUTOFF
+}
+
+// removeDisk removes a disk from the domain's config
+func (s *fakeDomainState) removeDisk(target string) {
+	for i, d := range s.def.Devices.Disks {
+		if d.Target.Device == target {
+			s.def.Devices.Disks = append(s.def.Devices.Disks[:i], s.def.Devices.Disks[i+1:]...)
+			break
+		}
+	}
+	delete(s.unplugged, target)
+	delete(s.unplugging, target)
+}
+
+// releaseDisks finishes the detaches the guest has not acted on
+func (s *fakeDomainState) releaseDisks() {
+	for target, config := range s.unplugging {
+		delete(s.unplugging, target)
+		if config {
+			s.removeDisk(target)
+			continue
+		}
+		if s.unplugged == nil {
+			s.unplugged = make(map[string]bool)
+		}
+		s.unplugged[target] = true
+	}
+}
+
+// liveDef returns the domain's live definition, without the disks detached
+// from it
+func (s *fakeDomainState) liveDef() (*VirDomain, error) {
+	if !s.active() || len(s.unplugged) == 0 {
+		return s.def, nil
+	}
+
+	def, err := copyDomain(s.def)
+	if err != nil {
+		return nil, err
+	}
+	disks := make([]Disk, 0, len(def.Devices.Disks))
+	for _, d := range def.Devices.Disks {
+		if !s.unplugged[d.Target.Device] {
+			disks = append(disks, d)
+		}
+	}
+	def.Devices.Disks = disks
+	return def, nil
+}
+
+func (s *fakeDomainState) snapshot(name string) (int, *fakeSnapshotState) {
+	for i, snapshot := range s.snapshots {
+		if snapshot.def.Name == name {
+			return i, snapshot
+		}
+	}
+	return -1, nil
+}
+
+// checkNetworks verifies that the networks used by a domain's interfaces exist
+// and are active
+func (h *fakeHypervisor) checkNetworks(def *VirDomain) error {
+	for _, iface := range def.Devices.Interfaces {
+		if iface.Type != "network" {
+			continue
+		}
+		n, ok := h.networks[iface.Source.Network]
+		if !ok {
+			return fakeError(libvirt.VIR_ERR_NO_NETWORK, "Network not found: no network with matching name '%s'", iface.Source.Network)
+		}
+		if !n.active {
+			return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: network '%s' is not active", iface.Source.Network)
+		}
+	}
+	return nil
+}
+
+// assignTargets gives each interface of a running domain a host device and
+// alias, as libvirt does when starting a domain
+func (h *fakeHypervisor) assignTargets(def *VirDomain) {
+	for i := range def.Devices.Interfaces {
+		iface := &def.Devices.Interfaces[i]
+		iface.Target = InterfaceTarget{Device: fmt.Sprintf("vnet%d", h.nextVnet)}
+		iface.Alias = InterfaceAlias{Name: fmt.Sprintf("net%d", i)}
+		h.nextVnet++
+	}
+}
+
+func clearTargets(def *VirDomain) {
+	for i := range def.Devices.Interfaces {
+		def.Devices.Interfaces[i].Target = InterfaceTarget{}
+		def.Devices.Interfaces[i].Alias = InterfaceAlias{}
+	}
+}
+
+// stop shuts off a domain. Transient domains disappear once stopped.
+func (b *FakeBackend) stop(h *fakeHypervisor, s *fakeDomainState, detail int) {
+	s.state = libvirt.VIR_DOMAIN_SHUTOFF
+	s.releaseDisks()
+	s.unplugged = nil
+	clearTargets(s.def)
+	b.emit(h, s.def, libvirt.VIR_DOMAIN_EVENT_STOPPED, detail)
+
+	if !s.persistent {
+		delete(h.domains, s.def.Name)
+	}
+}
+
+// Connection
+
+func (c *fakeConnection) close() {
+	c.closed = true
+	for _, id := range c.callbacks {
+		delete(c.h.callbacks, id)
+	}
+	c.callbacks = nil
+}
+
+func (c *fakeConnection) check(method string) error {
+	if err := c.b.failures["Connection."+method]; err != nil {
+		return err
+	}
+	if c.closed {
+		return fakeError(libvirt.VIR_ERR_INVALID_CONN, "invalid connection pointer in %s", method)
+	}
+	return nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("Close"); err != nil {
+		return err
+	}
+	c.close()
+
+	return nil
+}
+
+func (c *fakeConnection) IsAlive() (bool, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.b.failures["Connection.IsAlive"]; err != nil {
+		return false, err
+	}
+	return !c.closed, nil
+}
+
+func (c *fakeConnection) LookupDomainByName(name string) (BackendDomain, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("LookupDomainByName"); err != nil {
+		return nil, err
+	}
+
+	s, ok := c.h.domains[name]
+	if !ok {
+		return nil, fakeError(libvirt.VIR_ERR_NO_DOMAIN, "Domain not found: no domain with matching name '%s'", name)
+	}
+
+	return &fakeDomain{b: c.b, h: c.h, name: name, uuid: s.def.UUID}, nil
+}
+
+func (c *fakeConnection) DomainDefineXML(x string) (BackendDomain, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("DomainDefineXML"); err != nil {
+		return nil, err
+	}
+
+	def := &VirDomain{}
+	if err := xml.Unmarshal([]byte(x), def); err != nil {
+		return nil, fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+	}
+	if def.Name == "" {
+		return nil, fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: missing domain name")
+	}
+	if !fakeDomainTypes[def.Type] {
+		return nil, fakeError(libvirt.VIR_ERR_CONFIG_UNSUPPORTED, "unsupported configuration: unknown virt type '%s'", def.Type)
+	}
+
+	s, ok := c.h.domains[def.Name]
+	if !ok {
+		if def.UUID == "" {
+			def.UUID = uuid.New()
+		}
+		s = &fakeDomainState{
+			def:        def,
+			state:      libvirt.VIR_DOMAIN_SHUTOFF,
+			persistent: true,
+		}
+		c.h.domains[def.Name] = s
+		c.b.emit(c.h, def, libvirt.VIR_DOMAIN_EVENT_DEFINED, libvirt.VIR_DOMAIN_EVENT_DEFINED_ADDED)
+
+		return &fakeDomain{b: c.b, h: c.h, name: def.Name, uuid: def.UUID}, nil
+	}
+
+	if def.UUID != "" && def.UUID != s.def.UUID {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: domain '%s' is already defined with uuid %s", def.Name, s.def.UUID)
+	}
+	def.UUID = s.def.UUID
+	if s.active() {
+		c.h.assignTargets(def)
+	}
+	s.def = def
+	s.persistent = true
+	c.b.emit(c.h, def, libvirt.VIR_DOMAIN_EVENT_DEFINED, libvirt.VIR_DOMAIN_EVENT_DEFINED_UPDATED)
+
+	return &fakeDomain{b: c.b, h: c.h, name: def.Name, uuid: def.UUID}, nil
+}
+
+func (c *fakeConnection) ListAllDomains(flags uint32) ([]BackendDomain, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("ListAllDomains"); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(c.h.domains))
+	for name := range c.h.domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	domains := make([]BackendDomain, 0, len(names))
+	for _, name := range names {
+		s := c.h.domains[name]
+		if !matchFlags(flags, libvirt.VIR_CONNECT_LIST_DOMAINS_ACTIVE, libvirt.VIR_CONNECT_LIST_DOMAINS_INACTIVE, s.active()) ||
+			!matchFlags(flags, libvirt.VIR_CONNECT_LIST_DOMAINS_PERSISTENT, libvirt.VIR_CONNECT_LIST_DOMAINS_TRANSIENT, s.persistent) ||
+			!matchFlags(flags, libvirt.VIR_CONNECT_LIST_DOMAINS_AUTOSTART, libvirt.VIR_CONNECT_LIST_DOMAINS_NO_AUTOSTART, s.autostart) {
+			continue
+		}
+		domains = append(domains, &fakeDomain{b: c.b, h: c.h, name: name, uuid: s.def.UUID})
+	}
+
+	return domains, nil
+}
+
+func (c *fakeConnection) LookupNetworkByName(name string) (BackendNetwork, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("LookupNetworkByName"); err != nil {
+		return nil, err
+	}
+
+	s, ok := c.h.networks[name]
+	if !ok {
+		return nil, fakeError(libvirt.VIR_ERR_NO_NETWORK, "Network not found: no network with matching name '%s'", name)
+	}
+
+	return &fakeNetwork{b: c.b, h: c.h, name: name, uuid: s.def.UUID}, nil
+}
+
+func (c *fakeConnection) NetworkDefineXML(x string) (BackendNetwork, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("NetworkDefineXML"); err != nil {
+		return nil, err
+	}
+
+	def := &VirNetwork{}
+	if err := xml.Unmarshal([]byte(x), def); err != nil {
+		return nil, fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+	}
+	if def.Name == "" {
+		return nil, fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: missing network name")
+	}
+
+	s, ok := c.h.networks[def.Name]
+	if !ok {
+		if def.UUID == "" {
+			def.UUID = uuid.New()
+		}
+		c.h.networks[def.Name] = &fakeNetworkState{
+			def:        def,
+			persistent: true,
+		}
+
+		return &fakeNetwork{b: c.b, h: c.h, name: def.Name, uuid: def.UUID}, nil
+	}
+
+	if def.UUID != "" && def.UUID != s.def.UUID {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: network '%s' is already defined with uuid %s", def.Name, s.def.UUID)
+	}
+	def.UUID = s.def.UUID
+	s.def = def
+	s.persistent = true
+
+	return &fakeNetwork{b: c.b, h: c.h, name: def.Name, uuid: def.UUID}, nil
+}
+
+func (c *fakeConnection) ListAllNetworks(flags uint32) ([]BackendNetwork, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("ListAllNetworks"); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(c.h.networks))
+	for name := range c.h.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	networks := make([]BackendNetwork, 0, len(names))
+	for _, name := range names {
+		networks = append(networks, &fakeNetwork{b: c.b, h: c.h, name: name, uuid: c.h.networks[name].def.UUID})
+	}
+
+	return networks, nil
+}
+
+func (c *fakeConnection) LookupStoragePoolByName(name string) (BackendStoragePool, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("LookupStoragePoolByName"); err != nil {
+		return nil, err
+	}
+
+	s, ok := c.h.pools[name]
+	if !ok {
+		return nil, fakeError(libvirt.VIR_ERR_NO_STORAGE_POOL, "Storage pool not found: no storage pool with matching name '%s'", name)
+	}
+
+	return &fakeStoragePool{b: c.b, h: c.h, name: name, uuid: s.def.UUID}, nil
+}
+
+func (c *fakeConnection) ListAllStoragePools(flags uint32) ([]BackendStoragePool, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("ListAllStoragePools"); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(c.h.pools))
+	for name := range c.h.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pools := make([]BackendStoragePool, 0, len(names))
+	for _, name := range names {
+		s := c.h.pools[name]
+		if !matchFlags(flags, libvirt.VIR_CONNECT_LIST_STORAGE_POOLS_ACTIVE, libvirt.VIR_CONNECT_LIST_STORAGE_POOLS_INACTIVE, s.active) {
+			continue
+		}
+		pools = append(pools, &fakeStoragePool{b: c.b, h: c.h, name: name, uuid: s.def.UUID})
+	}
+
+	return pools, nil
+}
+
+func (c *fakeConnection) NewStream(flags uint32) (BackendStream, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("NewStream"); err != nil {
+		return nil, err
+	}
+
+	return &fakeStream{b: c.b}, nil
+}
+
+func (c *fakeConnection) DomainEventLifecycleRegister(callback DomainEventCallback) (int, error) {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("DomainEventLifecycleRegister"); err != nil {
+		return -1, err
+	}
+
+	id := c.b.nextCallbackID
+	c.b.nextCallbackID++
+	c.h.callbacks[id] = callback
+	c.callbacks = append(c.callbacks, id)
+
+	return id, nil
+}
+
+func (c *fakeConnection) DomainEventDeregister(callbackID int) error {
+	c.b.lock()
+	defer c.b.unlock()
+
+	if err := c.check("DomainEventDeregister"); err != nil {
+		return err
+	}
+
+	for i, id := range c.callbacks {
+		if id == callbackID {
+			c.callbacks = append(c.callbacks[:i], c.callbacks[i+1:]...)
+			delete(c.h.callbacks, id)
+			return nil
+		}
+	}
+
+	return fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: could not find event callback %d for deletion", callbackID)
+}
+
+// Domain
+
+// begin checks for an injected failure and looks up the domain's state. It
+// must be called with the backend locked.
+func (d *fakeDomain) begin(method string) (*fakeDomainState, error) {
+	if err := d.b.failures["Domain."+method]; err != nil {
+		return nil, err
+	}
+
+	s, ok := d.h.domains[d.name]
+	if !ok || s.def.UUID != d.uuid {
+		return nil, fakeError(libvirt.VIR_ERR_NO_DOMAIN, "Domain not found: no domain with matching uuid '%s' (%s)", d.uuid, d.name)
+	}
+
+	return s, nil
+}
+
+// beginActive is begin for methods that require a running domain
+func (d *fakeDomain) beginActive(method string) (*fakeDomainState, error) {
+	s, err := d.begin(method)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.active() {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: domain is not running")
+	}
+
+	return s, nil
+}
+
+func (d *fakeDomain) Free() error {
+	return nil
+}
+
+func (d *fakeDomain) GetName() (string, error) {
+	return d.name, nil
+}
+
+func (d *fakeDomain) GetState() ([]int, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("GetState")
+	if err != nil {
+		return nil, err
+	}
+
+	return []int{s.state, 0}, nil
+}
+
+func (d *fakeDomain) GetXMLDesc(flags uint32) (string, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("GetXMLDesc")
+	if err != nil {
+		return "", err
+	}
+
+	def := s.def
+	if flags&libvirt.VIR_DOMAIN_XML_INACTIVE == 0 {
+		if def, err = s.liveDef(); err != nil {
+			return "", err
+		}
+	}
+
+	x, err := xml.MarshalIndent(def, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(x), nil
+}
+
+func (d *fakeDomain) IsActive() (bool, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("IsActive")
+	if err != nil {
+		return false, err
+	}
+
+	return s.active(), nil
+}
+
+func (d *fakeDomain) IsPersistent() (bool, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("IsPersistent")
+	if err != nil {
+		return false, err
+	}
+
+	return s.persistent, nil
+}
+
+func (d *fakeDomain) SetMetadata(metadataType int, metadata, key, uri string, flags uint32) error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("SetMetadata")
+	if err != nil {
+		return err
+	}
+
+	if metadataType != libvirt.VIR_DOMAIN_METADATA_ELEMENT {
+		return fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: only element metadata is supported")
+	}
+
+	var v interface{}
+	switch uri {
+	case SnapshotNamespace:
+		v = &s.def.Metadata.Snapshots
+		s.def.Metadata.Snapshots = MetadataSnapshots{}
+	case DeviceNamespace:
+		v = &s.def.Metadata.Device
+		s.def.Metadata.Device = MetadataDevice{}
+	case userMetadataNamespace:
+		v = &s.def.Metadata.UserMetadata
+		s.def.Metadata.UserMetadata = UserMetadata{}
+	default:
+		return fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: unsupported metadata namespace '%s'", uri)
+	}
+
+	// empty metadata removes the element
+	if metadata == "" {
+		return nil
+	}
+
+	if err = xml.Unmarshal([]byte(metadata), v); err != nil {
+		return fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+	}
+
+	return nil
+}
+
+func (d *fakeDomain) Create() error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("Create")
+	if err != nil {
+		return err
+	}
+
+	if s.active() {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: domain is already running")
+	}
+	if err = d.h.checkNetworks(s.def); err != nil {
+		return err
+	}
+
+	s.state = libvirt.VIR_DOMAIN_RUNNING
+	d.h.assignTargets(s.def)
+	d.b.emit(d.h, s.def, libvirt.VIR_DOMAIN_EVENT_STARTED, libvirt.VIR_DOMAIN_EVENT_STARTED_BOOTED)
+
+	return nil
+}
+
+func (d *fakeDomain) Destroy() error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("Destroy")
+	if err != nil {
+		return err
+	}
+
+	d.b.stop(d.h, s, libvirt.VIR_DOMAIN_EVENT_STOPPED_DESTROYED)
+
+	return nil
+}
+
+func (d *fakeDomain) Shutdown() error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("Shutdown")
+	if err != nil {
+		return err
+	}
+
+	// the request is accepted, but the guest never acts on it
+	if d.b.ignoreShutdown[d.name] {
+		return nil
+	}
+
+	d.b.emit(d.h, s.def, libvirt.VIR_DOMAIN_EVENT_SHUTDOWN, libvirt.VIR_DOMAIN_EVENT_SHUTDOWN_FINISHED)
+	d.b.stop(d.h, s, libvirt.VIR_DOMAIN_EVENT_STOPPED_SHUTDOWN)
+
+	return nil
+}
+
+func (d *fakeDomain) Reboot(flags uint32) error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	_, err := d.beginActive("Reboot")
+	return err
+}
+
+func (d *fakeDomain) Suspend() error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("Suspend")
+	if err != nil {
+		return err
+	}
+
+	if s.state != libvirt.VIR_DOMAIN_PAUSED {
+		s.state = libvirt.VIR_DOMAIN_PAUSED
+		d.b.emit(d.h, s.def, libvirt.VIR_DOMAIN_EVENT_SUSPENDED, libvirt.VIR_DOMAIN_EVENT_SUSPENDED_PAUSED)
+	}
+
+	return nil
+}
+
+func (d *fakeDomain) Resume() error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("Resume")
+	if err != nil {
+		return err
+	}
+
+	if s.state == libvirt.VIR_DOMAIN_PAUSED {
+		s.state = libvirt.VIR_DOMAIN_RUNNING
+		d.b.emit(d.h, s.def, libvirt.VIR_DOMAIN_EVENT_RESUMED, libvirt.VIR_DOMAIN_EVENT_RESUMED_UNPAUSED)
+	}
+
+	return nil
+}
+
+func (d *fakeDomain) Undefine() error {
+	return d.UndefineFlags(0)
+}
+
+func (d *fakeDomain) UndefineFlags(flags uint32) error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("Undefine")
+	if err != nil {
+		return err
+	}
+
+	if !s.persistent {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: cannot undefine transient domain")
+	}
+	if len(s.snapshots) > 0 {
+		if flags&libvirt.VIR_DOMAIN_UNDEFINE_SNAPSHOTS_METADATA == 0 {
+			return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: cannot delete domain with %d snapshots", len(s.snapshots))
+		}
+		s.snapshots = nil
+		s.current = ""
+	}
+
+	// an active domain stays around as a transient domain until stopped
+	s.persistent = false
+	s.autostart = false
+	if !s.active() {
+		delete(d.h.domains, d.name)
+	}
+	d.b.emit(d.h, s.def, libvirt.VIR_DOMAIN_EVENT_UNDEFINED, libvirt.VIR_DOMAIN_EVENT_UNDEFINED_REMOVED)
+
+	return nil
+}
+
+func (d *fakeDomain) GetCPUStats(params *libvirt.VirTypedParameters, nParams int, startCPU int, nCPUs uint32, flags uint32) (int, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("GetCPUStats")
+	if err != nil {
+		return -1, err
+	}
+
+	cpus := s.def.VCPU
+	if cpus < 1 {
+		cpus = 1
+	}
+
+	if params == nil {
+		if nCPUs == 0 {
+			return cpus, nil
+		}
+		return 2, nil
+	}
+
+	if startCPU >= cpus {
+		return -1, fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: start_cpu %d larger than maximum of %d", startCPU, cpus-1)
+	}
+
+	for cpu := startCPU; cpu < startCPU+int(nCPUs) && cpu < cpus; cpu++ {
+		// one second of cpu time per cpu index, half of it spent in the guest
+		cpuTime := uint64(cpu+1) * uint64(time.Second)
+		*params = append(*params,
+			libvirt.VirTypedParameter{Name: "cpu_time", Value: cpuTime},
+			libvirt.VirTypedParameter{Name: "vcpu_time", Value: cpuTime / 2},
+		)
+	}
+
+	return len(*params), nil
+}
+
+func (d *fakeDomain) BlockStatsFlags(disk string, params *libvirt.VirTypedParameters, nParams int, flags uint32) (int, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("BlockStatsFlags")
+	if err != nil {
+		return -1, err
+	}
+
+	found := false
+	for _, dd := range s.def.Devices.Disks {
+		if dd.Target.Device == disk || (disk != "" && (dd.Source.Device == disk || dd.Source.File == disk)) {
+			found = true
+		}
+	}
+	if !found {
+		return -1, fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: invalid path: %s", disk)
+	}
+
+	names := []string{
+		"rd_operations", "rd_bytes", "rd_total_times",
+		"wr_operations", "wr_bytes", "wr_total_times",
+		"flush_operations", "flush_total_times",
+	}
+	if params == nil {
+		return len(names), nil
+	}
+
+	for _, name := range names {
+		*params = append(*params, libvirt.VirTypedParameter{Name: name, Value: int64(0)})
+	}
+
+	return len(*params), nil
+}
+
+func (d *fakeDomain) InterfaceStats(path string) (libvirt.VirDomainInterfaceStats, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("InterfaceStats")
+	if err != nil {
+		return libvirt.VirDomainInterfaceStats{}, err
+	}
+
+	for _, iface := range s.def.Devices.Interfaces {
+		if iface.Target.Device == path {
+			return libvirt.VirDomainInterfaceStats{}, nil
+		}
+	}
+
+	return libvirt.VirDomainInterfaceStats{}, fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: invalid path, '%s' is not a known interface", path)
+}
+
+func (d *fakeDomain) CreateSnapshotXML(x string, flags uint32) (BackendSnapshot, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("CreateSnapshotXML")
+	if err != nil {
+		return nil, err
+	}
+
+	def := VirDomainSnapshot{}
+	if err = xml.Unmarshal([]byte(x), &def); err != nil {
+		return nil, fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+	}
+	if def.Name == "" {
+		def.Name = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	if _, existing := s.snapshot(def.Name); existing != nil {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: domain snapshot %s already exists", def.Name)
+	}
+
+	domain, err := copyDomain(s.def)
+	if err != nil {
+		return nil, err
+	}
+
+	def.CreationTime = time.Now().Unix()
+	def.State = fakeSnapshotStates[s.state]
+	if s.current != "" {
+		def.Parent = &SnapshotParent{Name: s.current}
+	}
+
+	diskSnapshot := "internal"
+	def.Memory = &SnapshotMemory{Snapshot: "no"}
+	if flags&libvirt.VIR_DOMAIN_SNAPSHOT_CREATE_DISK_ONLY != 0 {
+		diskSnapshot = "external"
+		def.State = "disk-snapshot"
+	} else if s.active() {
+		def.Memory.Snapshot = "internal"
+	}
+	if len(s.def.Devices.Disks) > 0 {
+		def.Disks = &SnapshotDisks{}
+		for _, disk := range s.def.Devices.Disks {
+			def.Disks.Disks = append(def.Disks.Disks, SnapshotDisk{
+				Name:     disk.Target.Device,
+				Snapshot: diskSnapshot,
+			})
+		}
+	}
+
+	s.snapshots = append(s.snapshots, &fakeSnapshotState{
+		def:    def,
+		domain: domain,
+		state:  s.state,
+	})
+	s.current = def.Name
+
+	return &fakeSnapshot{d: d, name: def.Name}, nil
+}
+
+func (d *fakeDomain) ListAllSnapshots(flags uint32) ([]BackendSnapshot, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("ListAllSnapshots")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]BackendSnapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.snapshots {
+		snapshots = append(snapshots, &fakeSnapshot{d: d, name: snapshot.def.Name})
+	}
+
+	return snapshots, nil
+}
+
+func (d *fakeDomain) SnapshotLookupByName(name string, flags uint32) (BackendSnapshot, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("SnapshotLookupByName")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, snapshot := s.snapshot(name); snapshot == nil {
+		return nil, fakeError(libvirt.VIR_ERR_NO_DOMAIN_SNAPSHOT, "Domain snapshot not found: no domain snapshot with matching name '%s'", name)
+	}
+
+	return &fakeSnapshot{d: d, name: name}, nil
+}
+
+func (d *fakeDomain) Migrate(dconn BackendConnection, flags uint32, dname string, uri string, bandwidth uint64) (BackendDomain, error) {
+	conn, ok := dconn.(*fakeConnection)
+	if !ok || conn.b != d.b {
+		return nil, ErrUnsupportedConnection
+	}
+
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.beginActive("Migrate")
+	if err != nil {
+		return nil, err
+	}
+
+	if conn.closed {
+		return nil, fakeError(libvirt.VIR_ERR_INVALID_CONN, "invalid connection pointer in Migrate")
+	}
+	if conn.h == d.h {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: attempt to migrate guest to the same host")
+	}
+	if len(s.snapshots) > 0 {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: cannot migrate domain with %d snapshots", len(s.snapshots))
+	}
+
+	name := d.name
+	if dname != "" {
+		name = dname
+	}
+	if _, exists := conn.h.domains[name]; exists {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: domain '%s' already exists", name)
+	}
+	if err = conn.h.checkNetworks(s.def); err != nil {
+		return nil, err
+	}
+
+	def, err := copyDomain(s.def)
+	if err != nil {
+		return nil, err
+	}
+	def.Name = name
+	conn.h.assignTargets(def)
+
+	migrated := &fakeDomainState{
+		def:        def,
+		state:      s.state,
+		persistent: flags&libvirt.VIR_MIGRATE_PERSIST_DEST != 0,
+	}
+	if flags&libvirt.VIR_MIGRATE_PAUSED != 0 {
+		migrated.state = libvirt.VIR_DOMAIN_PAUSED
+	}
+	conn.h.domains[name] = migrated
+	if migrated.persistent {
+		d.b.emit(conn.h, def, libvirt.VIR_DOMAIN_EVENT_DEFINED, libvirt.VIR_DOMAIN_EVENT_DEFINED_ADDED)
+	}
+	d.b.emit(conn.h, def, libvirt.VIR_DOMAIN_EVENT_STARTED, libvirt.VIR_DOMAIN_EVENT_STARTED_MIGRATED)
+
+	if flags&libvirt.VIR_MIGRATE_UNDEFINE_SOURCE != 0 && s.persistent {
+		s.persistent = false
+		d.b.emit(d.h, s.def, libvirt.VIR_DOMAIN_EVENT_UNDEFINED, libvirt.VIR_DOMAIN_EVENT_UNDEFINED_REMOVED)
+	}
+	d.b.stop(d.h, s, libvirt.VIR_DOMAIN_EVENT_STOPPED_MIGRATED)
+
+	return &fakeDomain{b: d.b, h: conn.h, name: name, uuid: def.UUID}, nil
+}
+
+func (d *fakeDomain) MigrateSetMaxDowntime(downtime uint64, flags uint32) error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	_, err := d.beginActive("MigrateSetMaxDowntime")
+	return err
+}
+
+// GetJobProgress reports no active job, as fake migrations complete at once
+func (d *fakeDomain) GetJobProgress() (*JobProgress, error) {
+	d.b.lock()
+	defer d.b.unlock()
+
+	if _, err := d.beginActive("GetJobProgress"); err != nil {
+		return nil, err
+	}
+
+	return &JobProgress{Type: JobTypeNames[libvirt.VIR_DOMAIN_JOB_NONE]}, nil
+}
+
+// AbortJob always fails, as there is never an active job
+func (d *fakeDomain) AbortJob() error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	if _, err := d.beginActive("AbortJob"); err != nil {
+		return err
+	}
+
+	return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: no job is active on the domain")
+}
+
+// fakeDevice is the element of a device definition
+type fakeDevice struct {
+	XMLName xml.Name
+}
+
+func (d *fakeDomain) AttachDeviceFlags(x string, flags uint32) error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("AttachDeviceFlags")
+	if err != nil {
+		return err
+	}
+
+	live := flags&libvirt.VIR_DOMAIN_AFFECT_LIVE != 0
+	if live && !s.active() {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: domain is not running")
+	}
+
+	var device fakeDevice
+	if err = xml.Unmarshal([]byte(x), &device); err != nil {
+		return fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+	}
+
+	switch device.XMLName.Local {
+	case "disk":
+		var disk Disk
+		if err = xml.Unmarshal([]byte(x), &disk); err != nil {
+			return fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+		}
+		for _, dd := range s.def.Devices.Disks {
+			if dd.Target.Device == disk.Target.Device {
+				return fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: target %s already exists", disk.Target.Device)
+			}
+		}
+		if live && (disk.Target.Bus == "ide" || disk.Target.Bus == "sata") {
+			return fakeError(libvirt.VIR_ERR_CONFIG_UNSUPPORTED, "unsupported configuration: disk bus '%s' cannot be hotplugged.", disk.Target.Bus)
+		}
+		s.def.Devices.Disks = append(s.def.Devices.Disks, disk)
+	case "controller":
+		var controller Controller
+		if err = xml.Unmarshal([]byte(x), &controller); err != nil {
+			return fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+		}
+		s.def.Devices.Controllers = append(s.def.Devices.Controllers, controller)
+	default:
+		return fakeError(libvirt.VIR_ERR_CONFIG_UNSUPPORTED, "unsupported configuration: attach of device '%s' is not supported", device.XMLName.Local)
+	}
+
+	return nil
+}
+
+func (d *fakeDomain) DetachDeviceFlags(x string, flags uint32) error {
+	d.b.lock()
+	defer d.b.unlock()
+
+	s, err := d.begin("DetachDeviceFlags")
+	if err != nil {
+		return err
+	}
+
+	live := flags&libvirt.VIR_DOMAIN_AFFECT_LIVE != 0
+	if live && !s.active() {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: domain is not running")
+	}
+
+	var device fakeDevice
+	if err = xml.Unmarshal([]byte(x), &device); err != nil {
+		return fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+	}
+
+	switch device.XMLName.Local {
+	case "disk":
+		var disk Disk
+		if err = xml.Unmarshal([]byte(x), &disk); err != nil {
+			return fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+		}
+		target := disk.Target.Device
+		found := false
+		for _, dd := range s.def.Devices.Disks {
+			found = found || dd.Target.Device == target
+		}
+		if !found || (live && s.unplugged[target]) {
+			return fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: disk %s not found", target)
+		}
+
+		config := flags&libvirt.VIR_DOMAIN_AFFECT_CONFIG != 0 || !live
+		switch {
+		case live && d.b.holdDisks[d.name]:
+			// the guest is asked to release the disk and acts on it later
+			if s.unplugging == nil {
+				s.unplugging = make(map[string]bool)
+			}
+			s.unplugging[target] = config
+		case config:
+			s.removeDisk(target)
+		default:
+			if s.unplugged == nil {
+				s.unplugged = make(map[string]bool)
+			}
+			s.unplugged[target] = true
+		}
+		return nil
+	case "controller":
+		var controller Controller
+		if err = xml.Unmarshal([]byte(x), &controller); err != nil {
+			return fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+		}
+		for i, c := range s.def.Devices.Controllers {
+			if c.Type == controller.Type && c.Index == controller.Index {
+				s.def.Devices.Controllers = append(s.def.Devices.Controllers[:i], s.def.Devices.Controllers[i+1:]...)
+				return nil
+			}
+		}
+		return fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: device not found")
+	default:
+		return fakeError(libvirt.VIR_ERR_CONFIG_UNSUPPORTED, "unsupported configuration: detach of device '%s' is not supported", device.XMLName.Local)
+	}
+}
+
+// Network
+
+// begin checks for an injected failure and looks up the network's state. It
+// must be called with the backend locked.
+func (n *fakeNetwork) begin(method string) (*fakeNetworkState, error) {
+	if err := n.b.failures["Network."+method]; err != nil {
+		return nil, err
+	}
+
+	s, ok := n.h.networks[n.name]
+	if !ok || s.def.UUID != n.uuid {
+		return nil, fakeError(libvirt.VIR_ERR_NO_NETWORK, "Network not found: no network with matching uuid '%s' (%s)", n.uuid, n.name)
+	}
+
+	return s, nil
+}
+
+func (n *fakeNetwork) Free() error {
+	return nil
+}
+
+func (n *fakeNetwork) GetName() (string, error) {
+	return n.name, nil
+}
+
+func (n *fakeNetwork) GetXMLDesc(flags uint32) (string, error) {
+	n.b.lock()
+	defer n.b.unlock()
+
+	s, err := n.begin("GetXMLDesc")
+	if err != nil {
+		return "", err
+	}
+
+	x, err := xml.MarshalIndent(s.def, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(x), nil
+}
+
+func (n *fakeNetwork) IsActive() (bool, error) {
+	n.b.lock()
+	defer n.b.unlock()
+
+	s, err := n.begin("IsActive")
+	if err != nil {
+		return false, err
+	}
+
+	return s.active, nil
+}
+
+func (n *fakeNetwork) SetAutostart(autostart bool) error {
+	n.b.lock()
+	defer n.b.unlock()
+
+	s, err := n.begin("SetAutostart")
+	if err != nil {
+		return err
+	}
+
+	if !s.persistent {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: cannot set autostart for transient network")
+	}
+	s.autostart = autostart
+
+	return nil
+}
+
+func (n *fakeNetwork) Create() error {
+	n.b.lock()
+	defer n.b.unlock()
+
+	s, err := n.begin("Create")
+	if err != nil {
+		return err
+	}
+
+	if s.active {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: network is already active")
+	}
+	s.active = true
+
+	return nil
+}
+
+func (n *fakeNetwork) Destroy() error {
+	n.b.lock()
+	defer n.b.unlock()
+
+	s, err := n.begin("Destroy")
+	if err != nil {
+		return err
+	}
+
+	if !s.active {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: network is not active")
+	}
+	s.active = false
+	if !s.persistent {
+		delete(n.h.networks, n.name)
+	}
+
+	return nil
+}
+
+func (n *fakeNetwork) Undefine() error {
+	n.b.lock()
+	defer n.b.unlock()
+
+	s, err := n.begin("Undefine")
+	if err != nil {
+		return err
+	}
+
+	if !s.persistent {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: network '%s' is not persistent", n.name)
+	}
+
+	// an active network stays around as a transient network until destroyed
+	s.persistent = false
+	s.autostart = false
+	if !s.active {
+		delete(n.h.networks, n.name)
+	}
+
+	return nil
+}
+
+// Snapshot
+
+// begin checks for an injected failure and looks up the snapshot and its
+// domain's state. It must be called with the backend locked.
+func (s *fakeSnapshot) begin(method string) (*fakeDomainState, int, error) {
+	if err := s.d.b.failures["Snapshot."+method]; err != nil {
+		return nil, -1, err
+	}
+
+	ds, err := s.d.begin("")
+	if err != nil {
+		return nil, -1, err
+	}
+
+	i, _ := ds.snapshot(s.name)
+	if i < 0 {
+		return nil, -1, fakeError(libvirt.VIR_ERR_NO_DOMAIN_SNAPSHOT, "Domain snapshot not found: no domain snapshot with matching name '%s'", s.name)
+	}
+
+	return ds, i, nil
+}
+
+func (s *fakeSnapshot) Free() error {
+	return nil
+}
+
+func (s *fakeSnapshot) GetXMLDesc(flags uint32) (string, error) {
+	s.d.b.lock()
+	defer s.d.b.unlock()
+
+	ds, i, err := s.begin("GetXMLDesc")
+	if err != nil {
+		return "", err
+	}
+
+	x, err := xml.MarshalIndent(ds.snapshots[i].def, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(x), nil
+}
+
+func (s *fakeSnapshot) RevertToSnapshot(flags uint32) error {
+	b := s.d.b
+	h := s.d.h
+
+	b.lock()
+	defer b.unlock()
+
+	ds, i, err := s.begin("RevertToSnapshot")
+	if err != nil {
+		return err
+	}
+
+	snapshot := ds.snapshots[i]
+	if snapshot.def.External() {
+		return fakeError(libvirt.VIR_ERR_CONFIG_UNSUPPORTED, "unsupported configuration: revert to external snapshot not supported yet")
+	}
+
+	def, err := copyDomain(snapshot.domain)
+	if err != nil {
+		return err
+	}
+
+	wasActive := ds.active()
+	wasPaused := ds.state == libvirt.VIR_DOMAIN_PAUSED
+
+	clearTargets(def)
+	ds.def = def
+	ds.state = snapshot.state
+	ds.current = snapshot.def.Name
+
+	if !ds.active() {
+		if wasActive {
+			b.emit(h, def, libvirt.VIR_DOMAIN_EVENT_STOPPED, libvirt.VIR_DOMAIN_EVENT_STOPPED_FROM_SNAPSHOT)
+		}
+		return nil
+	}
+	h.assignTargets(def)
+
+	paused := ds.state == libvirt.VIR_DOMAIN_PAUSED
+	switch {
+	case !wasActive:
+		b.emit(h, def, libvirt.VIR_DOMAIN_EVENT_STARTED, libvirt.VIR_DOMAIN_EVENT_STARTED_FROM_SNAPSHOT)
+		if paused {
+			b.emit(h, def, libvirt.VIR_DOMAIN_EVENT_SUSPENDED, libvirt.VIR_DOMAIN_EVENT_SUSPENDED_FROM_SNAPSHOT)
+		}
+	case paused && !wasPaused:
+		b.emit(h, def, libvirt.VIR_DOMAIN_EVENT_SUSPENDED, libvirt.VIR_DOMAIN_EVENT_SUSPENDED_FROM_SNAPSHOT)
+	case !paused && wasPaused:
+		b.emit(h, def, libvirt.VIR_DOMAIN_EVENT_RESUMED, libvirt.VIR_DOMAIN_EVENT_RESUMED_FROM_SNAPSHOT)
+	}
+
+	return nil
+}
+
+func (s *fakeSnapshot) Delete(flags uint32) error {
+	s.d.b.lock()
+	defer s.d.b.unlock()
+
+	ds, i, err := s.begin("Delete")
+	if err != nil {
+		return err
+	}
+
+	deleted := ds.snapshots[i]
+	var parent string
+	if deleted.def.Parent != nil {
+		parent = deleted.def.Parent.Name
+	}
+
+	remove := map[string]bool{deleted.def.Name: true}
+	if flags&libvirt.VIR_DOMAIN_SNAPSHOT_DELETE_CHILDREN != 0 {
+		// snapshots are created after their parents, so one pass in order
+		// finds every descendant
+		for _, snapshot := range ds.snapshots {
+			if snapshot.def.Parent != nil && remove[snapshot.def.Parent.Name] {
+				remove[snapshot.def.Name] = true
+			}
+		}
+	}
+
+	snapshots := make([]*fakeSnapshotState, 0, len(ds.snapshots))
+	for _, snapshot := range ds.snapshots {
+		if remove[snapshot.def.Name] {
+			continue
+		}
+		// children of a deleted snapshot are reparented to its parent
+		if snapshot.def.Parent != nil && snapshot.def.Parent.Name == deleted.def.Name {
+			snapshot.def.Parent = nil
+			if parent != "" {
+				snapshot.def.Parent = &SnapshotParent{Name: parent}
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	ds.snapshots = snapshots
+
+	if remove[ds.current] {
+		ds.current = parent
+	}
+
+	return nil
+}
+
+// Storage pool
+
+// begin checks for an injected failure and looks up the pool's state. It must
+// be called with the backend locked.
+func (p *fakeStoragePool) begin(method string) (*fakePoolState, error) {
+	if err := p.b.failures["StoragePool."+method]; err != nil {
+		return nil, err
+	}
+
+	s, ok := p.h.pools[p.name]
+	if !ok || s.def.UUID != p.uuid {
+		return nil, fakeError(libvirt.VIR_ERR_NO_STORAGE_POOL, "Storage pool not found: no storage pool with matching uuid '%s' (%s)", p.uuid, p.name)
+	}
+
+	return s, nil
+}
+
+// beginActive is begin for methods that need the pool to be active
+func (p *fakeStoragePool) beginActive(method string) (*fakePoolState, error) {
+	s, err := p.begin(method)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.active {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: storage pool '%s' is not active", p.name)
+	}
+
+	return s, nil
+}
+
+// sparse returns whether the pool's volumes are sparse files
+func (s *fakePoolState) sparse() bool {
+	return filePoolTypes[s.def.Type]
+}
+
+// allocation returns the bytes allocated to the pool's volumes
+func (s *fakePoolState) allocation() uint64 {
+	var allocation uint64
+	for _, v := range s.volumes {
+		allocation += v.allocation(s)
+	}
+	return allocation
+}
+
+// allocation returns the bytes allocated to a volume: what has been written
+// for sparse volumes, or the capacity
+func (v *fakeVolumeState) allocation(pool *fakePoolState) uint64 {
+	if pool.sparse() {
+		return uint64(len(v.data))
+	}
+	return v.def.Capacity
+}
+
+func (p *fakeStoragePool) Free() error {
+	return nil
+}
+
+func (p *fakeStoragePool) GetName() (string, error) {
+	return p.name, nil
+}
+
+func (p *fakeStoragePool) GetXMLDesc(flags uint32) (string, error) {
+	p.b.lock()
+	defer p.b.unlock()
+
+	s, err := p.begin("GetXMLDesc")
+	if err != nil {
+		return "", err
+	}
+
+	def := *s.def
+	if s.active {
+		def.Allocation = s.allocation()
+		def.Available = def.Capacity - def.Allocation
+	}
+
+	x, err := xml.MarshalIndent(def, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(x), nil
+}
+
+func (p *fakeStoragePool) IsActive() (bool, error) {
+	p.b.lock()
+	defer p.b.unlock()
+
+	s, err := p.begin("IsActive")
+	if err != nil {
+		return false, err
+	}
+
+	return s.active, nil
+}
+
+func (p *fakeStoragePool) Refresh(flags uint32) error {
+	p.b.lock()
+	defer p.b.unlock()
+
+	_, err := p.beginActive("Refresh")
+	return err
+}
+
+func (p *fakeStoragePool) LookupStorageVolByName(name string) (BackendStorageVol, error) {
+	p.b.lock()
+	defer p.b.unlock()
+
+	s, err := p.beginActive("LookupStorageVolByName")
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := s.volumes[name]
+	if !ok {
+		return nil, fakeError(libvirt.VIR_ERR_NO_STORAGE_VOL, "Storage volume not found: no storage vol with matching name '%s'", name)
+	}
+
+	return &fakeStorageVol{p: p, name: name, key: v.def.Key}, nil
+}
+
+func (p *fakeStoragePool) StorageVolCreateXML(x string, flags uint32) (BackendStorageVol, error) {
+	p.b.lock()
+	defer p.b.unlock()
+
+	s, err := p.beginActive("StorageVolCreateXML")
+	if err != nil {
+		return nil, err
+	}
+
+	def := &VirStorageVol{}
+	if err := xml.Unmarshal([]byte(x), def); err != nil {
+		return nil, fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: %s", err)
+	}
+	if def.Name == "" {
+		return nil, fakeError(libvirt.VIR_ERR_XML_ERROR, "XML error: missing volume name element")
+	}
+	if _, ok := s.volumes[def.Name]; ok {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: storage vol '%s' already exists", def.Name)
+	}
+	if !s.sparse() && def.Capacity > s.def.Capacity-s.allocation() {
+		return nil, fakeError(libvirt.VIR_ERR_OPERATION_FAILED, "operation failed: not enough space left in storage pool '%s'", p.name)
+	}
+
+	def.Target.Path = s.def.Target.Path + "/" + def.Name
+	def.Key = def.Target.Path
+	def.Type = "block"
+	if s.sparse() {
+		def.Type = "file"
+		if def.Target.Format == nil {
+			def.Target.Format = &StorageFormat{Type: "raw"}
+		}
+	} else {
+		def.Target.Format = nil
+	}
+
+	s.volumes[def.Name] = &fakeVolumeState{def: def}
+
+	return &fakeStorageVol{p: p, name: def.Name, key: def.Key}, nil
+}
+
+func (p *fakeStoragePool) ListAllStorageVolumes(flags uint32) ([]BackendStorageVol, error) {
+	p.b.lock()
+	defer p.b.unlock()
+
+	s, err := p.beginActive("ListAllStorageVolumes")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(s.volumes))
+	for name := range s.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vols := make([]BackendStorageVol, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &fakeStorageVol{p: p, name: name, key: s.volumes[name].def.Key})
+	}
+
+	return vols, nil
+}
+
+// Storage volume
+
+// begin checks for an injected failure and looks up the volume's state and
+// its pool's. It must be called with the backend locked.
+func (v *fakeStorageVol) begin(method string) (*fakePoolState, *fakeVolumeState, error) {
+	if err := v.p.b.failures["StorageVol."+method]; err != nil {
+		return nil, nil, err
+	}
+
+	return v.state()
+}
+
+// state looks up the volume's state and its pool's. It must be called with the
+// backend locked.
+func (v *fakeStorageVol) state() (*fakePoolState, *fakeVolumeState, error) {
+	pool, ok := v.p.h.pools[v.p.name]
+	if !ok || pool.def.UUID != v.p.uuid || !pool.active {
+		return nil, nil, fakeError(libvirt.VIR_ERR_NO_STORAGE_VOL, "Storage volume not found: no storage vol with matching key '%s'", v.key)
+	}
+
+	s, ok := pool.volumes[v.name]
+	if !ok || s.def.Key != v.key {
+		return nil, nil, fakeError(libvirt.VIR_ERR_NO_STORAGE_VOL, "Storage volume not found: no storage vol with matching key '%s'", v.key)
+	}
+
+	return pool, s, nil
+}
+
+func (v *fakeStorageVol) Free() error {
+	return nil
+}
+
+func (v *fakeStorageVol) GetName() (string, error) {
+	return v.name, nil
+}
+
+func (v *fakeStorageVol) GetXMLDesc(flags uint32) (string, error) {
+	v.p.b.lock()
+	defer v.p.b.unlock()
+
+	pool, s, err := v.begin("GetXMLDesc")
+	if err != nil {
+		return "", err
+	}
+
+	def := *s.def
+	def.Allocation = s.allocation(pool)
+
+	x, err := xml.MarshalIndent(def, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(x), nil
+}
+
+func (v *fakeStorageVol) Delete(flags uint32) error {
+	v.p.b.lock()
+	defer v.p.b.unlock()
+
+	pool, _, err := v.begin("Delete")
+	if err != nil {
+		return err
+	}
+
+	delete(pool.volumes, v.name)
+
+	return nil
+}
+
+func (v *fakeStorageVol) Resize(capacity uint64, flags uint32) error {
+	v.p.b.lock()
+	defer v.p.b.unlock()
+
+	pool, s, err := v.begin("Resize")
+	if err != nil {
+		return err
+	}
+
+	if capacity < s.def.Capacity && flags&libvirt.VIR_STORAGE_VOL_RESIZE_SHRINK == 0 {
+		return fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: Can't shrink capacity below existing capacity unless shrink flag explicitly specified")
+	}
+	if !pool.sparse() && capacity > s.def.Capacity && capacity-s.def.Capacity > pool.def.Capacity-pool.allocation() {
+		return fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: Not enough space left in storage pool")
+	}
+
+	s.def.Capacity = capacity
+	if uint64(len(s.data)) > capacity {
+		s.data = s.data[:capacity]
+	}
+
+	return nil
+}
+
+// transfer checks the range of a volume transfer and starts it on a stream
+func (v *fakeStorageVol) transfer(method string, stream BackendStream, offset uint64, length uint64, upload bool) error {
+	v.p.b.lock()
+	defer v.p.b.unlock()
+
+	_, s, err := v.begin(method)
+	if err != nil {
+		return err
+	}
+
+	st, ok := stream.(*fakeStream)
+	if !ok {
+		return ErrUnsupportedStream
+	}
+	if st.vol != nil || st.done {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: stream is already in use")
+	}
+	if offset > s.def.Capacity || length > s.def.Capacity-offset {
+		return fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: range %d+%d is beyond the capacity of volume '%s'", offset, length, v.name)
+	}
+
+	st.vol = v
+	st.upload = upload
+	st.offset = offset
+	st.length = length
+	if length == 0 {
+		st.length = s.def.Capacity - offset
+	}
+
+	if !upload {
+		data := make([]byte, st.length)
+		if offset < uint64(len(s.data)) {
+			copy(data, s.data[offset:])
+		}
+		st.buf.Write(data)
+	}
+
+	return nil
+}
+
+func (v *fakeStorageVol) Upload(stream BackendStream, offset uint64, length uint64, flags uint32) error {
+	return v.transfer("Upload", stream, offset, length, true)
+}
+
+func (v *fakeStorageVol) Download(stream BackendStream, offset uint64, length uint64, flags uint32) error {
+	return v.transfer("Download", stream, offset, length, false)
+}
+
+// Stream
+
+// check checks for an injected failure and that the stream is transferring in
+// a direction. It must be called with the backend locked.
+func (st *fakeStream) check(method string, upload bool) error {
+	if err := st.b.failures["Stream."+method]; err != nil {
+		return err
+	}
+	if st.vol == nil || st.done || st.upload != upload {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: stream is not open")
+	}
+	return nil
+}
+
+func (st *fakeStream) Read(p []byte) (int, error) {
+	st.b.lock()
+	defer st.b.unlock()
+
+	if err := st.check("Read", false); err != nil {
+		return 0, err
+	}
+	if st.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return st.buf.Read(p)
+}
+
+func (st *fakeStream) Write(p []byte) (int, error) {
+	st.b.lock()
+	defer st.b.unlock()
+
+	if err := st.check("Write", true); err != nil {
+		return 0, err
+	}
+	if uint64(st.buf.Len()+len(p)) > st.length {
+		return 0, fakeError(libvirt.VIR_ERR_INVALID_ARG, "invalid argument: more data than the %d bytes requested", st.length)
+	}
+
+	return st.buf.Write(p)
+}
+
+func (st *fakeStream) Finish() error {
+	st.b.lock()
+	defer st.b.unlock()
+
+	if st.vol == nil || st.done {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: stream is not open")
+	}
+	if err := st.b.failures["Stream.Finish"]; err != nil {
+		return err
+	}
+	st.done = true
+
+	if !st.upload {
+		return nil
+	}
+
+	_, s, err := st.vol.state()
+	if err != nil {
+		return err
+	}
+
+	end := st.offset + uint64(st.buf.Len())
+	if end > uint64(len(s.data)) {
+		data := make([]byte, end)
+		copy(data, s.data)
+		s.data = data
+	}
+	copy(s.data[st.offset:], st.buf.Bytes())
+
+	return nil
+}
+
+func (st *fakeStream) Abort() error {
+	st.b.lock()
+	defer st.b.unlock()
+
+	if st.vol == nil || st.done {
+		return fakeError(libvirt.VIR_ERR_OPERATION_INVALID, "Requested operation is not valid: stream is not open")
+	}
+	st.done = true
+	st.buf.Reset()
+
+	return nil
+}
+
+func (st *fakeStream) Free() error {
+	return nil
+}
@@ -0,0 +1,553 @@
+package libvirt_test
+
+import (
+	"errors"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alexzorin/libvirt-go"
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+const fakeURI = "fake:///default"
+
+type guestRPC func(*http.Request, *rpc.GuestRequest, *rpc.GuestResponse) error
+
+func fakeSetup(t *testing.T) (*mlibvirt.Libvirt, *mlibvirt.FakeBackend, *client.Guest) {
+	backend := mlibvirt.NewFakeBackend()
+	lv, err := mlibvirt.NewLibvirtWithBackend(backend, fakeURI, "", 2)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+
+	guest := &client.Guest{
+		ID:       "fake-guest",
+		Type:     "test",
+		Memory:   512,
+		CPU:      2,
+		Metadata: map[string]string{"owner": "mistify"},
+		Disks: []client.Disk{
+			{Image: "ubuntu", Source: "/dev/zvol/mistify/fake-guest-0"},
+		},
+		Nics: []client.Nic{
+			{Name: "eth0", Mac: "02:00:00:00:00:01", Network: "mistify0", VLANs: []int{1, 2}},
+		},
+	}
+
+	response := &rpc.GuestResponse{}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, response); err != nil {
+		t.Fatalf("CreateGuest failed: %s\n", err.Error())
+	}
+
+	return lv, backend, response.Guest
+}
+
+func call(t *testing.T, name string, fn guestRPC, guest *client.Guest, expectedState string) *client.Guest {
+	response := &rpc.GuestResponse{}
+	if err := fn(nil, &rpc.GuestRequest{Guest: guest}, response); err != nil {
+		t.Fatalf("%s failed: %s\n", name, err.Error())
+	}
+
+	if response.Guest.State != expectedState {
+		t.Fatalf("After %s, expected state %s, got state %s\n", name, expectedState, response.Guest.State)
+	}
+
+	return response.Guest
+}
+
+func expectVirError(t *testing.T, name string, err error, code int) {
+	virErr, ok := err.(libvirt.VirError)
+	if !ok {
+		t.Fatalf("%s: expected libvirt error %d, got %v\n", name, code, err)
+	}
+	if virErr.Code != code {
+		t.Fatalf("%s: expected libvirt error %d, got %d: %s\n", name, code, virErr.Code, virErr.Message)
+	}
+}
+
+func TestFakeLifecycle(t *testing.T) {
+	lv, _, guest := fakeSetup(t)
+
+	guest = call(t, "Status", lv.Status, guest, "shutoff")
+	if guest.Metadata["owner"] != "mistify" {
+		t.Fatalf("Expected metadata to be persisted, got %v\n", guest.Metadata)
+	}
+
+	guest = call(t, "Run", lv.Run, guest, "running")
+	// nic devices are only known once the domain is running
+	guest = call(t, "Run", lv.Run, guest, "running")
+	if guest.Nics[0].Device == "" || guest.Nics[0].Name == "" {
+		t.Fatalf("Expected nic device and name after Run, got %+v\n", guest.Nics[0])
+	}
+
+	guest = call(t, "Pause", lv.Pause, guest, "paused")
+	guest = call(t, "Pause", lv.Pause, guest, "paused")
+	guest = call(t, "Resume", lv.Resume, guest, "running")
+	guest = call(t, "Resume", lv.Resume, guest, "running")
+	guest = call(t, "Reboot", lv.Reboot, guest, "running")
+	guest = call(t, "Shutdown", lv.Shutdown, guest, "shutoff")
+	guest = call(t, "Shutdown", lv.Shutdown, guest, "shutoff")
+	guest = call(t, "Run", lv.Run, guest, "running")
+	guest = call(t, "Poweroff", lv.Poweroff, guest, "shutoff")
+
+	if err := lv.Reboot(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err == nil {
+		t.Fatalf("Expected Reboot of a stopped guest to fail\n")
+	} else {
+		expectVirError(t, "Reboot", err, libvirt.VIR_ERR_OPERATION_INVALID)
+	}
+
+	list := &mlibvirt.ListGuestsResponse{}
+	if err := lv.ListGuests(nil, &mlibvirt.ListGuestsRequest{Active: true}, list); err != nil {
+		t.Fatalf("ListGuests failed: %s\n", err.Error())
+	}
+	if len(list.Guests) != 0 {
+		t.Fatalf("Expected no active guests, got %d\n", len(list.Guests))
+	}
+	if err := lv.ListGuests(nil, &mlibvirt.ListGuestsRequest{Inactive: true}, list); err != nil {
+		t.Fatalf("ListGuests failed: %s\n", err.Error())
+	}
+	if len(list.Guests) != 1 || list.Guests[0].State != "shutoff" {
+		t.Fatalf("Expected one shutoff guest, got %+v\n", list.Guests)
+	}
+	if err := lv.ListGuests(nil, &mlibvirt.ListGuestsRequest{Active: true, Inactive: true}, list); err != nil {
+		t.Fatalf("ListGuests failed: %s\n", err.Error())
+	}
+	if len(list.Guests) != 1 {
+		t.Fatalf("Expected active or inactive to match the shutoff guest, got %+v\n", list.Guests)
+	}
+
+	call(t, "Delete", lv.Delete, guest, guest.State)
+
+	if _, err := lv.LookupDomainByName(guest.ID); err == nil {
+		t.Fatalf("Expected domain to be deleted\n")
+	} else {
+		expectVirError(t, "LookupDomainByName", err, libvirt.VIR_ERR_NO_DOMAIN)
+	}
+	if _, err := lv.LookupNetworkByName(guest.Nics[0].Mac); err == nil {
+		t.Fatalf("Expected network to be deleted\n")
+	} else {
+		expectVirError(t, "LookupNetworkByName", err, libvirt.VIR_ERR_NO_NETWORK)
+	}
+}
+
+func TestFakeGuestErrors(t *testing.T) {
+	lv, backend, guest := fakeSetup(t)
+
+	if err := lv.GracefulShutdown(nil, &mlibvirt.ShutdownRequest{}, &mlibvirt.ShutdownResponse{}); err != syscall.EINVAL {
+		t.Fatalf("Expected EINVAL for a missing guest, got %v\n", err)
+	}
+
+	// calls that lock the guest check for it first
+	locked := map[string]func(*http.Request, *rpc.GuestRequest, *rpc.GuestResponse) error{
+		"Poweroff": lv.Poweroff,
+		"Delete":   lv.Delete,
+		"Create":   lv.Create,
+		"Run":      lv.Run,
+		"Reboot":   lv.Reboot,
+		"Shutdown": lv.Shutdown,
+		"Pause":    lv.Pause,
+		"Resume":   lv.Resume,
+	}
+	for name, fn := range locked {
+		if err := fn(nil, &rpc.GuestRequest{}, &rpc.GuestResponse{}); err != syscall.EINVAL {
+			t.Fatalf("Expected EINVAL from %s for a missing guest, got %v\n", name, err)
+		}
+	}
+
+	missing := &client.Guest{ID: "missing"}
+	if err := lv.Status(nil, &rpc.GuestRequest{Guest: missing}, &rpc.GuestResponse{}); err == nil {
+		t.Fatalf("Expected Status of a missing guest to fail\n")
+	} else {
+		expectVirError(t, "Status", err, libvirt.VIR_ERR_NO_DOMAIN)
+	}
+
+	injected := errors.New("injected")
+	backend.FailOn("Domain.Create", injected)
+	if err := lv.Run(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != injected {
+		t.Fatalf("Expected injected error from Run, got %v\n", err)
+	}
+	backend.FailOn("Domain.Create", nil)
+
+	backend.FailOn("Backend.Connect", injected)
+	backend.Disconnect()
+	if err := lv.Status(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != injected {
+		t.Fatalf("Expected injected error from Status while disconnected, got %v\n", err)
+	}
+	backend.FailOn("Backend.Connect", nil)
+
+	// pooled connections reconnect once libvirtd is back
+	call(t, "Status", lv.Status, guest, "shutoff")
+}
+
+func TestFakeGracefulShutdown(t *testing.T) {
+	lv, backend, guest := fakeSetup(t)
+
+	guest = call(t, "Run", lv.Run, guest, "running")
+	backend.IgnoreShutdown(guest.ID, true)
+
+	response := &mlibvirt.ShutdownResponse{}
+	request := &mlibvirt.ShutdownRequest{Guest: guest, Timeout: 1}
+	if err := lv.GracefulShutdown(nil, request, response); err != mlibvirt.ErrShutdownTimeout {
+		t.Fatalf("Expected ErrShutdownTimeout, got %v\n", err)
+	}
+
+	request.Force = true
+	if err := lv.GracefulShutdown(nil, request, response); err != nil {
+		t.Fatalf("GracefulShutdown failed: %s\n", err.Error())
+	}
+	if response.Method != mlibvirt.ShutdownMethodPoweroff || response.Guest.State != "shutoff" {
+		t.Fatalf("Expected poweroff to shutoff, got %s to %s\n", response.Method, response.Guest.State)
+	}
+
+	// a guest that can't be asked to shut down, e.g. without ACPI, is only
+	// powered off with force
+	guest = call(t, "Run", lv.Run, response.Guest, "running")
+	injected := errors.New("injected")
+	backend.FailOn("Domain.Shutdown", injected)
+	request = &mlibvirt.ShutdownRequest{Guest: guest, Timeout: 1}
+	if err := lv.GracefulShutdown(nil, request, response); err != injected {
+		t.Fatalf("Expected injected error from GracefulShutdown, got %v\n", err)
+	}
+	call(t, "Status", lv.Status, guest, "running")
+
+	request.Force = true
+	if err := lv.GracefulShutdown(nil, request, response); err != nil {
+		t.Fatalf("GracefulShutdown failed: %s\n", err.Error())
+	}
+	if response.Method != mlibvirt.ShutdownMethodPoweroff || response.Guest.State != "shutoff" {
+		t.Fatalf("Expected poweroff to shutoff, got %s to %s\n", response.Method, response.Guest.State)
+	}
+}
+
+func TestFakeMetrics(t *testing.T) {
+	lv, _, guest := fakeSetup(t)
+
+	request := &rpc.GuestMetricsRequest{Guest: guest}
+	response := &rpc.GuestMetricsResponse{}
+	if err := lv.CPUMetrics(nil, request, response); err == nil {
+		t.Fatalf("Expected CPUMetrics of a stopped guest to fail\n")
+	}
+
+	guest = call(t, "Run", lv.Run, guest, "running")
+	guest = call(t, "Run", lv.Run, guest, "running")
+	request.Guest = guest
+
+	if err := lv.CPUMetrics(nil, request, response); err != nil {
+		t.Fatalf("CPUMetrics failed: %s\n", err.Error())
+	}
+	if len(response.CPU) != int(guest.CPU) || response.CPU[1].CPUTime != 2 {
+		t.Fatalf("Unexpected cpu metrics: %+v\n", response.CPU)
+	}
+
+	if err := lv.DiskMetrics(nil, request, response); err != nil {
+		t.Fatalf("DiskMetrics failed: %s\n", err.Error())
+	}
+	if _, ok := response.Disk[guest.Disks[0].Device]; !ok {
+		t.Fatalf("Expected disk metrics for %s, got %+v\n", guest.Disks[0].Device, response.Disk)
+	}
+
+	if err := lv.NicMetrics(nil, request, response); err != nil {
+		t.Fatalf("NicMetrics failed: %s\n", err.Error())
+	}
+	if _, ok := response.Nic[guest.Nics[0].Name]; !ok {
+		t.Fatalf("Expected nic metrics for %s, got %+v\n", guest.Nics[0].Name, response.Nic)
+	}
+}
+
+func TestFakeSnapshots(t *testing.T) {
+	lv, _, guest := fakeSetup(t)
+
+	guest = call(t, "Run", lv.Run, guest, "running")
+
+	snap := func(fn func(*http.Request, *mlibvirt.SnapshotRequest, *mlibvirt.SnapshotResponse) error, request *mlibvirt.SnapshotRequest) *mlibvirt.SnapshotResponse {
+		request.Guest = guest
+		response := &mlibvirt.SnapshotResponse{}
+		if err := fn(nil, request, response); err != nil {
+			t.Fatalf("Snapshot %s failed: %s\n", request.Name, err.Error())
+		}
+		guest = response.Guest
+		return response
+	}
+
+	methods := map[string]func(*http.Request, *mlibvirt.SnapshotRequest, *mlibvirt.SnapshotResponse) error{
+		"CreateSnapshot": lv.CreateSnapshot,
+		"ListSnapshots":  lv.ListSnapshots,
+		"RevertSnapshot": lv.RevertSnapshot,
+		"DeleteSnapshot": lv.DeleteSnapshot,
+	}
+	for name, fn := range methods {
+		for _, g := range []*client.Guest{nil, {}} {
+			request := &mlibvirt.SnapshotRequest{Guest: g, Name: "first"}
+			if err := fn(nil, request, &mlibvirt.SnapshotResponse{}); err != syscall.EINVAL {
+				t.Fatalf("Expected EINVAL from %s for guest %+v, got %v\n", name, g, err)
+			}
+		}
+	}
+
+	snap(lv.CreateSnapshot, &mlibvirt.SnapshotRequest{Name: "first", Metadata: map[string]string{"reason": "test"}})
+	response := snap(lv.CreateSnapshot, &mlibvirt.SnapshotRequest{Name: "second", DiskOnly: true})
+	if len(response.Snapshots) != 1 || len(response.Snapshots[0].Children) != 1 {
+		t.Fatalf("Expected one root with one child, got %+v\n", response.Snapshots)
+	}
+	if !response.Snapshots[0].Children[0].External {
+		t.Fatalf("Expected disk only snapshot to be external\n")
+	}
+
+	if err := lv.RevertSnapshot(nil, &mlibvirt.SnapshotRequest{Guest: guest, Name: "second"}, &mlibvirt.SnapshotResponse{}); err == nil {
+		t.Fatalf("Expected revert to an external snapshot to fail\n")
+	}
+
+	call(t, "Poweroff", lv.Poweroff, guest, "shutoff")
+	response = snap(lv.RevertSnapshot, &mlibvirt.SnapshotRequest{Name: "first"})
+	if response.Guest.State != "running" {
+		t.Fatalf("Expected revert to a running snapshot to start the guest, got %s\n", response.Guest.State)
+	}
+	if response.Snapshots[0].Metadata["reason"] != "test" {
+		t.Fatalf("Expected snapshot metadata to survive revert, got %+v\n", response.Snapshots[0])
+	}
+
+	response = snap(lv.DeleteSnapshot, &mlibvirt.SnapshotRequest{Name: "first", Recursive: true})
+	if len(response.Snapshots) != 0 {
+		t.Fatalf("Expected no snapshots after recursive delete, got %+v\n", response.Snapshots)
+	}
+
+	// a running guest with snapshots is deleted along with them
+	snap(lv.CreateSnapshot, &mlibvirt.SnapshotRequest{Name: "last"})
+	call(t, "Delete", lv.Delete, guest, guest.State)
+
+	if _, err := lv.LookupDomainByName(guest.ID); err == nil {
+		t.Fatalf("Expected domain to be deleted\n")
+	} else {
+		expectVirError(t, "LookupDomainByName", err, libvirt.VIR_ERR_NO_DOMAIN)
+	}
+	list := &mlibvirt.ListGuestsResponse{}
+	if err := lv.ListGuests(nil, &mlibvirt.ListGuestsRequest{}, list); err != nil {
+		t.Fatalf("ListGuests failed: %s\n", err.Error())
+	}
+	if len(list.Guests) != 0 {
+		t.Fatalf("Expected no guests left behind, got %+v\n", list.Guests)
+	}
+}
+
+func TestFakeCreateGuestRollback(t *testing.T) {
+	lv, backend, guest := fakeSetup(t)
+
+	guest.ID = "rollback-guest"
+	guest.Nics[0].Mac = "02:00:00:00:00:02"
+
+	backend.FailOn("Connection.DomainDefineXML", errors.New("injected"))
+	err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{})
+	stepErr, ok := err.(*mlibvirt.StepError)
+	if !ok || stepErr.Step != "define domain" {
+		t.Fatalf("Expected CreateGuest to fail defining the domain, got %v\n", err)
+	}
+
+	if _, err := lv.LookupNetworkByName(guest.Nics[0].Mac); err == nil {
+		t.Fatalf("Expected network to be rolled back\n")
+	}
+}
+
+func TestFakeReconcile(t *testing.T) {
+	lv, backend, guest := fakeSetup(t)
+
+	conn, err := backend.Connect(fakeURI)
+	if err != nil {
+		t.Fatalf("Connect failed: %s\n", err.Error())
+	}
+	if _, err = conn.DomainDefineXML(`<domain type="test"><name>stray</name><memory>1024</memory><vcpu>1</vcpu></domain>`); err != nil {
+		t.Fatalf("DomainDefineXML failed: %s\n", err.Error())
+	}
+
+	response := &mlibvirt.ReconcileResponse{}
+	request := &mlibvirt.ReconcileRequest{Guests: []*client.Guest{guest}, Remove: true}
+	if err = lv.Reconcile(nil, request, response); err != nil {
+		t.Fatalf("Reconcile failed: %s\n", err.Error())
+	}
+	if len(response.RemovedDomains) != 1 || response.RemovedDomains[0] != "stray" {
+		t.Fatalf("Expected stray domain to be removed, got %+v\n", response)
+	}
+	if len(response.DivergedDomains) != 0 || len(response.DivergedNetworks) != 0 {
+		t.Fatalf("Expected no divergence, got %+v\n", response)
+	}
+}
+
+func TestFakeReconcileLocking(t *testing.T) {
+	backend := mlibvirt.NewFakeBackend()
+	lv, err := mlibvirt.NewLibvirtWithBackend(backend, fakeURI, "", 1)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+
+	conn, err := backend.Connect(fakeURI)
+	if err != nil {
+		t.Fatalf("Connect failed: %s\n", err.Error())
+	}
+	domain, err := conn.DomainDefineXML(`<domain type="test"><name>stray</name><memory>1024</memory><vcpu>1</vcpu></domain>`)
+	if err != nil {
+		t.Fatalf("DomainDefineXML failed: %s\n", err.Error())
+	}
+	if err = domain.Create(); err != nil {
+		t.Fatalf("Create failed: %s\n", err.Error())
+	}
+	backend.IgnoreShutdown("stray", true)
+
+	// the stray domain's lock is held while its shutdown times out, and
+	// Reconcile waits for it
+	shutdown := make(chan error, 1)
+	go func() {
+		request := &mlibvirt.ShutdownRequest{Guest: &client.Guest{ID: "stray"}, Timeout: 2}
+		shutdown <- lv.GracefulShutdown(nil, request, &mlibvirt.ShutdownResponse{})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	response := &mlibvirt.ReconcileResponse{}
+	reconciled := make(chan error, 1)
+	go func() {
+		reconciled <- lv.Reconcile(nil, &mlibvirt.ReconcileRequest{Remove: true}, response)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// without keeping the only pooled connection from other calls
+	if err = lv.ListGuests(nil, &mlibvirt.ListGuestsRequest{}, &mlibvirt.ListGuestsResponse{}); err != nil {
+		t.Fatalf("ListGuests failed: %s\n", err.Error())
+	}
+	select {
+	case err = <-shutdown:
+		t.Fatalf("Expected ListGuests not to wait for the guest lock, shutdown finished first with %v\n", err)
+	default:
+	}
+
+	if err = <-shutdown; err != mlibvirt.ErrShutdownTimeout {
+		t.Fatalf("Expected ErrShutdownTimeout, got %v\n", err)
+	}
+	if err = <-reconciled; err != nil {
+		t.Fatalf("Reconcile failed: %s\n", err.Error())
+	}
+	if len(response.RemovedDomains) != 1 || response.RemovedDomains[0] != "stray" {
+		t.Fatalf("Expected stray domain to be removed, got %+v\n", response)
+	}
+}
+
+func TestFakeMigrate(t *testing.T) {
+	lv, backend, guest := fakeSetup(t)
+
+	guest = call(t, "Run", lv.Run, guest, "running")
+
+	request := &mlibvirt.MigrateRequest{Guest: guest, URI: "fake:///destination"}
+	if err := lv.Migrate(nil, request, &mlibvirt.MigrateResponse{}); err == nil {
+		t.Fatalf("Expected Migrate to fail without the guest's networks on the destination\n")
+	} else {
+		expectVirError(t, "Migrate", err, libvirt.VIR_ERR_NO_NETWORK)
+	}
+
+	dconn, err := backend.Connect(request.URI)
+	if err != nil {
+		t.Fatalf("Connect failed: %s\n", err.Error())
+	}
+	x, err := lv.NetworkXML(guest.Nics[0])
+	if err != nil {
+		t.Fatalf("NetworkXML failed: %s\n", err.Error())
+	}
+	network, err := dconn.NetworkDefineXML(x)
+	if err != nil {
+		t.Fatalf("NetworkDefineXML failed: %s\n", err.Error())
+	}
+	if err = network.Create(); err != nil {
+		t.Fatalf("Network Create failed: %s\n", err.Error())
+	}
+
+	response := &mlibvirt.MigrateResponse{}
+	if err = lv.Migrate(nil, request, response); err != nil {
+		t.Fatalf("Migrate failed: %s\n", err.Error())
+	}
+	if response.Guest.State != "running" {
+		t.Fatalf("Expected migrated guest to be running, got %s\n", response.Guest.State)
+	}
+
+	if _, err = lv.LookupDomainByName(guest.ID); err == nil {
+		t.Fatalf("Expected source domain to be undefined\n")
+	}
+	if _, err = dconn.LookupDomainByName(guest.ID); err != nil {
+		t.Fatalf("Expected domain on the destination: %s\n", err.Error())
+	}
+}
+
+func TestFakeEvents(t *testing.T) {
+	lv, _, guest := fakeSetup(t)
+
+	em := lv.NewEventMonitor(10)
+	if err := em.Start(); err != nil {
+		t.Fatalf("EventMonitor Start failed: %s\n", err.Error())
+	}
+	defer func() {
+		if err := em.Stop(); err != nil {
+			t.Fatalf("EventMonitor Stop failed: %s\n", err.Error())
+		}
+	}()
+
+	guest = call(t, "Run", lv.Run, guest, "running")
+	guest = call(t, "Pause", lv.Pause, guest, "paused")
+	call(t, "Poweroff", lv.Poweroff, guest, "shutoff")
+
+	expected := []string{"started", "suspended", "stopped"}
+	events := em.Since(0, 0)
+	if len(events) != len(expected) {
+		t.Fatalf("Expected events %v, got %+v\n", expected, events)
+	}
+	for i, e := range events {
+		if e.Event != expected[i] || e.GuestID != guest.ID {
+			t.Fatalf("Expected event %s for %s, got %+v\n", expected[i], guest.ID, e)
+		}
+	}
+	if events[2].Reason != "destroyed" || events[2].State != "shutoff" {
+		t.Fatalf("Expected destroyed to shutoff, got %+v\n", events[2])
+	}
+}
+
+func TestFakeEventMonitorStartStop(t *testing.T) {
+	lv, _, _ := fakeSetup(t)
+	em := lv.NewEventMonitor(10)
+
+	// only one of several concurrent starts runs the monitor
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- em.Start()
+		}()
+	}
+	started := 0
+	for i := 0; i < cap(errs); i++ {
+		switch err := <-errs; err {
+		case nil:
+			started++
+		case mlibvirt.ErrEventMonitorRunning:
+		default:
+			t.Fatalf("EventMonitor Start failed: %s\n", err.Error())
+		}
+	}
+	if started != 1 {
+		t.Fatalf("Expected one start to succeed, got %d\n", started)
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- em.Stop()
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("EventMonitor Stop failed: %s\n", err.Error())
+		}
+	}
+
+	// a stopped monitor can be started again
+	if err := em.Start(); err != nil {
+		t.Fatalf("EventMonitor restart failed: %s\n", err.Error())
+	}
+	if err := em.Stop(); err != nil {
+		t.Fatalf("EventMonitor Stop failed: %s\n", err.Error())
+	}
+}
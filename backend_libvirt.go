@@ -0,0 +1,318 @@
+package libvirt
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+)
+
+type (
+	// LibvirtBackend is a Backend using libvirtd through libvirt-go
+	LibvirtBackend struct {
+		eventLoop sync.Once
+	}
+
+	libvirtConnection struct {
+		*libvirt.VirConnection
+		callbacks map[int]*libvirt.DomainEventCallback
+	}
+
+	libvirtDomain struct {
+		*libvirt.VirDomain
+	}
+
+	libvirtNetwork struct {
+		*libvirt.VirNetwork
+	}
+
+	libvirtSnapshot struct {
+		*libvirt.VirDomainSnapshot
+	}
+
+	libvirtStoragePool struct {
+		*libvirt.VirStoragePool
+	}
+
+	libvirtStorageVol struct {
+		*libvirt.VirStorageVol
+	}
+
+	libvirtStream struct {
+		*libvirt.VirStream
+	}
+)
+
+// ErrUnsupportedConnection is returned when mixing connections from different
+// backends, such as migrating between them
+var ErrUnsupportedConnection = errors.New("connection is not from this backend")
+
+// ErrUnsupportedStream is returned when using a stream from a different backend
+// for a volume transfer
+var ErrUnsupportedStream = errors.New("stream is not from this backend")
+
+// Connect opens a connection to libvirtd
+func (b *LibvirtBackend) Connect(uri string) (BackendConnection, error) {
+	conn, err := libvirt.NewVirConnection(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return &libvirtConnection{
+		VirConnection: &conn,
+		callbacks:     make(map[int]*libvirt.DomainEventCallback),
+	}, nil
+}
+
+// StartEventLoop registers and runs the default libvirt event loop
+func (b *LibvirtBackend) StartEventLoop() {
+	b.eventLoop.Do(func() {
+		libvirt.EventRegisterDefaultImpl()
+		go func() {
+			for {
+				if libvirt.EventRunDefaultImpl() < 0 {
+					log.Error("failed to run libvirt event loop")
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+	})
+}
+
+func (c *libvirtConnection) Close() error {
+	_, err := c.CloseConnection()
+	return err
+}
+
+func (c *libvirtConnection) LookupDomainByName(name string) (BackendDomain, error) {
+	domain, err := c.VirConnection.LookupDomainByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtDomain{&domain}, nil
+}
+
+func (c *libvirtConnection) DomainDefineXML(xml string) (BackendDomain, error) {
+	domain, err := c.VirConnection.DomainDefineXML(xml)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtDomain{&domain}, nil
+}
+
+func (c *libvirtConnection) ListAllDomains(flags uint32) ([]BackendDomain, error) {
+	domains, err := c.VirConnection.ListAllDomains(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BackendDomain, len(domains))
+	for i := range domains {
+		list[i] = &libvirtDomain{&domains[i]}
+	}
+	return list, nil
+}
+
+func (c *libvirtConnection) LookupNetworkByName(name string) (BackendNetwork, error) {
+	network, err := c.VirConnection.LookupNetworkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtNetwork{&network}, nil
+}
+
+func (c *libvirtConnection) NetworkDefineXML(xml string) (BackendNetwork, error) {
+	network, err := c.VirConnection.NetworkDefineXML(xml)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtNetwork{&network}, nil
+}
+
+func (c *libvirtConnection) ListAllNetworks(flags uint32) ([]BackendNetwork, error) {
+	networks, err := c.VirConnection.ListAllNetworks(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BackendNetwork, len(networks))
+	for i := range networks {
+		list[i] = &libvirtNetwork{&networks[i]}
+	}
+	return list, nil
+}
+
+func (c *libvirtConnection) LookupStoragePoolByName(name string) (BackendStoragePool, error) {
+	pool, err := c.VirConnection.LookupStoragePoolByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStoragePool{&pool}, nil
+}
+
+func (c *libvirtConnection) ListAllStoragePools(flags uint32) ([]BackendStoragePool, error) {
+	pools, err := c.VirConnection.ListAllStoragePools(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BackendStoragePool, len(pools))
+	for i := range pools {
+		list[i] = &libvirtStoragePool{&pools[i]}
+	}
+	return list, nil
+}
+
+func (c *libvirtConnection) NewStream(flags uint32) (BackendStream, error) {
+	stream, err := libvirt.NewVirStream(c.VirConnection, uint(flags))
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStream{stream}, nil
+}
+
+func (c *libvirtConnection) DomainEventLifecycleRegister(callback DomainEventCallback) (int, error) {
+	cb := libvirt.DomainEventCallback(func(c *libvirt.VirConnection, d *libvirt.VirDomain, event interface{}, f func()) int {
+		if lifecycle, ok := event.(libvirt.DomainLifecycleEvent); ok {
+			callback(&libvirtDomain{d}, lifecycle.Event, lifecycle.Detail)
+		}
+		return 0
+	})
+
+	callbackID := c.DomainEventRegister(libvirt.VirDomain{}, libvirt.VIR_DOMAIN_EVENT_ID_LIFECYCLE, &cb, func() {})
+	if callbackID < 0 {
+		return callbackID, errors.New("failed to register for domain events")
+	}
+	// keep the callback referenced for as long as it is registered
+	c.callbacks[callbackID] = &cb
+
+	return callbackID, nil
+}
+
+func (c *libvirtConnection) DomainEventDeregister(callbackID int) error {
+	delete(c.callbacks, callbackID)
+	if c.VirConnection.DomainEventDeregister(callbackID) < 0 {
+		return errors.New("failed to deregister for domain events")
+	}
+	return nil
+}
+
+func (d *libvirtDomain) CreateSnapshotXML(xml string, flags uint32) (BackendSnapshot, error) {
+	snapshot, err := d.VirDomain.CreateSnapshotXML(xml, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtSnapshot{&snapshot}, nil
+}
+
+func (d *libvirtDomain) ListAllSnapshots(flags uint32) ([]BackendSnapshot, error) {
+	snapshots, err := d.VirDomain.ListAllSnapshots(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BackendSnapshot, len(snapshots))
+	for i := range snapshots {
+		list[i] = &libvirtSnapshot{&snapshots[i]}
+	}
+	return list, nil
+}
+
+func (d *libvirtDomain) SnapshotLookupByName(name string, flags uint32) (BackendSnapshot, error) {
+	snapshot, err := d.VirDomain.SnapshotLookupByName(name, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtSnapshot{&snapshot}, nil
+}
+
+func (d *libvirtDomain) Migrate(dconn BackendConnection, flags uint32, dname string, uri string, bandwidth uint64) (BackendDomain, error) {
+	conn, ok := dconn.(*libvirtConnection)
+	if !ok {
+		return nil, ErrUnsupportedConnection
+	}
+
+	domain, err := d.VirDomain.Migrate(conn.VirConnection, flags, dname, uri, bandwidth)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtDomain{&domain}, nil
+}
+
+func (d *libvirtDomain) GetJobProgress() (*JobProgress, error) {
+	info, err := d.GetJobInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	return &JobProgress{
+		Type:          JobTypeNames[info.Type()],
+		TimeElapsed:   info.TimeElapsed(),
+		TimeRemaining: info.TimeRemaining(),
+		DataTotal:     info.DataTotal(),
+		DataProcessed: info.DataProcessed(),
+		DataRemaining: info.DataRemaining(),
+	}, nil
+}
+
+func (p *libvirtStoragePool) LookupStorageVolByName(name string) (BackendStorageVol, error) {
+	vol, err := p.VirStoragePool.LookupStorageVolByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStorageVol{&vol}, nil
+}
+
+func (p *libvirtStoragePool) StorageVolCreateXML(xml string, flags uint32) (BackendStorageVol, error) {
+	vol, err := p.VirStoragePool.StorageVolCreateXML(xml, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStorageVol{&vol}, nil
+}
+
+func (p *libvirtStoragePool) ListAllStorageVolumes(flags uint32) ([]BackendStorageVol, error) {
+	vols, err := p.VirStoragePool.ListAllStorageVolumes(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BackendStorageVol, len(vols))
+	for i := range vols {
+		list[i] = &libvirtStorageVol{&vols[i]}
+	}
+	return list, nil
+}
+
+func (v *libvirtStorageVol) Upload(stream BackendStream, offset uint64, length uint64, flags uint32) error {
+	s, ok := stream.(*libvirtStream)
+	if !ok {
+		return ErrUnsupportedStream
+	}
+	return v.VirStorageVol.Upload(s.VirStream, offset, length, flags)
+}
+
+func (v *libvirtStorageVol) Download(stream BackendStream, offset uint64, length uint64, flags uint32) error {
+	s, ok := stream.(*libvirtStream)
+	if !ok {
+		return ErrUnsupportedStream
+	}
+	return v.VirStorageVol.Download(s.VirStream, offset, length, flags)
+}
+
+// Read reads from the stream, returning io.EOF once libvirt has no more data
+func (s *libvirtStream) Read(p []byte) (int, error) {
+	n, err := s.VirStream.Read(p)
+	if n == 0 && err == nil && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// Finish completes a transfer, reporting any error from the other end
+func (s *libvirtStream) Finish() error {
+	return s.Close()
+}
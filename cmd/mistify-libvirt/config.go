@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-libvirt"
+	flag "github.com/spf13/pflag"
+)
+
+// envPrefix is the prefix of environment variables overriding config settings,
+// e.g. MISTIFY_LIBVIRT_URI for uri
+const envPrefix = "MISTIFY_LIBVIRT_"
+
+type (
+	// Config is the agent configuration. Settings are taken from, in
+	// increasing order of precedence, the defaults, the JSON config file,
+	// MISTIFY_LIBVIRT_* environment variables, and command line flags.
+	Config struct {
+		URI               string   `json:"uri"`
+		PoolSize          int      `json:"pool_size"`
+		Address           string   `json:"address"`
+		Port              uint     `json:"port"`
+		Zpool             string   `json:"zpool"`
+		ZFSCommand        string   `json:"zfs_command"`
+		LogLevel          string   `json:"log_level"`
+		ShutdownTimeout   Duration `json:"shutdown_timeout"`
+		DetachTimeout     Duration `json:"detach_timeout"`
+		ReadTimeout       Duration `json:"read_timeout"`
+		WriteTimeout      Duration `json:"write_timeout"`
+		LockTimeout       Duration `json:"lock_timeout"`
+		JobRetention      Duration `json:"job_retention"`
+		IdempotencyWindow Duration `json:"idempotency_window"`
+		// HTTPS is served when a certificate and key are given, and client
+		// certificates are required when a client CA is given
+		TLSCert            string   `json:"tls_cert"`
+		TLSKey             string   `json:"tls_key"`
+		TLSClientCA        string   `json:"tls_client_ca"`
+		TLSAllowedSubjects []string `json:"tls_allowed_subjects"`
+		// Authorization policy file; all calls are allowed when not set
+		Policy string `json:"policy"`
+		// Audit log file of mutating calls, rotated at AuditMaxSize MiB
+		AuditLog      string `json:"audit_log"`
+		AuditMaxSize  int    `json:"audit_max_size"`
+		AuditMaxFiles int    `json:"audit_max_files"`
+	}
+
+	// Duration is a time.Duration read from JSON as a string such as "90s"
+	Duration struct {
+		time.Duration
+	}
+)
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() *Config {
+	return &Config{
+		URI:               "qemu:///system",
+		PoolSize:          4,
+		Port:              20001,
+		Zpool:             "mistify",
+		ZFSCommand:        libvirt.DefaultZFSCommand,
+		LogLevel:          "warning",
+		ShutdownTimeout:   Duration{libvirt.DefaultShutdownTimeout},
+		DetachTimeout:     Duration{libvirt.DefaultDetachTimeout},
+		LockTimeout:       Duration{libvirt.DefaultLockTimeout},
+		JobRetention:      Duration{libvirt.DefaultJobRetention},
+		IdempotencyWindow: Duration{libvirt.DefaultIdempotencyWindow},
+		AuditMaxSize:      libvirt.DefaultAuditMaxSize >> 20,
+		AuditMaxFiles:     libvirt.DefaultAuditMaxFiles,
+	}
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"90s\": %s", err)
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+
+	return nil
+}
+
+// MarshalJSON formats a duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// setters parse setting values into the fields of a config, keyed by setting
+// name. Flags use the same names with dashes instead of underscores.
+func (c *Config) setters() map[string]func(string) error {
+	return map[string]func(string) error{
+		"uri":                  setString(&c.URI),
+		"pool_size":            setInt(&c.PoolSize),
+		"address":              setString(&c.Address),
+		"port":                 setUint(&c.Port),
+		"zpool":                setString(&c.Zpool),
+		"zfs_command":          setString(&c.ZFSCommand),
+		"log_level":            setString(&c.LogLevel),
+		"shutdown_timeout":     setDuration(&c.ShutdownTimeout.Duration),
+		"detach_timeout":       setDuration(&c.DetachTimeout.Duration),
+		"read_timeout":         setDuration(&c.ReadTimeout.Duration),
+		"write_timeout":        setDuration(&c.WriteTimeout.Duration),
+		"lock_timeout":         setDuration(&c.LockTimeout.Duration),
+		"job_retention":        setDuration(&c.JobRetention.Duration),
+		"idempotency_window":   setDuration(&c.IdempotencyWindow.Duration),
+		"tls_cert":             setString(&c.TLSCert),
+		"tls_key":              setString(&c.TLSKey),
+		"tls_client_ca":        setString(&c.TLSClientCA),
+		"tls_allowed_subjects": setStrings(&c.TLSAllowedSubjects),
+		"policy":               setString(&c.Policy),
+		"audit_log":            setString(&c.AuditLog),
+		"audit_max_size":       setInt(&c.AuditMaxSize),
+		"audit_max_files":      setInt(&c.AuditMaxFiles),
+	}
+}
+
+func setString(p *string) func(string) error {
+	return func(value string) error {
+		*p = value
+		return nil
+	}
+}
+
+func setInt(p *int) func(string) error {
+	return func(value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*p = i
+		return nil
+	}
+}
+
+func setUint(p *uint) func(string) error {
+	return func(value string) error {
+		i, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		*p = uint(i)
+		return nil
+	}
+}
+
+// setStrings parses a comma separated list. Flag values are formatted as
+// "[a,b]".
+func setStrings(p *[]string) func(string) error {
+	return func(value string) error {
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		values := make([]string, 0)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		*p = values
+		return nil
+	}
+}
+
+func setDuration(p *time.Duration) func(string) error {
+	return func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*p = d
+		return nil
+	}
+}
+
+// LoadFile reads settings from a JSON config file. Settings missing from the
+// file are left unchanged.
+func (c *Config) LoadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(c); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return nil
+}
+
+// LoadEnv reads settings from MISTIFY_LIBVIRT_* environment variables
+func (c *Config) LoadEnv() error {
+	for name, set := range c.setters() {
+		key := envPrefix + strings.ToUpper(name)
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		if err := set(value); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+// LoadFlags reads settings from the command line flags that were set
+func (c *Config) LoadFlags() error {
+	setters := c.setters()
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		set, ok := setters[strings.Replace(f.Name, "-", "_", -1)]
+		if !ok || err != nil {
+			return
+		}
+		if e := set(f.Value.String()); e != nil {
+			err = fmt.Errorf("--%s: %s", f.Name, e)
+		}
+	})
+
+	return err
+}
+
+// Validate checks that the settings are usable
+func (c *Config) Validate() error {
+	if c.URI == "" {
+		return errors.New("uri is required")
+	}
+	if c.PoolSize < 1 {
+		return errors.New("pool_size must be at least 1")
+	}
+	if c.Port == 0 || c.Port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if c.ZFSCommand == "" {
+		return errors.New("zfs_command is required")
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+	if c.DetachTimeout.Duration <= 0 {
+		return errors.New("detach_timeout must be positive")
+	}
+	if c.LockTimeout.Duration <= 0 {
+		return errors.New("lock_timeout must be positive")
+	}
+	if c.JobRetention.Duration < 0 {
+		return errors.New("job_retention must not be negative")
+	}
+	if c.IdempotencyWindow.Duration < 0 {
+		return errors.New("idempotency_window must not be negative")
+	}
+	if c.ReadTimeout.Duration < 0 || c.WriteTimeout.Duration < 0 {
+		return errors.New("read_timeout and write_timeout must not be negative")
+	}
+	if c.AuditMaxSize < 1 || c.AuditMaxFiles < 0 {
+		return errors.New("audit_max_size must be at least 1 and audit_max_files not negative")
+	}
+	if tls := c.TLS(); tls != nil {
+		if err := tls.Validate(); err != nil {
+			return err
+		}
+	} else if c.TLSClientCA != "" || len(c.TLSAllowedSubjects) > 0 {
+		return errors.New("tls_client_ca and tls_allowed_subjects require tls_cert and tls_key")
+	}
+
+	return nil
+}
+
+// TLS returns the TLS settings, or nil if HTTPS is not configured
+func (c *Config) TLS() *libvirt.TLSConfig {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		return nil
+	}
+	return &libvirt.TLSConfig{
+		CertFile:        c.TLSCert,
+		KeyFile:         c.TLSKey,
+		ClientCAFile:    c.TLSClientCA,
+		AllowedSubjects: c.TLSAllowedSubjects,
+	}
+}
+
+// loadConfig parses the command line arguments and builds the agent
+// configuration
+func loadConfig(args []string) (*Config, error) {
+	defaults := DefaultConfig()
+
+	// flag values are only used when set; Visit picks them up by name
+	var (
+		filename string
+		flags    Config
+	)
+	flag.StringVarP(&filename, "config", "c", "", "JSON config file (env "+envPrefix+"CONFIG)")
+	flag.StringVarP(&flags.URI, "uri", "u", defaults.URI, "libvirt uri")
+	flag.IntVarP(&flags.PoolSize, "pool-size", "n", defaults.PoolSize, "libvirt connection pool size")
+	flag.StringVarP(&flags.Address, "address", "a", defaults.Address, "listen address, all addresses if empty")
+	flag.UintVarP(&flags.Port, "port", "p", defaults.Port, "listen port")
+	flag.StringVarP(&flags.Zpool, "zpool", "z", defaults.Zpool, "zpool for guest disk volumes")
+	flag.StringVarP(&flags.ZFSCommand, "zfs-command", "", defaults.ZFSCommand, "zfs command used to manage guest disk volumes")
+	flag.StringVarP(&flags.LogLevel, "log-level", "l", defaults.LogLevel, "log level: debug/info/warning/error/critical/fatal")
+	flag.DurationVarP(&flags.ShutdownTimeout.Duration, "shutdown-timeout", "", defaults.ShutdownTimeout.Duration, "default GracefulShutdown timeout")
+	flag.DurationVarP(&flags.DetachTimeout.Duration, "detach-timeout", "", defaults.DetachTimeout.Duration, "how long DetachDisk waits for a running guest to release the disk")
+	flag.DurationVarP(&flags.LockTimeout.Duration, "lock-timeout", "", defaults.LockTimeout.Duration, "how long calls wait for another operation on the same guest")
+	flag.DurationVarP(&flags.JobRetention.Duration, "job-retention", "", defaults.JobRetention.Duration, "how long finished async jobs are kept")
+	flag.DurationVarP(&flags.IdempotencyWindow.Duration, "idempotency-window", "", defaults.IdempotencyWindow.Duration, "how long responses are kept for their idempotency key")
+	flag.DurationVarP(&flags.ReadTimeout.Duration, "read-timeout", "", defaults.ReadTimeout.Duration, "HTTP request read timeout, none if 0")
+	flag.DurationVarP(&flags.WriteTimeout.Duration, "write-timeout", "", defaults.WriteTimeout.Duration, "HTTP response write timeout, none if 0")
+	flag.StringVarP(&flags.TLSCert, "tls-cert", "", "", "TLS certificate file, serves HTTPS if set")
+	flag.StringVarP(&flags.TLSKey, "tls-key", "", "", "TLS key file")
+	flag.StringVarP(&flags.TLSClientCA, "tls-client-ca", "", "", "CA bundle to verify required client certificates")
+	flag.StringSliceVarP(&flags.TLSAllowedSubjects, "tls-allowed-subjects", "", nil, "client certificate common names allowed, all verified clients if empty")
+	flag.StringVarP(&flags.Policy, "policy", "", "", "JSON authorization policy file, all calls allowed if empty")
+	flag.StringVarP(&flags.AuditLog, "audit-log", "", "", "audit log file of mutating calls, none if empty")
+	flag.IntVarP(&flags.AuditMaxSize, "audit-max-size", "", defaults.AuditMaxSize, "audit log size in MiB at which it is rotated")
+	flag.IntVarP(&flags.AuditMaxFiles, "audit-max-files", "", defaults.AuditMaxFiles, "number of rotated audit logs kept")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := defaults
+
+	if filename == "" {
+		filename = os.Getenv(envPrefix + "CONFIG")
+	}
+	if filename != "" {
+		if err := config.LoadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.LoadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := config.LoadFlags(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// runLoadConfig loads a config from a fresh flag set, a config file with the
+// given contents if not empty, and the given environment
+func runLoadConfig(t *testing.T, file string, env map[string]string, args ...string) (*Config, error) {
+	flag.CommandLine = flag.NewFlagSet("mistify-libvirt", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(ioutil.Discard)
+
+	if file != "" {
+		f, err := ioutil.TempFile("", "config")
+		if err != nil {
+			t.Fatalf("can't create temp file: %s\n", err.Error())
+		}
+		defer func() {
+			_ = os.Remove(f.Name())
+		}()
+
+		if _, err = f.WriteString(file); err != nil {
+			t.Fatalf("can't write temp file: %s\n", err.Error())
+		}
+		if err = f.Close(); err != nil {
+			t.Fatalf("can't close temp file: %s\n", err.Error())
+		}
+		args = append(args, "--config="+f.Name())
+	}
+
+	for key, value := range env {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatalf("can't set %s: %s\n", key, err.Error())
+		}
+		defer func(key string) {
+			_ = os.Unsetenv(key)
+		}(key)
+	}
+
+	return loadConfig(args)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := `{
+		"uri": "test:///file",
+		"pool_size": 2,
+		"port": 1000,
+		"zpool": "file",
+		"shutdown_timeout": "2m",
+		"lock_timeout": "20s",
+		"tls_allowed_subjects": ["file"]
+	}`
+	env := map[string]string{
+		envPrefix + "POOL_SIZE":            "6",
+		envPrefix + "PORT":                 "2000",
+		envPrefix + "LOCK_TIMEOUT":         "40s",
+		envPrefix + "TLS_CERT":             "env.crt",
+		envPrefix + "TLS_KEY":              "env.key",
+		envPrefix + "TLS_CLIENT_CA":        "env-ca.crt",
+		envPrefix + "TLS_ALLOWED_SUBJECTS": "env-a, env-b",
+	}
+
+	config, err := runLoadConfig(t, file, env, "--port=3000", "--tls-allowed-subjects=flag-a,flag-b")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s\n", err.Error())
+	}
+
+	expected := DefaultConfig()
+	expected.URI = "test:///file"
+	expected.Zpool = "file"
+	expected.ShutdownTimeout = Duration{2 * time.Minute}
+	expected.PoolSize = 6
+	expected.LockTimeout = Duration{40 * time.Second}
+	expected.TLSCert = "env.crt"
+	expected.TLSKey = "env.key"
+	expected.TLSClientCA = "env-ca.crt"
+	expected.Port = 3000
+	expected.TLSAllowedSubjects = []string{"flag-a", "flag-b"}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected config %+v, got %+v\n", expected, config)
+	}
+
+	// without overrides the environment list is parsed
+	config, err = runLoadConfig(t, file, env)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s\n", err.Error())
+	}
+	if subjects := []string{"env-a", "env-b"}; !reflect.DeepEqual(config.TLSAllowedSubjects, subjects) {
+		t.Fatalf("expected subjects %v, got %v\n", subjects, config.TLSAllowedSubjects)
+	}
+	if config.Port != 2000 {
+		t.Fatalf("expected port 2000, got %d\n", config.Port)
+	}
+
+	// the config file may also come from the environment
+	_, err = runLoadConfig(t, "", map[string]string{envPrefix + "CONFIG": os.DevNull})
+	if err == nil {
+		t.Fatalf("expected an empty config file to fail to decode\n")
+	}
+
+	config, err = runLoadConfig(t, "", nil)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(config, DefaultConfig()) {
+		t.Fatalf("expected the default config, got %+v\n", config)
+	}
+}
+
+func TestLoadConfigBadValues(t *testing.T) {
+	tests := []struct {
+		description string
+		file        string
+		env         map[string]string
+		args        []string
+	}{
+		{"malformed file", `{"uri": `, nil, nil},
+		{"file int as string", `{"pool_size": "four"}`, nil, nil},
+		{"file duration as number", `{"lock_timeout": 30}`, nil, nil},
+		{"file bad duration", `{"lock_timeout": "soon"}`, nil, nil},
+		{"env bad int", "", map[string]string{envPrefix + "POOL_SIZE": "four"}, nil},
+		{"env negative uint", "", map[string]string{envPrefix + "PORT": "-1"}, nil},
+		{"env bad duration", "", map[string]string{envPrefix + "DETACH_TIMEOUT": "soon"}, nil},
+		{"flag bad int", "", nil, []string{"--pool-size=four"}},
+		{"flag bad duration", "", nil, []string{"--lock-timeout=soon"}},
+		{"unknown flag", "", nil, []string{"--no-such-flag"}},
+		{"invalid env value", "", map[string]string{envPrefix + "POOL_SIZE": "0"}, nil},
+		{"invalid flag value", "", nil, []string{"--port=70000"}},
+		{"missing config file", "", map[string]string{envPrefix + "CONFIG": "/nonexistent/config.json"}, nil},
+	}
+
+	for _, test := range tests {
+		if _, err := runLoadConfig(t, test.file, test.env, test.args...); err == nil {
+			t.Fatalf("%s: expected loadConfig to fail\n", test.description)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("expected the default config to be valid: %s\n", err.Error())
+	}
+
+	invalid := map[string]func(*Config){
+		"empty uri":              func(c *Config) { c.URI = "" },
+		"zero pool size":         func(c *Config) { c.PoolSize = 0 },
+		"zero port":              func(c *Config) { c.Port = 0 },
+		"port out of range":      func(c *Config) { c.Port = 65536 },
+		"empty zfs command":      func(c *Config) { c.ZFSCommand = "" },
+		"zero shutdown timeout":  func(c *Config) { c.ShutdownTimeout.Duration = 0 },
+		"zero detach timeout":    func(c *Config) { c.DetachTimeout.Duration = 0 },
+		"zero lock timeout":      func(c *Config) { c.LockTimeout.Duration = 0 },
+		"negative job retention": func(c *Config) { c.JobRetention.Duration = -time.Second },
+		"negative idempotency":   func(c *Config) { c.IdempotencyWindow.Duration = -time.Second },
+		"negative read timeout":  func(c *Config) { c.ReadTimeout.Duration = -time.Second },
+		"negative write timeout": func(c *Config) { c.WriteTimeout.Duration = -time.Second },
+		"zero audit max size":    func(c *Config) { c.AuditMaxSize = 0 },
+		"negative audit files":   func(c *Config) { c.AuditMaxFiles = -1 },
+		"tls cert without key":   func(c *Config) { c.TLSCert = "agent.crt" },
+		"client ca without tls":  func(c *Config) { c.TLSClientCA = "ca.crt" },
+		"subjects without tls":   func(c *Config) { c.TLSAllowedSubjects = []string{"a"} },
+		"subjects without ca": func(c *Config) {
+			c.TLSCert, c.TLSKey, c.TLSAllowedSubjects = "agent.crt", "agent.key", []string{"a"}
+		},
+	}
+	for description, mutate := range invalid {
+		config := DefaultConfig()
+		mutate(config)
+		if err := config.Validate(); err == nil {
+			t.Fatalf("%s: expected config to be invalid\n", description)
+		}
+	}
+
+	valid := map[string]func(*Config){
+		"zero job retention":  func(c *Config) { c.JobRetention.Duration = 0 },
+		"zero idempotency":    func(c *Config) { c.IdempotencyWindow.Duration = 0 },
+		"zero audit files":    func(c *Config) { c.AuditMaxFiles = 0 },
+		"highest port":        func(c *Config) { c.Port = 65535 },
+		"http read timeouts":  func(c *Config) { c.ReadTimeout.Duration, c.WriteTimeout.Duration = time.Second, time.Second },
+		"audit log and files": func(c *Config) { c.AuditLog, c.AuditMaxFiles = "audit.log", 10 },
+	}
+	for description, mutate := range valid {
+		config := DefaultConfig()
+		mutate(config)
+		if err := config.Validate(); err != nil {
+			t.Fatalf("%s: expected config to be valid: %s\n", description, err.Error())
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	var d Duration
+	if err := json.Unmarshal([]byte(`"1m30s"`), &d); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %s\n", err.Error())
+	}
+	if d.Duration != 90*time.Second {
+		t.Fatalf("expected 1m30s, got %s\n", d.Duration)
+	}
+
+	for _, invalid := range []string{`90`, `"90"`, `"soon"`, `["90s"]`} {
+		d = Duration{}
+		if err := json.Unmarshal([]byte(invalid), &d); err == nil {
+			t.Fatalf("expected %s to be an invalid duration\n", invalid)
+		}
+	}
+
+	b, err := json.Marshal(Duration{90 * time.Second})
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %s\n", err.Error())
+	}
+	if string(b) != `"1m30s"` {
+		t.Fatalf(`expected "1m30s", got %s`+"\n", b)
+	}
+
+	// the defaults survive a round trip through the config file format
+	b, err = json.Marshal(DefaultConfig())
+	if err != nil {
+		t.Fatalf("can't marshal config: %s\n", err.Error())
+	}
+	config := &Config{}
+	if err = json.Unmarshal(b, config); err != nil {
+		t.Fatalf("can't unmarshal config: %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(config, DefaultConfig()) {
+		t.Fatalf("expected %+v, got %+v\n", DefaultConfig(), config)
+	}
+}
+
+func TestConfigSetters(t *testing.T) {
+	config := &Config{}
+	setters := config.setters()
+
+	// every setting has a setter, an environment variable and a flag
+	if _, err := runLoadConfig(t, "", nil); err != nil {
+		t.Fatalf("loadConfig failed: %s\n", err.Error())
+	}
+	configType := reflect.TypeOf(*config)
+	for i := 0; i < configType.NumField(); i++ {
+		name := configType.Field(i).Tag.Get("json")
+		if _, ok := setters[name]; !ok {
+			t.Fatalf("setting %s has no setter\n", name)
+		}
+	}
+	if len(setters) != configType.NumField() {
+		t.Fatalf("expected %d setters, got %d\n", configType.NumField(), len(setters))
+	}
+	for name := range setters {
+		if flag.Lookup(strings.Replace(name, "_", "-", -1)) == nil {
+			t.Fatalf("setting %s has no flag\n", name)
+		}
+	}
+
+	values := map[string]string{
+		"uri":                  "test:///default",
+		"pool_size":            "8",
+		"address":              "127.0.0.1",
+		"port":                 "8080",
+		"zpool":                "tank",
+		"zfs_command":          "/sbin/zfs",
+		"log_level":            "debug",
+		"shutdown_timeout":     "1m",
+		"detach_timeout":       "2m",
+		"read_timeout":         "3m",
+		"write_timeout":        "4m",
+		"lock_timeout":         "5m",
+		"job_retention":        "6m",
+		"idempotency_window":   "7m",
+		"tls_cert":             "agent.crt",
+		"tls_key":              "agent.key",
+		"tls_client_ca":        "ca.crt",
+		"tls_allowed_subjects": "[a, b,,c]",
+		"policy":               "policy.json",
+		"audit_log":            "audit.log",
+		"audit_max_size":       "9",
+		"audit_max_files":      "10",
+	}
+	for name, value := range values {
+		if err := setters[name](value); err != nil {
+			t.Fatalf("%s: can't set %s: %s\n", name, value, err.Error())
+		}
+	}
+
+	expected := &Config{
+		URI:                "test:///default",
+		PoolSize:           8,
+		Address:            "127.0.0.1",
+		Port:               8080,
+		Zpool:              "tank",
+		ZFSCommand:         "/sbin/zfs",
+		LogLevel:           "debug",
+		ShutdownTimeout:    Duration{time.Minute},
+		DetachTimeout:      Duration{2 * time.Minute},
+		ReadTimeout:        Duration{3 * time.Minute},
+		WriteTimeout:       Duration{4 * time.Minute},
+		LockTimeout:        Duration{5 * time.Minute},
+		JobRetention:       Duration{6 * time.Minute},
+		IdempotencyWindow:  Duration{7 * time.Minute},
+		TLSCert:            "agent.crt",
+		TLSKey:             "agent.key",
+		TLSClientCA:        "ca.crt",
+		TLSAllowedSubjects: []string{"a", "b", "c"},
+		Policy:             "policy.json",
+		AuditLog:           "audit.log",
+		AuditMaxSize:       9,
+		AuditMaxFiles:      10,
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected config %+v, got %+v\n", expected, config)
+	}
+
+	// an empty list clears the setting
+	if err := setters["tls_allowed_subjects"]("[]"); err != nil {
+		t.Fatalf("can't set an empty list: %s\n", err.Error())
+	}
+	if config.TLSAllowedSubjects == nil || len(config.TLSAllowedSubjects) != 0 {
+		t.Fatalf("expected no subjects, got %v\n", config.TLSAllowedSubjects)
+	}
+
+	invalid := map[string]string{
+		"pool_size":        "eight",
+		"port":             "4294967296",
+		"audit_max_size":   "1.5",
+		"audit_max_files":  "",
+		"shutdown_timeout": "60",
+		"lock_timeout":     "a minute",
+	}
+	for name, value := range invalid {
+		if err := setters[name](value); err == nil {
+			t.Fatalf("%s: expected %q to be invalid\n", name, value)
+		}
+	}
+}
@@ -7,8 +7,107 @@ The following arguments are understood:
 
 	$ mistify-libvirt -h
 	Usage of mistify-libvirt:
+	-a, --address="": listen address, all addresses if empty
+	    --audit-log="": audit log file of mutating calls, none if empty
+	    --audit-max-files=10: number of rotated audit logs kept
+	    --audit-max-size=100: audit log size in MiB at which it is rotated
+	-c, --config="": JSON config file (env MISTIFY_LIBVIRT_CONFIG)
+	    --detach-timeout=30s: how long DetachDisk waits for a running guest to release the disk
+	    --idempotency-window=1h0m0s: how long responses are kept for their idempotency key
+	    --job-retention=1h0m0s: how long finished async jobs are kept
+	    --lock-timeout=10s: how long calls wait for another operation on the same guest
 	-l, --log-level="warning": log level: debug/info/warning/error/critical/fatal
+	-n, --pool-size=4: libvirt connection pool size
 	-p, --port=20001: listen port
-	-z, --zpool="mistify": zpool
+	    --policy="": JSON authorization policy file, all calls allowed if empty
+	    --read-timeout=0: HTTP request read timeout, none if 0
+	    --shutdown-timeout=1m0s: default GracefulShutdown timeout
+	    --tls-allowed-subjects=[]: client certificate common names allowed, all verified clients if empty
+	    --tls-cert="": TLS certificate file, serves HTTPS if set
+	    --tls-client-ca="": CA bundle to verify required client certificates
+	    --tls-key="": TLS key file
+	-u, --uri="qemu:///system": libvirt uri
+	    --write-timeout=0: HTTP response write timeout, none if 0
+	    --zfs-command="zfs": zfs command used to manage guest disk volumes
+	-z, --zpool="mistify": zpool for guest disk volumes
+
+Configuration
+
+Settings may also be given in a JSON config file, named with --config or
+MISTIFY_LIBVIRT_CONFIG, and in environment variables named MISTIFY_LIBVIRT_
+followed by the upper case setting name. Flags take precedence over the
+environment, which takes precedence over the config file. Settings that are
+not given anywhere keep their defaults.
+
+	{
+		"uri": "qemu:///system",
+		"pool_size": 4,
+		"address": "127.0.0.1",
+		"port": 20001,
+		"zpool": "mistify",
+		"zfs_command": "zfs",
+		"log_level": "info",
+		"shutdown_timeout": "2m",
+		"detach_timeout": "30s",
+		"read_timeout": "30s",
+		"write_timeout": "0s",
+		"lock_timeout": "10s",
+		"job_retention": "1h",
+		"idempotency_window": "1h",
+		"tls_cert": "/etc/mistify/agent.pem",
+		"tls_key": "/etc/mistify/agent.key",
+		"tls_client_ca": "/etc/mistify/clients-ca.pem",
+		"tls_allowed_subjects": ["mistify-agent"],
+		"policy": "/etc/mistify/libvirt-policy.json",
+		"audit_log": "/var/log/mistify/libvirt-audit.log",
+		"audit_max_size": 100,
+		"audit_max_files": 10
+	}
+
+	$ MISTIFY_LIBVIRT_URI=qemu+ssh://host/system mistify-libvirt --pool-size=8
+
+The write timeout also bounds event long-polls and other slow requests, so it
+is disabled by default.
+
+TLS
+
+HTTPS is served when tls_cert and tls_key are set. Setting tls_client_ca
+requires clients to present a certificate signed by one of its CAs, and
+tls_allowed_subjects further restricts them to certificates with one of the
+listed common names. In the environment the subjects are comma separated.
+
+Authorization
+
+A policy file restricts which RPC methods each caller may call. Callers are
+identified by an "Authorization: Bearer" token or by their client certificate
+common name, and methods are matched by patterns such as "Status", "*Metrics"
+or "*". The events endpoint is authorized as the method Events, and volume
+downloads and uploads as DownloadVolume and UploadVolume. Calls from unknown
+callers and calls to methods a caller is not allowed get a 403 with a
+"permission denied" JSON-RPC error, and are logged.
+
+	{
+		"callers": [
+			{
+				"name": "monitoring",
+				"tokens": ["d2b1c4..."],
+				"methods": ["Status", "*Metrics", "Events"]
+			},
+			{
+				"name": "orchestrator",
+				"subjects": ["mistify-agent"],
+				"methods": ["*"]
+			}
+		]
+	}
+
+Audit Log
+
+When audit_log is set, every mutating RPC call is appended to it as a JSON
+line with the caller, method, guest, the guest's state before and after, the
+duration and any error. The file is rotated to audit_log.1 and so on when it
+reaches audit_max_size MiB.
+
+	{"time":"2015-06-01T12:00:00Z","caller":"orchestrator","remote":"10.0.0.5:41234","method":"Libvirt.Poweroff","guest":"f1e0...","state_before":"running","state_after":"shutoff","duration_ms":212}
 */
 package main
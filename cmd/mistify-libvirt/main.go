@@ -1,55 +1,78 @@
 package main
 
 import (
+	"os"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-agent-libvirt"
-	"github.com/mistifyio/mistify-agent/rpc"
 	logx "github.com/mistifyio/mistify-logrus-ext"
-	flag "github.com/spf13/pflag"
 )
 
 func main() {
 
-	var port uint
-	var zpool, logLevel string
-
-	flag.StringVarP(&zpool, "zpool", "z", "mistify", "zpool")
-	flag.UintVarP(&port, "port", "p", 20001, "listen port")
-	flag.StringVarP(&logLevel, "log-level", "l", "warning", "log level: debug/info/warning/error/critical/fatal")
-	flag.Parse()
-
-	if err := logx.DefaultSetup(logLevel); err != nil {
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
-			"func":  "logx.DefaultSetup",
-		}).Fatal("failed to set up logrus")
+			"func":  "loadConfig",
+		}).Fatal("invalid configuration")
 	}
 
-	server, err := rpc.NewServer(port)
-	if err != nil {
+	if err := logx.DefaultSetup(config.LogLevel); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
-			"func":  "rpc.NewServer",
-		}).Fatal(err)
+			"func":  "logx.DefaultSetup",
+		}).Fatal("failed to set up logrus")
 	}
 
-	lv, err := libvirt.NewLibvirt("qemu:///system", zpool, 4)
+	lv, err := libvirt.NewLibvirt(config.URI, config.Zpool, config.PoolSize)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 			"func":  "libvirt.NewLibvirt",
+			"uri":   config.URI,
 		}).Fatal(err)
 	}
-	if err := server.RegisterService(lv); err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-			"func":  "server.RegisterService",
-		}).Fatal(err)
+	lv.SetZFSCommand(config.ZFSCommand)
+	lv.SetShutdownTimeout(config.ShutdownTimeout.Duration)
+	lv.SetDetachTimeout(config.DetachTimeout.Duration)
+	lv.SetLockTimeout(config.LockTimeout.Duration)
+	lv.SetJobRetention(config.JobRetention.Duration)
+	lv.SetIdempotencyWindow(config.IdempotencyWindow.Duration)
+
+	server := &libvirt.ServerConfig{
+		Address:      config.Address,
+		Port:         config.Port,
+		ReadTimeout:  config.ReadTimeout.Duration,
+		WriteTimeout: config.WriteTimeout.Duration,
+		TLS:          config.TLS(),
 	}
-	if err = server.ListenAndServe(); err != nil {
+
+	if config.Policy != "" {
+		server.Policy, err = libvirt.LoadPolicy(config.Policy)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"func":  "libvirt.LoadPolicy",
+			}).Fatal(err)
+		}
+	}
+
+	if config.AuditLog != "" {
+		server.Audit, err = lv.NewAuditLog(config.AuditLog, int64(config.AuditMaxSize)<<20, config.AuditMaxFiles)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"func":  "libvirt.NewAuditLog",
+			}).Fatal(err)
+		}
+		defer logx.LogReturnedErr(server.Audit.Close, nil, "failed to close audit log")
+	}
+
+	if err := lv.RunServer(server); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
-			"func":  "rpc.Server.ListenAndServe",
+			"func":  "libvirt.RunServer",
 		}).Fatal(err)
 	}
 }
@@ -0,0 +1,267 @@
+package libvirt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+// defaultDiskBus is the bus of disks that don't request one
+const defaultDiskBus = "virtio"
+
+type (
+	// diskBus is a supported disk bus, with the prefix of its target device
+	// names and the most disks it can have, or 0 for no limit
+	diskBus struct {
+		prefix string
+		max    int
+	}
+
+	// DiskTargetError is returned when a disk's bus is not supported or its
+	// target device can't be used on the bus
+	DiskTargetError struct {
+		Bus    string
+		Device string
+		Reason string
+	}
+)
+
+// diskBuses are the supported disk buses. scsi disks are attached to a
+// virtio-scsi controller. scsi and sata disks share the sd names.
+var diskBuses = map[string]diskBus{
+	"virtio": {prefix: "vd"},
+	"scsi":   {prefix: "sd"},
+	"sata":   {prefix: "sd"},
+	"ide":    {prefix: "hd", max: 4},
+}
+
+// Error describes the disk and why it can't be used
+func (e *DiskTargetError) Error() string {
+	return fmt.Sprintf("disk %q on bus %q: %s", e.Device, e.Bus, e.Reason)
+}
+
+// diskName returns the target device name for the disk at an index on a bus
+// prefix, naming them a-z, then aa-az, ba-bz and so on
+func diskName(prefix string, index int) string {
+	name := ""
+	for ; index >= 0; index = index/26 - 1 {
+		name = string(rune('a'+index%26)) + name
+	}
+	return prefix + name
+}
+
+// diskIndex returns the index of a target device name on a bus prefix, or
+// false if the name is not on the prefix
+func diskIndex(prefix string, name string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+		return 0, false
+	}
+	index := 0
+	for _, c := range name[len(prefix):] {
+		if c < 'a' || c > 'z' {
+			return 0, false
+		}
+		index = index*26 + int(c-'a') + 1
+	}
+	return index - 1, true
+}
+
+// checkDiskTarget checks that a disk's bus is supported and that its target
+// device, if it has one, is a free name on the bus. A missing bus defaults to
+// virtio.
+func checkDiskTarget(disk *client.Disk, used map[string]bool) error {
+	if disk.Bus == "" {
+		disk.Bus = defaultDiskBus
+	}
+	bus, ok := diskBuses[disk.Bus]
+	if !ok {
+		return &DiskTargetError{Bus: disk.Bus, Device: disk.Device, Reason: "unsupported bus, use virtio, scsi, sata or ide"}
+	}
+	if disk.Device == "" {
+		return nil
+	}
+
+	index, ok := diskIndex(bus.prefix, disk.Device)
+	if !ok {
+		return &DiskTargetError{Bus: disk.Bus, Device: disk.Device, Reason: fmt.Sprintf("target must be named %sa, %sb, ...", bus.prefix, bus.prefix)}
+	}
+	if bus.max > 0 && index >= bus.max {
+		return &DiskTargetError{Bus: disk.Bus, Device: disk.Device, Reason: fmt.Sprintf("bus supports at most %d disks", bus.max)}
+	}
+	if used[disk.Device] {
+		return &DiskTargetError{Bus: disk.Bus, Device: disk.Device, Reason: "target already in use"}
+	}
+	return nil
+}
+
+// nextDiskTarget returns the first target device name on a disk's bus that is
+// not used
+func nextDiskTarget(disk *client.Disk, used map[string]bool) (string, error) {
+	bus := diskBuses[disk.Bus]
+	for index := 0; bus.max == 0 || index < bus.max; index++ {
+		if name := diskName(bus.prefix, index); !used[name] {
+			return name, nil
+		}
+	}
+	return "", &DiskTargetError{Bus: disk.Bus, Reason: fmt.Sprintf("bus supports at most %d disks", bus.max)}
+}
+
+// assignDiskTargets checks the buses and requested target devices of disks,
+// and gives the disks without one the first free names on their buses
+func assignDiskTargets(disks []client.Disk) error {
+	used := make(map[string]bool, len(disks))
+	for i := range disks {
+		disk := &disks[i]
+		if err := checkDiskTarget(disk, used); err != nil {
+			return err
+		}
+		if disk.Device != "" {
+			used[disk.Device] = true
+		}
+	}
+
+	for i := range disks {
+		disk := &disks[i]
+		if disk.Device != "" {
+			continue
+		}
+		name, err := nextDiskTarget(disk, used)
+		if err != nil {
+			return err
+		}
+		disk.Device = name
+		used[name] = true
+	}
+	return nil
+}
+
+// diskControllers returns the controllers needed by disks: a virtio-scsi
+// controller for scsi disks. Controllers for the other buses are added by
+// libvirt.
+func diskControllers(disks []client.Disk) []Controller {
+	for _, disk := range disks {
+		if disk.Bus == "scsi" {
+			return []Controller{{Type: "scsi", Index: 0, Model: "virtio-scsi"}}
+		}
+	}
+	return nil
+}
+
+// diskFormats maps file extensions to the disk formats they are read as.
+// Anything else is raw: formats are never probed from the file contents, as a
+// guest could otherwise write a header pointing at a host file.
+var diskFormats = map[string]string{
+	".qcow2": "qcow2",
+}
+
+// diskFormat returns the format of a disk source by its file extension
+func diskFormat(path string) string {
+	if format, ok := diskFormats[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return "raw"
+}
+
+// isBlockDevice returns whether a disk source is a block device rather than a
+// file
+func isBlockDevice(path string) bool {
+	return strings.HasPrefix(path, "/dev/")
+}
+
+// diskSource returns the libvirt disk type and source for a path
+func diskSource(path string) (string, DiskSource) {
+	if isBlockDevice(path) {
+		return "block", DiskSource{Device: path}
+	}
+	return "file", DiskSource{File: path}
+}
+
+// imageFile returns whether a disk's image is a file or device path, rather
+// than a zfs snapshot to clone
+func imageFile(disk *client.Disk) bool {
+	return filepath.IsAbs(disk.Image)
+}
+
+// needsVolume returns whether a disk needs a zvol created for it. Disks with
+// only an image path use the image directly, read-only.
+func needsVolume(disk *client.Disk) bool {
+	return disk.Source == "" && !imageFile(disk)
+}
+
+// diskPaths returns the files and block devices used by disks: their sources
+// and image files
+func diskPaths(disks []client.Disk) []string {
+	paths := make([]string, 0, len(disks))
+	for i := range disks {
+		disk := &disks[i]
+		if disk.Source != "" {
+			paths = append(paths, disk.Source)
+		}
+		if imageFile(disk) {
+			paths = append(paths, disk.Image)
+		}
+	}
+	return paths
+}
+
+// checkDiskSource checks that a disk's source and image can be used as a file
+// or block device: paths must be absolute and only qcow2 files can be backed
+// by an image
+func checkDiskSource(disk *client.Disk) error {
+	if disk.Source == "" {
+		return nil
+	}
+	if !filepath.IsAbs(disk.Source) {
+		return syscall.EINVAL
+	}
+	if imageFile(disk) && !isBlockDevice(disk.Source) && diskFormat(disk.Source) != "qcow2" {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// GuestDisk builds a libvirt disk definition for a guest disk. It only
+// describes files and devices: nothing is created or checked on disk. Sources
+// under /dev are block devices and anything else is a file, read as qcow2 or
+// raw by its extension, which must match the file's real format. A qcow2 file
+// with an image path is described as a linked clone backed by the image, so
+// the file must already be a qcow2 overlay of that image, e.g. made with
+// "qemu-img create -f qcow2 -b <image> -F <format> <source>". A disk with only
+// an image path attaches the image itself read-only. Deeper backing chains are
+// followed by libvirt from the images.
+func GuestDisk(disk client.Disk) Disk {
+	path := disk.Source
+	readOnly := path == "" && imageFile(&disk)
+	if readOnly {
+		path = disk.Image
+	}
+
+	d := Disk{
+		Device: "disk",
+		Driver: DiskDriver{
+			Name: "qemu",
+			Type: diskFormat(path),
+		},
+		Target: DiskTarget{
+			Device: disk.Device,
+			Bus:    disk.Bus,
+		},
+	}
+	d.Type, d.Source = diskSource(path)
+
+	if readOnly {
+		d.ReadOnly = &DiskReadOnly{}
+	} else if d.Type == "file" && imageFile(&disk) {
+		backingType, backingSource := diskSource(disk.Image)
+		d.BackingStore = &DiskBackingStore{
+			Type:   backingType,
+			Format: &DiskFormat{Type: diskFormat(disk.Image)},
+			Source: &backingSource,
+		}
+	}
+
+	return d
+}
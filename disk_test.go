@@ -0,0 +1,228 @@
+package libvirt_test
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+func TestFileDisks(t *testing.T) {
+	// file disks need no zpool
+	lv, err := mlibvirt.NewLibvirtWithBackend(mlibvirt.NewFakeBackend(), fakeURI, "", 2)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+
+	guest := &client.Guest{
+		ID:   "file-guest",
+		Type: "test",
+		Disks: []client.Disk{
+			{Source: "/var/lib/mistify/guests/file-guest.qcow2", Image: "/var/lib/mistify/images/ubuntu.qcow2"},
+			{Image: "/var/lib/mistify/images/tools.iso"},
+		},
+	}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != nil {
+		t.Fatalf("CreateGuest failed: %s\n", err.Error())
+	}
+
+	domain, err := lv.LookupDomainByName(guest.ID)
+	if err != nil {
+		t.Fatalf("LookupDomainByName failed: %s\n", err.Error())
+	}
+	v, err := mlibvirt.ParseDomain(domain)
+	if err != nil {
+		t.Fatalf("ParseDomain failed: %s\n", err.Error())
+	}
+	disks := v.Devices.Disks
+	if disks[0].Type != "file" || disks[0].Driver.Type != "qcow2" || disks[0].BackingStore.Source.File != guest.Disks[0].Image {
+		t.Fatalf("expected a linked clone, got %+v\n", disks[0])
+	}
+	if disks[1].ReadOnly == nil || disks[1].Source.File != guest.Disks[1].Image || disks[1].Driver.Type != "raw" {
+		t.Fatalf("expected the image attached read-only, got %+v\n", disks[1])
+	}
+
+	invalid := []client.Disk{
+		{Source: "guests/relative.qcow2"},
+		{Source: "/var/lib/mistify/guests/raw.img", Image: "/var/lib/mistify/images/ubuntu.qcow2"},
+	}
+	for _, disk := range invalid {
+		guest.Disks = []client.Disk{disk}
+		if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != syscall.EINVAL {
+			t.Fatalf("expected EINVAL for disk %+v, got %v\n", disk, err)
+		}
+	}
+}
+
+func TestDiskTargets(t *testing.T) {
+	lv, err := mlibvirt.NewLibvirtWithBackend(mlibvirt.NewFakeBackend(), fakeURI, "", 2)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+
+	guest := &client.Guest{ID: "bus-guest", Type: "test"}
+	for i := 0; i < 28; i++ {
+		guest.Disks = append(guest.Disks, client.Disk{Source: fmt.Sprintf("/dev/zvol/tank/bus-guest-%d", i)})
+	}
+	guest.Disks = append(guest.Disks,
+		client.Disk{Bus: "sata", Source: "/dev/sdb"},
+		client.Disk{Bus: "scsi", Device: "sda", Source: "/dev/sdc"},
+		client.Disk{Bus: "ide", Source: "/var/lib/mistify/images/windows.iso"},
+	)
+	response := &rpc.GuestResponse{}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, response); err != nil {
+		t.Fatalf("CreateGuest failed: %s\n", err.Error())
+	}
+
+	expected := map[int]string{0: "vda", 25: "vdz", 26: "vdaa", 27: "vdab", 28: "sdb", 29: "sda", 30: "hda"}
+	for i, device := range expected {
+		if disk := response.Guest.Disks[i]; disk.Device != device {
+			t.Fatalf("expected disk %d to be %s, got %+v\n", i, device, disk)
+		}
+	}
+
+	domain, err := lv.LookupDomainByName(guest.ID)
+	if err != nil {
+		t.Fatalf("LookupDomainByName failed: %s\n", err.Error())
+	}
+	v, err := mlibvirt.ParseDomain(domain)
+	if err != nil {
+		t.Fatalf("ParseDomain failed: %s\n", err.Error())
+	}
+	if len(v.Devices.Controllers) != 1 || v.Devices.Controllers[0].Model != "virtio-scsi" {
+		t.Fatalf("expected a virtio-scsi controller, got %+v\n", v.Devices.Controllers)
+	}
+
+	invalid := [][]client.Disk{
+		{{Bus: "usb"}},
+		{{Bus: "ide", Device: "vda"}},
+		{{Bus: "ide", Device: "hde"}},
+		{{Device: "vdb"}, {Device: "vdb"}},
+		{{Bus: "ide"}, {Bus: "ide"}, {Bus: "ide"}, {Bus: "ide"}, {Bus: "ide"}},
+	}
+	for _, disks := range invalid {
+		for i := range disks {
+			disks[i].Source = fmt.Sprintf("/dev/zvol/tank/invalid-%d", i)
+		}
+		guest := &client.Guest{ID: "invalid-bus-guest", Type: "test", Disks: disks}
+		err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{})
+		if _, ok := err.(*mlibvirt.DiskTargetError); !ok {
+			t.Fatalf("expected DiskTargetError for disks %+v, got %v\n", disks, err)
+		}
+	}
+}
+
+func attachDisk(t *testing.T, lv *mlibvirt.Libvirt, guest *client.Guest, disk client.Disk) *mlibvirt.DiskResponse {
+	response := &mlibvirt.DiskResponse{}
+	if err := lv.AttachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: disk}, response); err != nil {
+		t.Fatalf("AttachDisk failed: %s\n", err.Error())
+	}
+	return response
+}
+
+func TestHotplugDisks(t *testing.T) {
+	backend := mlibvirt.NewFakeBackend()
+	lv, commands, cleanup := zfsSetup(t, backend)
+	defer cleanup()
+
+	guest := &client.Guest{ID: "hotplug-guest", Type: "test", Memory: 256, CPU: 1, Disks: []client.Disk{{Size: 1024}}}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != nil {
+		t.Fatalf("CreateGuest failed: %s\n", err.Error())
+	}
+	commands()
+	guest = call(t, "Run", lv.Run, &client.Guest{ID: guest.ID}, "running")
+
+	response := attachDisk(t, lv, guest, client.Disk{Size: 512})
+	expectCommands(t, "AttachDisk", commands(), "create -p -V 512M tank/guests/hotplug-guest-vdb")
+	if response.Disk.Device != "vdb" || len(response.Disks) != 2 || response.Disks[1].Volume != "tank/guests/hotplug-guest-vdb" {
+		t.Fatalf("unexpected attached disk %+v and disks %+v\n", response.Disk, response.Disks)
+	}
+
+	// scsi disks get a controller
+	response = attachDisk(t, lv, guest, client.Disk{Bus: "scsi", Source: "/dev/sdc"})
+	if response.Disk.Device != "sda" || len(response.Guest.Disks) != 3 {
+		t.Fatalf("unexpected attached disk %+v and disks %+v\n", response.Disk, response.Guest.Disks)
+	}
+	domain, err := lv.LookupDomainByName(guest.ID)
+	if err != nil {
+		t.Fatalf("LookupDomainByName failed: %s\n", err.Error())
+	}
+	v, err := mlibvirt.ParseDomain(domain)
+	if err != nil {
+		t.Fatalf("ParseDomain failed: %s\n", err.Error())
+	}
+	if len(v.Devices.Controllers) != 1 || len(v.Metadata.Device.Disks) != 3 {
+		t.Fatalf("expected a controller and metadata for 3 disks, got %+v %+v\n", v.Devices.Controllers, v.Metadata.Device)
+	}
+
+	// ide disks can't be hotplugged, and the volume created for one is
+	// destroyed
+	err = lv.AttachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: client.Disk{Bus: "ide", Size: 512}}, &mlibvirt.DiskResponse{})
+	if stepErr, ok := err.(*mlibvirt.StepError); !ok || stepErr.Step != "attach disk hda" {
+		t.Fatalf("expected StepError attaching an ide disk, got %v\n", err)
+	}
+	expectCommands(t, "AttachDisk", commands(),
+		"create -p -V 512M tank/guests/hotplug-guest-hda",
+		"destroy -r tank/guests/hotplug-guest-hda",
+	)
+	err = lv.AttachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: client.Disk{Device: "vda", Source: "/dev/sdd"}}, &mlibvirt.DiskResponse{})
+	if _, ok := err.(*mlibvirt.DiskTargetError); !ok {
+		t.Fatalf("expected DiskTargetError attaching a used target, got %v\n", err)
+	}
+
+	detached := &mlibvirt.DiskResponse{}
+	if err := lv.DetachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: client.Disk{Device: "vdb"}}, detached); err != nil {
+		t.Fatalf("DetachDisk failed: %s\n", err.Error())
+	}
+	expectCommands(t, "DetachDisk", commands(), "destroy -r tank/guests/hotplug-guest-vdb")
+	if detached.Disk.Volume != "tank/guests/hotplug-guest-vdb" || len(detached.Disks) != 2 || detached.Disks[1].Device != "sda" {
+		t.Fatalf("unexpected detached disk %+v and disks %+v\n", detached.Disk, detached.Disks)
+	}
+
+	// the freed target is reused, and a volume sent with a source is neither
+	// recorded nor destroyed
+	response = attachDisk(t, lv, guest, client.Disk{Source: "/dev/zvol/tank/guests/db1-vda", Volume: "tank/guests/db1-vda"})
+	if response.Disk.Device != "vdb" || response.Disks[1].Volume != "" {
+		t.Fatalf("expected vdb to be reused without a volume, got %+v\n", response.Disks[1])
+	}
+	if err := lv.DetachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: client.Disk{Device: "vdb"}}, detached); err != nil {
+		t.Fatalf("DetachDisk failed: %s\n", err.Error())
+	}
+	expectCommands(t, "DetachDisk", commands(), "")
+
+	// a running guest must release a disk before its volume is destroyed; if
+	// it doesn't in time, the disk and its volume are kept until a retry
+	attachDisk(t, lv, guest, client.Disk{Size: 512})
+	commands()
+	lv.SetDetachTimeout(time.Millisecond)
+	backend.HoldDisks(guest.ID, true)
+	err = lv.DetachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: client.Disk{Device: "vdb"}}, detached)
+	if err != mlibvirt.ErrDetachTimeout {
+		t.Fatalf("expected ErrDetachTimeout, got %v\n", err)
+	}
+	expectCommands(t, "DetachDisk", commands(), "")
+	if v, err = mlibvirt.ParseDomain(domain); err != nil {
+		t.Fatalf("ParseDomain failed: %s\n", err.Error())
+	}
+	if disks := v.GuestDisks(); len(disks) != 3 || disks[2].Volume != "tank/guests/hotplug-guest-vdb" {
+		t.Fatalf("expected the disk to be kept, got %+v\n", disks)
+	}
+
+	backend.HoldDisks(guest.ID, false)
+	if err := lv.DetachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: client.Disk{Device: "vdb"}}, detached); err != nil {
+		t.Fatalf("DetachDisk failed: %s\n", err.Error())
+	}
+	expectCommands(t, "DetachDisk", commands(), "destroy -r tank/guests/hotplug-guest-vdb")
+	if len(detached.Disks) != 2 {
+		t.Fatalf("expected the disk to be detached, got %+v\n", detached.Disks)
+	}
+
+	err = lv.DetachDisk(nil, &mlibvirt.DiskRequest{Guest: guest, Disk: client.Disk{Device: "vdz"}}, &mlibvirt.DiskResponse{})
+	if err != mlibvirt.ErrNoDisk {
+		t.Fatalf("expected ErrNoDisk, got %v\n", err)
+	}
+}
@@ -7,6 +7,13 @@ HTTP API Endpoint
 	/_mistify_RPC_
 		* GET - Run a specified method
 
+	/_mistify_events_?since=ID&timeout=SECONDS
+		* GET - Long-poll for guest lifecycle events newer than ID
+
+	/_mistify_volumes_?pool=POOL&volume=VOLUME&offset=BYTES&length=BYTES
+		* GET - Download the contents of a volume
+		* PUT - Upload the request body to a volume
+
 Request Structure
 
     {
@@ -18,7 +25,8 @@ Request Structure
     }
 
 Where RPC_METHOD is the desired method and DATA_STRUCTURE is one of the request
-structs defined in http://godoc.org/github.com/mistifyio/mistify-agent/rpc .
+structs defined in http://godoc.org/github.com/mistifyio/mistify-agent/rpc or,
+for methods such as snapshots, in this package.
 
 Response Structure
 
@@ -43,13 +51,211 @@ RPC Methods
 	Reboot
 	Poweroff
 	Shutdown
+	GracefulShutdown
 	Run
+	Pause
+	Resume
+	Migrate
 
 	Status
+	ListGuests
+	Reconcile
 	CPUMetrics
 	DiskMetrics
 	NicMetrics
 
+	CreateSnapshot
+	ListSnapshots
+	RevertSnapshot
+	DeleteSnapshot
+
+	AttachDisk
+	DetachDisk
+
+	JobStatus
+	ListJobs
+	CancelJob
+
+	ListStoragePools
+	ListVolumes
+	CreateVolume
+	ResizeVolume
+	DeleteVolume
+
+Events
+
+Each event has an increasing id, the guest id, the libvirt event name (e.g.
+"stopped"), the resulting guest state using the same names as Status (e.g.
+"shutoff"), and a reason (e.g. "crashed"). Clients pass the id of the last
+event they saw as "since" to receive only newer events.
+
+Backends
+
+Hypervisor access goes through the Backend interface. NewLibvirt uses
+LibvirtBackend, which talks to libvirtd. FakeBackend keeps domains, networks,
+and snapshots in memory and can inject failures, for testing without libvirtd:
+
+	lv, err := libvirt.NewLibvirtWithBackend(libvirt.NewFakeBackend(), "fake:///default", "", 1)
+
+Disk Volumes
+
+CreateGuest creates a zvol named ZPOOL/guests/GUEST-DEVICE for each disk
+without a source, of the disk's size in MiB, or cloned from the ZFS snapshot
+named by the disk's image (e.g. "mistify/images/ubuntu@base"), which must be
+under the zpool, and resized if the disk has a size. The disk's volume and
+source are set to the zvol, and Delete destroys the volumes it created before
+undefining the domain, so a Delete that fails on a volume can be retried.
+Disks with a source are used as they are, and a volume sent by the client is
+ignored, never recorded or destroyed. The zfs command can be changed with
+SetZFSCommand, e.g. to a fake one for testing.
+
+Disk sources under /dev are attached as block devices and any other source as
+a file, read as qcow2 if it ends in .qcow2 and raw otherwise; formats are
+never probed from the contents, so the extension must match the file's real
+format. A qcow2 file whose disk has an image path (e.g.
+"/var/lib/mistify/images/ubuntu.qcow2") is attached as a linked clone backed
+by the image, and a disk with only an image path attaches the image itself
+read-only. These files are only described in the domain XML, never created:
+the source and image must already exist, and a linked clone's source must
+already be a qcow2 overlay of its image, e.g. made with
+"qemu-img create -f qcow2 -b <image> -F <format> <source>". Neither needs
+a zpool, so qcow2 files can be used where ZFS is not available, such as in
+development.
+
+Disks are on the virtio bus unless they request scsi, sata or ide; scsi disks
+get a virtio-scsi controller. Disks without a target device are given the
+first free name on their bus: vda to vdz then vdaa, vdab and so on for virtio,
+sda onwards for scsi and sata, and hda to hdd for ide. Unsupported buses, and
+target devices that are taken or don't fit their bus, fail with a
+*DiskTargetError.
+
+AttachDisk adds a disk to a guest's persistent config and, if the guest is
+running, to the running guest, without a reboot. The disk gets the first free
+target device on its bus and a zvol if it has no source, like in CreateGuest;
+ide and sata disks can only be attached to stopped guests. DetachDisk removes
+a disk by its target device and destroys its zvol if it was created for the
+guest. A running guest must release the disk first; if it does not within the
+timeout set with SetDetachTimeout, ErrDetachTimeout is returned and the disk
+and its zvol are kept until the detach is retried. Both update the mistify device metadata and return the guest's disks.
+
+Storage
+
+ListStoragePools reports the capacity, allocation and available space of
+libvirt storage pools, such as dir, logical and zfs pools, and ListVolumes the
+volumes in one. CreateVolume, ResizeVolume and DeleteVolume manage volumes by
+pool and name, with sizes in bytes. Volumes in dir, fs and netfs pools are
+sparse files, raw unless another format such as qcow2 is given; volumes in
+other pools are fully allocated. The contents of a volume are downloaded with
+a GET, and replaced with a PUT of the data, at VolumesPath; offset and length
+limit the transfer to part of the volume. Volumes that are disks of a guest
+can't be deleted or uploaded to, and guests can't start using a volume while
+it is being uploaded to or deleted. The endpoint is installed by RunServer, or
+with:
+
+	server.Handle(libvirt.VolumesPath, lv.VolumeHandler())
+
+Server
+
+RunServer serves the API with all of its endpoints and handlers: the events
+and volumes endpoints, async jobs and idempotency keys, and, when the config
+has them, TLS, a Policy and an AuditLog. It is what mistify-libvirt runs,
+and RunHTTP and RunHTTPS call it without a policy or audit log:
+
+	lv.RunServer(&libvirt.ServerConfig{
+		Address: "127.0.0.1",
+		Port:    20001,
+		TLS:     tls,
+		Policy:  policy,
+		Audit:   audit,
+	})
+
+TLS
+
+RunHTTPS serves the API over HTTPS. With a client CA bundle, clients must
+present a certificate signed by one of its CAs, and with allowed subjects only
+certificates with one of those common names are accepted; others get a 403:
+
+	err := lv.RunHTTPS(20001, &libvirt.TLSConfig{
+		CertFile:        "/etc/mistify/agent.pem",
+		KeyFile:         "/etc/mistify/agent.key",
+		ClientCAFile:    "/etc/mistify/clients-ca.pem",
+		AllowedSubjects: []string{"mistify-agent"},
+	})
+
+Authorization
+
+A Policy maps callers, identified by bearer token or client certificate common
+name, to the methods they may call. Policy.Handler wraps the HTTP server's
+handler; calls from unknown callers or to methods that are not allowed get a
+403 with an ErrPermissionDenied JSON-RPC error and are logged. The events
+endpoint is authorized as EventsMethod, and volume downloads and uploads as
+DownloadVolumeMethod and UploadVolumeMethod.
+
+	policy, err := libvirt.LoadPolicy("/etc/mistify/libvirt-policy.json")
+	server.HTTPServer.Handler = policy.Handler(server.HTTPServer.Handler)
+
+The caller is passed on in the X-Mistify-Caller header. CallerHandler removes
+any such header sent by the client and must wrap the outermost handler, with
+or without a policy, so that clients can't name themselves in the audit log or
+share another caller's idempotency keys:
+
+	server.HTTPServer.Handler = libvirt.CallerHandler(server.HTTPServer.Handler)
+
+Audit Log
+
+AuditLog.Handler records every call to one of MutatingMethods as a JSON line
+with the caller, method, guest, the guest's state before and after, the
+duration and any error, in a file rotated by size. Volume uploads are recorded
+as UploadVolumeMethod with the pool and volume name. Wrap the handler with it
+before wrapping with a Policy handler, so the caller is known:
+
+	audit, err := lv.NewAuditLog("/var/log/mistify/libvirt-audit.log", libvirt.DefaultAuditMaxSize, libvirt.DefaultAuditMaxFiles)
+	server.HTTPServer.Handler = audit.Handler(server.HTTPServer.Handler)
+
+Locking
+
+Calls that change a guest are serialized per guest, while calls on different
+guests run in parallel. A call waits for the guest's current operation for up
+to DefaultLockTimeout, or the duration set with SetLockTimeout, and then fails
+with ErrGuestBusy. Read only calls such as Status and the metrics are not
+serialized.
+
+Jobs
+
+Any RPC call made to /_mistify_RPC_?async=true runs in the background as a job.
+The call returns a JobResponse at once, and JobStatus reports the job's state,
+the progress of the guest's libvirt job (virDomainGetJobInfo) while it runs,
+and the call's response or error once it has finished. CancelJob aborts the
+guest's libvirt job, such as a migration, only if the cancelled job holds the
+guest's lock. A job still waiting for the lock is marked cancelled and fails
+with ErrJobCancelled instead of starting. Finished jobs are kept for
+DefaultJobRetention, or the duration set with SetJobRetention. The handler that
+runs them is installed by RunServer, or with:
+
+	server.HTTPServer.Handler = lv.JobHandler(server.HTTPServer.Handler)
+
+Idempotency
+
+A mutating call made with an Idempotency-Key header, or an idempotency_key query
+parameter, is made only once per caller and key. Retries with the same key get
+the original response with an Idempotent-Replayed header, and a retry made while
+the original call is still running waits for it. Only successful responses are
+kept, for DefaultIdempotencyWindow or the duration set with
+SetIdempotencyWindow, so failed calls can be retried. Using a key again for a
+different call fails with ErrIdempotencyKeyReused. The handler is installed by
+RunServer, or with:
+
+	server.HTTPServer.Handler = lv.IdempotencyHandler(server.HTTPServer.Handler)
+
+Building
+
+The dependencies predate go modules and there is no go.mod, so the package is
+built in GOPATH mode from $GOPATH/src/github.com/mistifyio/mistify-agent-libvirt.
+The libvirt bindings use cgo and need the libvirt headers, e.g. the libvirt-dev
+package. The Makefile clones missing dependencies and sets GO111MODULE=off:
+
+	make build vet test
+
 See the godocs and function signatures for each method's purpose and expected
 request/response structs.
 */
@@ -0,0 +1,382 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+)
+
+// EventsPath is the HTTP path of the domain event long-poll endpoint
+const EventsPath = "/_mistify_events_"
+
+// DefaultEventBufferSize is the number of recent events kept for long-polling
+const DefaultEventBufferSize = 1024
+
+// Long-poll timeouts for the events endpoint
+const (
+	DefaultEventPollTimeout = 30 * time.Second
+	MaxEventPollTimeout     = 5 * time.Minute
+)
+
+// eventCheckInterval is how often the event connection is checked for liveness
+var eventCheckInterval = 5 * time.Second
+
+// LifecycleEventNames maps libvirt lifecycle events to event name strings
+var LifecycleEventNames = map[int]string{
+	libvirt.VIR_DOMAIN_EVENT_DEFINED:     "defined",
+	libvirt.VIR_DOMAIN_EVENT_UNDEFINED:   "undefined",
+	libvirt.VIR_DOMAIN_EVENT_STARTED:     "started",
+	libvirt.VIR_DOMAIN_EVENT_SUSPENDED:   "suspended",
+	libvirt.VIR_DOMAIN_EVENT_RESUMED:     "resumed",
+	libvirt.VIR_DOMAIN_EVENT_STOPPED:     "stopped",
+	libvirt.VIR_DOMAIN_EVENT_SHUTDOWN:    "shutdown",
+	libvirt.VIR_DOMAIN_EVENT_PMSUSPENDED: "pmsuspended",
+	libvirt.VIR_DOMAIN_EVENT_CRASHED:     "crashed",
+}
+
+// LifecycleEventStates maps libvirt lifecycle events to the domain state they
+// leave the domain in. Events not listed here are resolved by looking up the
+// domain's state.
+var LifecycleEventStates = map[int]int{
+	libvirt.VIR_DOMAIN_EVENT_STARTED:     libvirt.VIR_DOMAIN_RUNNING,
+	libvirt.VIR_DOMAIN_EVENT_SUSPENDED:   libvirt.VIR_DOMAIN_PAUSED,
+	libvirt.VIR_DOMAIN_EVENT_RESUMED:     libvirt.VIR_DOMAIN_RUNNING,
+	libvirt.VIR_DOMAIN_EVENT_STOPPED:     libvirt.VIR_DOMAIN_SHUTOFF,
+	libvirt.VIR_DOMAIN_EVENT_SHUTDOWN:    libvirt.VIR_DOMAIN_SHUTDOWN,
+	libvirt.VIR_DOMAIN_EVENT_PMSUSPENDED: libvirt.VIR_DOMAIN_PMSUSPENDED,
+	libvirt.VIR_DOMAIN_EVENT_CRASHED:     libvirt.VIR_DOMAIN_CRASHED,
+}
+
+// LifecycleEventReasons maps libvirt lifecycle event details to reason strings
+var LifecycleEventReasons = map[int]map[int]string{
+	libvirt.VIR_DOMAIN_EVENT_DEFINED: {
+		libvirt.VIR_DOMAIN_EVENT_DEFINED_ADDED:   "added",
+		libvirt.VIR_DOMAIN_EVENT_DEFINED_UPDATED: "updated",
+	},
+	libvirt.VIR_DOMAIN_EVENT_UNDEFINED: {
+		libvirt.VIR_DOMAIN_EVENT_UNDEFINED_REMOVED: "removed",
+	},
+	libvirt.VIR_DOMAIN_EVENT_STARTED: {
+		libvirt.VIR_DOMAIN_EVENT_STARTED_BOOTED:        "booted",
+		libvirt.VIR_DOMAIN_EVENT_STARTED_MIGRATED:      "migrated",
+		libvirt.VIR_DOMAIN_EVENT_STARTED_RESTORED:      "restored",
+		libvirt.VIR_DOMAIN_EVENT_STARTED_FROM_SNAPSHOT: "snapshot",
+		libvirt.VIR_DOMAIN_EVENT_STARTED_WAKEUP:        "wakeup",
+	},
+	libvirt.VIR_DOMAIN_EVENT_SUSPENDED: {
+		libvirt.VIR_DOMAIN_EVENT_SUSPENDED_PAUSED:        "paused",
+		libvirt.VIR_DOMAIN_EVENT_SUSPENDED_MIGRATED:      "migrated",
+		libvirt.VIR_DOMAIN_EVENT_SUSPENDED_IOERROR:       "ioerror",
+		libvirt.VIR_DOMAIN_EVENT_SUSPENDED_WATCHDOG:      "watchdog",
+		libvirt.VIR_DOMAIN_EVENT_SUSPENDED_RESTORED:      "restored",
+		libvirt.VIR_DOMAIN_EVENT_SUSPENDED_FROM_SNAPSHOT: "snapshot",
+	},
+	libvirt.VIR_DOMAIN_EVENT_RESUMED: {
+		libvirt.VIR_DOMAIN_EVENT_RESUMED_UNPAUSED:      "unpaused",
+		libvirt.VIR_DOMAIN_EVENT_RESUMED_MIGRATED:      "migrated",
+		libvirt.VIR_DOMAIN_EVENT_RESUMED_FROM_SNAPSHOT: "snapshot",
+	},
+	libvirt.VIR_DOMAIN_EVENT_STOPPED: {
+		libvirt.VIR_DOMAIN_EVENT_STOPPED_SHUTDOWN:      "shutdown",
+		libvirt.VIR_DOMAIN_EVENT_STOPPED_DESTROYED:     "destroyed",
+		libvirt.VIR_DOMAIN_EVENT_STOPPED_CRASHED:       "crashed",
+		libvirt.VIR_DOMAIN_EVENT_STOPPED_MIGRATED:      "migrated",
+		libvirt.VIR_DOMAIN_EVENT_STOPPED_SAVED:         "saved",
+		libvirt.VIR_DOMAIN_EVENT_STOPPED_FAILED:        "failed",
+		libvirt.VIR_DOMAIN_EVENT_STOPPED_FROM_SNAPSHOT: "snapshot",
+	},
+	libvirt.VIR_DOMAIN_EVENT_SHUTDOWN: {
+		libvirt.VIR_DOMAIN_EVENT_SHUTDOWN_FINISHED: "finished",
+	},
+	libvirt.VIR_DOMAIN_EVENT_CRASHED: {
+		libvirt.VIR_DOMAIN_EVENT_CRASHED_PANICKED: "panicked",
+	},
+}
+
+// ErrEventMonitorRunning is returned when starting an already running monitor
+var ErrEventMonitorRunning = errors.New("event monitor already running")
+
+type (
+	// Event is a guest lifecycle event
+	Event struct {
+		ID      uint64    `json:"id"`
+		GuestID string    `json:"guest_id"`
+		Event   string    `json:"event"`
+		State   string    `json:"state"`
+		Reason  string    `json:"reason"`
+		Time    time.Time `json:"time"`
+	}
+
+	// EventMonitor listens for domain events on a dedicated connection and
+	// keeps the most recent ones for long-polling clients
+	EventMonitor struct {
+		uri     string
+		backend Backend
+		size    int
+
+		// connMu guards the connection and stop, which is set while the
+		// monitor runs
+		connMu     sync.Mutex
+		conn       BackendConnection
+		callbackID int
+		stop       chan struct{}
+
+		mu     sync.Mutex
+		events []Event
+		next   uint64
+		notify chan struct{}
+	}
+)
+
+// NewEventMonitor creates a new EventMonitor for the uri and backend of a
+// Libvirt keeping up to size events
+func (lv *Libvirt) NewEventMonitor(size int) *EventMonitor {
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+
+	return &EventMonitor{
+		uri:        lv.uri,
+		backend:    lv.backend,
+		size:       size,
+		callbackID: -1,
+		events:     make([]Event, 0, size),
+		next:       1,
+		notify:     make(chan struct{}),
+	}
+}
+
+// Start opens the event connection, registers for lifecycle events, and runs
+// the backend's event loop
+func (em *EventMonitor) Start() error {
+	em.connMu.Lock()
+	defer em.connMu.Unlock()
+
+	if em.stop != nil {
+		return ErrEventMonitorRunning
+	}
+
+	em.backend.StartEventLoop()
+
+	if err := em.connect(); err != nil {
+		return err
+	}
+
+	em.stop = make(chan struct{})
+	go em.watch(em.stop)
+
+	return nil
+}
+
+// Stop deregisters for events and closes the event connection
+func (em *EventMonitor) Stop() error {
+	em.connMu.Lock()
+	defer em.connMu.Unlock()
+
+	if em.stop == nil {
+		return nil
+	}
+	close(em.stop)
+	em.stop = nil
+
+	return em.disconnect()
+}
+
+// connect and disconnect must be called with connMu held
+func (em *EventMonitor) connect() error {
+	conn, err := em.backend.Connect(em.uri)
+	if err != nil {
+		return err
+	}
+
+	callbackID, err := conn.DomainEventLifecycleRegister(em.handleEvent)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	em.conn = conn
+	em.callbackID = callbackID
+
+	return nil
+}
+
+func (em *EventMonitor) disconnect() error {
+	if em.conn == nil {
+		return nil
+	}
+
+	if em.callbackID >= 0 {
+		if err := em.conn.DomainEventDeregister(em.callbackID); err != nil {
+			log.WithField("error", err).Error("failed to deregister for domain events")
+		}
+		em.callbackID = -1
+	}
+
+	err := em.conn.Close()
+	em.conn = nil
+
+	return err
+}
+
+// watch reconnects and re-registers if the event connection dies
+func (em *EventMonitor) watch(stop chan struct{}) {
+	ticker := time.NewTicker(eventCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			em.reconnect(stop)
+		}
+	}
+}
+
+// reconnect replaces the event connection if it is no longer alive, unless
+// the monitor was stopped while waiting for the lock
+func (em *EventMonitor) reconnect(stop chan struct{}) {
+	em.connMu.Lock()
+	defer em.connMu.Unlock()
+
+	select {
+	case <-stop:
+		return
+	default:
+	}
+
+	if em.conn != nil {
+		if alive, err := em.conn.IsAlive(); err == nil && alive {
+			return
+		}
+	}
+
+	log.WithField("uri", em.uri).Warn("event connection lost, reconnecting")
+	if err := em.disconnect(); err != nil {
+		log.WithField("error", err).Error("failed to close event connection")
+	}
+	if err := em.connect(); err != nil {
+		log.WithField("error", err).Error("failed to reconnect event connection")
+	}
+}
+
+func (em *EventMonitor) handleEvent(d BackendDomain, event int, detail int) {
+	name, err := d.GetName()
+	if err != nil {
+		log.WithField("error", err).Error("failed to get name of domain for event")
+		return
+	}
+
+	state, ok := LifecycleEventStates[event]
+	if !ok {
+		state, err = GetState(d)
+		if err != nil {
+			state = libvirt.VIR_DOMAIN_NOSTATE
+		}
+	}
+
+	e := Event{
+		GuestID: name,
+		Event:   LifecycleEventNames[event],
+		State:   StateNames[state],
+		Reason:  LifecycleEventReasons[event][detail],
+		Time:    time.Now(),
+	}
+
+	log.WithFields(log.Fields{
+		"guest":  e.GuestID,
+		"event":  e.Event,
+		"state":  e.State,
+		"reason": e.Reason,
+	}).Debug("domain event")
+
+	em.Publish(e)
+}
+
+// Publish records an event, assigns it an id, and wakes up waiting clients
+func (em *EventMonitor) Publish(e Event) {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+
+	e.ID = em.next
+	em.next++
+
+	if len(em.events) == em.size {
+		copy(em.events, em.events[1:])
+		em.events = em.events[:len(em.events)-1]
+	}
+	em.events = append(em.events, e)
+
+	close(em.notify)
+	em.notify = make(chan struct{})
+}
+
+// Since returns the events with an id greater than since, waiting up to the
+// timeout for one to arrive if there are none
+func (em *EventMonitor) Since(since uint64, timeout time.Duration) []Event {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		em.mu.Lock()
+		events := make([]Event, 0)
+		for _, e := range em.events {
+			if e.ID > since {
+				events = append(events, e)
+			}
+		}
+		notify := em.notify
+		em.mu.Unlock()
+
+		if len(events) > 0 {
+			return events
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return events
+		}
+	}
+}
+
+// ServeHTTP long-polls for events. The "since" query parameter is the last
+// event id seen by the client and "timeout" is the number of seconds to wait.
+func (em *EventMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := DefaultEventPollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		seconds, err := strconv.ParseUint(t, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout > MaxEventPollTimeout {
+		timeout = MaxEventPollTimeout
+	}
+
+	events := em.Since(since, timeout)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.WithField("error", err).Error("failed to encode events")
+	}
+}
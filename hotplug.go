@@ -0,0 +1,369 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+	"github.com/mistifyio/mistify-agent/client"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// DeviceNamespace is the xml namespace used for disk metadata
+const DeviceNamespace = "http://mistify.io/xml/device/1"
+
+// ErrNoDisk is returned when detaching a disk a guest does not have
+var ErrNoDisk = errors.New("guest has no disk with that target device")
+
+// ErrDetachTimeout is returned when a running guest does not release a
+// detached disk in time. The disk stays in the guest's config and metadata and
+// its volume is kept, so the detach can be retried.
+var ErrDetachTimeout = errors.New("timed out waiting for guest to release the disk")
+
+type (
+	// DiskRequest is a request to attach a disk to, or detach a disk from, a
+	// guest
+	DiskRequest struct {
+		Guest *client.Guest `json:"guest"`
+		Disk  client.Disk   `json:"disk"`
+	}
+
+	// DiskResponse is the disk attached or detached and the guest's disks
+	// afterwards
+	DiskResponse struct {
+		Guest *client.Guest `json:"guest"`
+		Disk  client.Disk   `json:"disk"`
+		Disks []client.Disk `json:"disks"`
+	}
+)
+
+// affectFlags returns the flags to change a domain's persistent config and,
+// if it is running, its live state
+func affectFlags(domain BackendDomain) uint32 {
+	flags := uint32(libvirt.VIR_DOMAIN_AFFECT_CONFIG)
+	if active, err := domain.IsActive(); err == nil && active {
+		flags |= libvirt.VIR_DOMAIN_AFFECT_LIVE
+	}
+	return flags
+}
+
+// SetDeviceMetadata replaces the mistify device metadata of a libvirt domain
+func SetDeviceMetadata(domain BackendDomain, metadata MetadataDevice) error {
+	x, err := xml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	return domain.SetMetadata(libvirt.VIR_DOMAIN_METADATA_ELEMENT, string(x), "mistify-device", DeviceNamespace, affectFlags(domain))
+}
+
+// GuestDisks returns the disks of a domain, with their image and volume
+// information from the mistify metadata. Images attached read-only are
+// reported without a source, as they were requested.
+func (v *VirDomain) GuestDisks() []client.Disk {
+	disks := make([]client.Disk, 0, len(v.Devices.Disks))
+	for _, d := range v.Devices.Disks {
+		disk := client.Disk{
+			Bus:    d.Target.Bus,
+			Device: d.Target.Device,
+			Source: d.Source.Device,
+		}
+		if disk.Source == "" {
+			disk.Source = d.Source.File
+		}
+
+		for _, m := range v.Metadata.Device.Disks {
+			if m.Device == disk.Device {
+				disk.Image = m.Image
+				disk.Volume = m.Volume
+			}
+		}
+		if d.ReadOnly != nil && disk.Source == disk.Image {
+			disk.Source = ""
+		}
+
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+// parseDomainConfig retrieves and parses the persistent config of a libvirt
+// domain, rather than its live definition
+func parseDomainConfig(domain BackendDomain) (*VirDomain, error) {
+	xmldesc, err := domain.GetXMLDesc(libvirt.VIR_DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &VirDomain{}
+	if err = xml.Unmarshal([]byte(xmldesc), v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// waitForDetach polls a running libvirt domain until its guest has released a
+// disk or the timeout expires
+func waitForDetach(domain BackendDomain, device string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		v, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+		if !v.hasDisk(device) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrDetachTimeout
+		}
+		time.Sleep(statePollInterval)
+	}
+}
+
+// hasDisk returns whether a domain has a disk with a target device
+func (v *VirDomain) hasDisk(device string) bool {
+	for _, d := range v.Devices.Disks {
+		if d.Target.Device == device {
+			return true
+		}
+	}
+	return false
+}
+
+// hasController returns whether a domain has a controller of a type
+func (v *VirDomain) hasController(controllerType string) bool {
+	for _, c := range v.Devices.Controllers {
+		if c.Type == controllerType {
+			return true
+		}
+	}
+	return false
+}
+
+// DiskWrapper looks up and parses a libvirt domain for a disk request, runs a
+// function on it, and responds with the guest's disks
+func (lv *Libvirt) DiskWrapper(fn func(BackendDomain, *VirDomain, *DiskRequest) error) func(*http.Request, *DiskRequest, *DiskResponse) error {
+	return func(r *http.Request, request *DiskRequest, response *DiskResponse) error {
+		if request.Guest == nil || request.Guest.ID == "" {
+			return syscall.EINVAL
+		}
+
+		domain, err := lv.LookupDomainByName(request.Guest.ID)
+		if err != nil {
+			return err
+		}
+		defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": request.Guest.ID}, "failed to free domain")
+
+		v, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(domain, v, request); err != nil {
+			return err
+		}
+
+		if v, err = ParseDomain(domain); err != nil {
+			return err
+		}
+
+		state, err := GetState(domain)
+		if err != nil {
+			return err
+		}
+
+		*response = DiskResponse{
+			Guest: request.Guest,
+			Disk:  request.Disk,
+			Disks: v.GuestDisks(),
+		}
+		response.Guest.Disks = response.Disks
+		response.Guest.State = StateNames[state]
+
+		return nil
+	}
+}
+
+// AttachDisk attaches a disk to a guest's persistent config and, if it is
+// running, to the running guest. The disk gets the first free target device
+// on its bus unless it requests one, and a zvol like CreateGuest if it has no
+// source. scsi disks get a virtio-scsi controller if the guest has no scsi
+// controller. If any step fails, everything done so far is undone and a
+// *StepError describing the failed step is returned. The disk is attached
+// last, so undoing never has to wait for a running guest to release it before
+// destroying its volume.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainAttachDeviceFlags
+func (lv *Libvirt) AttachDisk(r *http.Request, request *DiskRequest, response *DiskResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest": request.Guest.ID,
+		"disk":  request.Disk.Device,
+		"bus":   request.Disk.Bus,
+	}).Info("Libvirt.AttachDisk")
+
+	unlock, err := lv.lockGuest(r, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.DiskWrapper(func(domain BackendDomain, v *VirDomain, request *DiskRequest) error {
+		disk := &request.Disk
+
+		used := make(map[string]bool, len(v.Devices.Disks))
+		for _, d := range v.Devices.Disks {
+			used[d.Target.Device] = true
+		}
+		if err := checkDiskTarget(disk, used); err != nil {
+			return err
+		}
+		if disk.Device == "" {
+			name, err := nextDiskTarget(disk, used)
+			if err != nil {
+				return err
+			}
+			disk.Device = name
+		}
+		if err := checkDiskSource(disk); err != nil {
+			return err
+		}
+		if err := lv.checkDiskVolume(disk); err != nil {
+			return err
+		}
+
+		unlockVolumes, err := lv.lockVolumes(diskPaths([]client.Disk{*disk})...)
+		if err != nil {
+			return err
+		}
+		defer unlockVolumes()
+
+		flags := affectFlags(domain)
+		rb := newRollback("AttachDisk")
+
+		if needsVolume(disk) {
+			if err := lv.createDiskVolume(rb, request.Guest, disk); err != nil {
+				return err
+			}
+		}
+
+		if controllers := diskControllers([]client.Disk{*disk}); len(controllers) > 0 && !v.hasController("scsi") {
+			x, err := xml.Marshal(controllers[0])
+			if err != nil {
+				return rb.fail("generate controller", err)
+			}
+			if err = domain.AttachDeviceFlags(string(x), flags); err != nil {
+				return rb.fail("attach controller", err)
+			}
+			rb.add("attach controller", func() error {
+				return domain.DetachDeviceFlags(string(x), flags)
+			})
+		}
+
+		x, err := xml.Marshal(GuestDisk(*disk))
+		if err != nil {
+			return rb.fail("generate disk", err)
+		}
+
+		metadata := v.Metadata.Device
+		metadata.Disks = append(metadata.Disks, MetadataDisk{
+			Device: disk.Device,
+			Image:  disk.Image,
+			Volume: disk.Volume,
+		})
+		if err = SetDeviceMetadata(domain, metadata); err != nil {
+			return rb.fail("set device metadata", err)
+		}
+		rb.add("set device metadata", func() error {
+			return SetDeviceMetadata(domain, v.Metadata.Device)
+		})
+
+		if err = domain.AttachDeviceFlags(string(x), flags); err != nil {
+			return rb.fail("attach disk "+disk.Device, err)
+		}
+
+		return nil
+	})(r, request, response)
+}
+
+// DetachDisk detaches a disk, by its target device, from a guest's persistent
+// config and, if it is running, from the running guest, which must release
+// it first. The disk's volume is destroyed if it was created for the guest. If
+// the guest does not release the disk in time, ErrDetachTimeout is returned
+// and the disk is left in the config, metadata and volume until a retry.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainDetachDeviceFlags
+func (lv *Libvirt) DetachDisk(r *http.Request, request *DiskRequest, response *DiskResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" || request.Disk.Device == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest": request.Guest.ID,
+		"disk":  request.Disk.Device,
+	}).Info("Libvirt.DetachDisk")
+
+	unlock, err := lv.lockGuest(r, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.DiskWrapper(func(domain BackendDomain, v *VirDomain, request *DiskRequest) error {
+		config, err := parseDomainConfig(domain)
+		if err != nil {
+			return err
+		}
+
+		var x []byte
+		for i, d := range config.GuestDisks() {
+			if d.Device != request.Disk.Device {
+				continue
+			}
+			request.Disk = d
+			if x, err = xml.Marshal(config.Devices.Disks[i]); err != nil {
+				return err
+			}
+		}
+		if x == nil {
+			return ErrNoDisk
+		}
+
+		// the volume can't be destroyed while the running guest still uses
+		// it, and libvirt only asks the guest to release the disk
+		if affectFlags(domain)&libvirt.VIR_DOMAIN_AFFECT_LIVE != 0 && v.hasDisk(request.Disk.Device) {
+			if err = domain.DetachDeviceFlags(string(x), libvirt.VIR_DOMAIN_AFFECT_LIVE); err != nil {
+				return err
+			}
+			if err = waitForDetach(domain, request.Disk.Device, lv.detachTimeout); err != nil {
+				return err
+			}
+		}
+		if err = domain.DetachDeviceFlags(string(x), libvirt.VIR_DOMAIN_AFFECT_CONFIG); err != nil {
+			return err
+		}
+
+		metadata := config.Metadata.Device
+		metadata.Disks = make([]MetadataDisk, 0, len(config.Metadata.Device.Disks))
+		for _, m := range config.Metadata.Device.Disks {
+			if m.Device != request.Disk.Device {
+				metadata.Disks = append(metadata.Disks, m)
+			}
+		}
+		if err = SetDeviceMetadata(domain, metadata); err != nil {
+			return err
+		}
+
+		if lv.createdVolume(request.Guest.ID, MetadataDisk{Device: request.Disk.Device, Volume: request.Disk.Volume}) {
+			return lv.destroyVolume(request.Disk.Volume)
+		}
+		return nil
+	})(r, request, response)
+}
@@ -0,0 +1,181 @@
+package libvirt
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// IdempotencyKeyHeader is the HTTP header carrying an idempotency key. The
+// idempotency_key query parameter may be used instead.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayHeader is set on responses replayed from the cache
+const IdempotentReplayHeader = "Idempotent-Replayed"
+
+// DefaultIdempotencyWindow is how long responses are kept for their
+// idempotency key, unless changed with SetIdempotencyWindow
+const DefaultIdempotencyWindow = time.Hour
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is used again
+// for a different call
+var ErrIdempotencyKeyReused = errors.New("idempotency key was used for a different call")
+
+type (
+	// idempotencyCache keeps the responses of successful calls by caller and
+	// idempotency key
+	idempotencyCache struct {
+		lock    sync.Mutex
+		entries map[string]*idempotencyEntry
+		window  time.Duration
+	}
+
+	// idempotencyEntry is a call in progress or its cached result. done is
+	// closed when the call finishes.
+	idempotencyEntry struct {
+		sum       [sha256.Size]byte
+		done      chan struct{}
+		succeeded bool
+		result    *json.RawMessage
+		expires   time.Time
+	}
+)
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		entries: make(map[string]*idempotencyEntry),
+		window:  DefaultIdempotencyWindow,
+	}
+}
+
+// reserve returns the entry for a key, creating it if there is none. The
+// returned bool is true if the entry is new and the call should be made.
+func (c *idempotencyCache) reserve(key string, sum [sha256.Size]byte) (*idempotencyEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if !entry.expires.IsZero() && entry.expires.Before(now) {
+			delete(c.entries, k)
+		}
+	}
+
+	if entry, ok := c.entries[key]; ok {
+		return entry, false
+	}
+
+	entry := &idempotencyEntry{
+		sum:  sum,
+		done: make(chan struct{}),
+	}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// complete caches the result of a successful call, or forgets a failed one so
+// it can be retried
+func (c *idempotencyCache) complete(key string, entry *idempotencyEntry, result *json.RawMessage, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ok {
+		entry.succeeded = true
+		entry.result = result
+		entry.expires = time.Now().Add(c.window)
+	} else {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+}
+
+// SetIdempotencyWindow sets how long responses are kept for their idempotency
+// key
+func (lv *Libvirt) SetIdempotencyWindow(window time.Duration) {
+	lv.idempotency.lock.Lock()
+	defer lv.idempotency.lock.Unlock()
+
+	lv.idempotency.window = window
+}
+
+// IdempotencyHandler wraps an HTTP handler so that calls to MutatingMethods
+// made again with the same idempotency key return the original response
+// instead of being made again. Keys are per caller, and only successful
+// responses are kept, so failed calls can be retried. A retry while the
+// original call is still running waits for it.
+func (lv *Libvirt) IdempotencyHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			key = r.URL.Query().Get("idempotency_key")
+		}
+		if key == "" || r.URL.Path != rpc.RPCPath {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		request, err := readRPCRequest(w, r)
+		if err != nil || !MutatingMethods[request.Method] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		// an async call's response is its job, so its retries get the same job
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s", request.Method, r.URL.Query().Get("async"), request.Params)))
+		cacheKey := Caller(r) + "\x00" + key
+
+		for {
+			entry, ok := lv.idempotency.reserve(cacheKey, sum)
+			if entry.sum != sum {
+				log.WithFields(log.Fields{
+					"key":    key,
+					"method": request.Method,
+				}).Warn("idempotency key reused")
+				writeRPCResponse(w, http.StatusConflict, nil, ErrIdempotencyKeyReused.Error(), request.ID)
+				return
+			}
+
+			if ok {
+				lv.serveIdempotent(handler, w, r, cacheKey, entry)
+				return
+			}
+
+			<-entry.done
+			if entry.succeeded {
+				log.WithFields(log.Fields{
+					"key":    key,
+					"method": request.Method,
+				}).Info("replaying idempotent call")
+				w.Header().Set(IdempotentReplayHeader, "true")
+				writeRPCResponse(w, http.StatusOK, entry.result, nil, request.ID)
+				return
+			}
+			// the original call failed and was forgotten, so make it again
+		}
+	})
+}
+
+// serveIdempotent makes a call and completes its idempotency entry, even if the
+// call panics, so retries waiting for it are not stuck
+func (lv *Libvirt) serveIdempotent(handler http.Handler, w http.ResponseWriter, r *http.Request, key string, entry *idempotencyEntry) {
+	completed := false
+	defer func() {
+		if !completed {
+			lv.idempotency.complete(key, entry, nil, false)
+		}
+	}()
+
+	rw := newRecordingResponseWriter(w)
+	handler.ServeHTTP(rw, r)
+
+	result, rpcErr := rw.outcome()
+	lv.idempotency.complete(key, entry, result, rpcErr == "")
+	completed = true
+}
@@ -0,0 +1,132 @@
+package libvirt_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// idempotentCall makes a call with an idempotency key and returns the recorded
+// response and its decoded body
+func idempotentCall(t *testing.T, handler http.Handler, key string, id int, guest *client.Guest) (*httptest.ResponseRecorder, *rpc.GuestResponse, string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"method": "Libvirt.CreateGuest",
+		"params": []interface{}{rpc.GuestRequest{Guest: guest}},
+		"id":     id,
+	})
+	r, err := http.NewRequest("POST", "http://localhost"+rpc.RPCPath, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("can't create request: %s\n", err.Error())
+	}
+	if key != "" {
+		r.Header.Set(mlibvirt.IdempotencyKeyHeader, key)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	response := struct {
+		Result *rpc.GuestResponse `json:"result"`
+		Error  interface{}        `json:"error"`
+		ID     int                `json:"id"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %s: %s\n", w.Body.String(), err.Error())
+	}
+	if response.ID != id {
+		t.Fatalf("expected response id %d, got %d\n", id, response.ID)
+	}
+
+	rpcErr := ""
+	if response.Error != nil {
+		rpcErr = response.Error.(string)
+	}
+	return w, response.Result, rpcErr
+}
+
+func TestIdempotency(t *testing.T) {
+	lv, _, _ := fakeSetup(t)
+
+	calls := 0
+	fail := false
+	handler := lv.IdempotencyHandler(rpcHandler(map[string]guestRPC{
+		"Libvirt.CreateGuest": func(r *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+			calls++
+			if fail {
+				return syscall.EIO
+			}
+			return lv.CreateGuest(r, request, response)
+		},
+	}))
+
+	guest := &client.Guest{ID: "idempotent-guest", Type: "test", Memory: 256, CPU: 1}
+
+	w, result, rpcErr := idempotentCall(t, handler, "key-1", 1, guest)
+	if rpcErr != "" || result == nil || result.Guest.ID != guest.ID {
+		t.Fatalf("CreateGuest failed: %s\n", rpcErr)
+	}
+	if w.Header().Get(mlibvirt.IdempotentReplayHeader) != "" {
+		t.Fatalf("first call should not be a replay\n")
+	}
+
+	// a retry is answered from the cache rather than defining the guest again
+	w, replayed, rpcErr := idempotentCall(t, handler, "key-1", 2, guest)
+	if rpcErr != "" || replayed == nil || replayed.Guest.ID != guest.ID || replayed.Guest.State != result.Guest.State {
+		t.Fatalf("expected replayed response, got %+v %s\n", replayed, rpcErr)
+	}
+	if w.Header().Get(mlibvirt.IdempotentReplayHeader) != "true" {
+		t.Fatalf("expected retry to be a replay\n")
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d\n", calls)
+	}
+
+	// reusing the key for another call is refused
+	other := &client.Guest{ID: "other-guest", Type: "test", Memory: 256, CPU: 1}
+	w, _, rpcErr = idempotentCall(t, handler, "key-1", 3, other)
+	if w.Code != http.StatusConflict || rpcErr != mlibvirt.ErrIdempotencyKeyReused.Error() {
+		t.Fatalf("expected ErrIdempotencyKeyReused, got %d %s\n", w.Code, rpcErr)
+	}
+
+	// without a key, or with a new one, the call is made again
+	if _, _, rpcErr = idempotentCall(t, handler, "", 4, guest); rpcErr != "" {
+		t.Fatalf("CreateGuest failed: %s\n", rpcErr)
+	}
+	if _, _, rpcErr = idempotentCall(t, handler, "key-2", 5, guest); rpcErr != "" {
+		t.Fatalf("CreateGuest failed: %s\n", rpcErr)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d\n", calls)
+	}
+
+	// failures are not cached
+	fail = true
+	if _, _, rpcErr = idempotentCall(t, handler, "key-3", 6, other); rpcErr == "" {
+		t.Fatalf("expected CreateGuest to fail\n")
+	}
+	fail = false
+	if _, _, rpcErr = idempotentCall(t, handler, "key-3", 7, other); rpcErr != "" {
+		t.Fatalf("CreateGuest failed: %s\n", rpcErr)
+	}
+	if calls != 5 {
+		t.Fatalf("expected 5 calls, got %d\n", calls)
+	}
+
+	// cached responses expire
+	lv.SetIdempotencyWindow(0)
+	for id := 8; id < 10; id++ {
+		if _, _, rpcErr = idempotentCall(t, handler, "key-4", id, other); rpcErr != "" {
+			t.Fatalf("CreateGuest failed: %s\n", rpcErr)
+		}
+	}
+	if calls != 7 {
+		t.Fatalf("expected 7 calls, got %d\n", calls)
+	}
+}
@@ -0,0 +1,461 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/pborman/uuid"
+)
+
+// Job states
+const (
+	JobStateRunning   = "running"
+	JobStateCompleted = "completed"
+	JobStateFailed    = "failed"
+	JobStateCancelled = "cancelled"
+)
+
+// DefaultJobRetention is how long finished jobs are kept, unless changed with
+// SetJobRetention
+const DefaultJobRetention = time.Hour
+
+// jobHeader carries the id of the job a call runs as. JobHandler sets it on
+// the job's own copy of the request and removes it from any other.
+const jobHeader = "X-Mistify-Job"
+
+// JobMethods are the RPC methods that manage jobs and are never run as one
+var JobMethods = map[string]bool{
+	"Libvirt.JobStatus": true,
+	"Libvirt.ListJobs":  true,
+	"Libvirt.CancelJob": true,
+}
+
+var (
+	// ErrJobNotFound is returned for unknown or expired job ids
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobFinished is returned when cancelling a job that is not running
+	ErrJobFinished = errors.New("job has already finished")
+	// ErrJobNotCancellable is returned when cancelling a job that is not for
+	// a guest
+	ErrJobNotCancellable = errors.New("job can not be cancelled")
+	// ErrJobCancelled is returned to a job's call that was cancelled before
+	// it took its guest's lock
+	ErrJobCancelled = errors.New("job was cancelled")
+)
+
+type (
+	// Job is an RPC call running in the background. Result is the call's
+	// response once it has completed.
+	Job struct {
+		ID       string           `json:"id"`
+		Method   string           `json:"method"`
+		Guest    string           `json:"guest,omitempty"`
+		Caller   string           `json:"caller,omitempty"`
+		State    string           `json:"state"`
+		Created  time.Time        `json:"created"`
+		Finished *time.Time       `json:"finished,omitempty"`
+		Progress *JobProgress     `json:"progress,omitempty"`
+		Result   *json.RawMessage `json:"result,omitempty"`
+		Error    string           `json:"error,omitempty"`
+
+		cancelled bool
+		// locked is set while the call holds its guest's lock, so the
+		// guest's libvirt job, if any, is its own
+		locked bool
+	}
+
+	// JobRequest is a request for a job by id
+	JobRequest struct {
+		ID string `json:"id"`
+	}
+
+	// JobResponse is a job
+	JobResponse struct {
+		Job *Job `json:"job"`
+	}
+
+	// ListJobsRequest filters jobs by guest and state. Empty fields match all
+	// jobs.
+	ListJobsRequest struct {
+		Guest string `json:"guest,omitempty"`
+		State string `json:"state,omitempty"`
+	}
+
+	// ListJobsResponse is a list of jobs, oldest first
+	ListJobsResponse struct {
+		Jobs []*Job `json:"jobs"`
+	}
+
+	// jobTable keeps running jobs and recently finished ones
+	jobTable struct {
+		lock      sync.Mutex
+		jobs      map[string]*Job
+		retention time.Duration
+	}
+
+	// jobResponseWriter keeps the response of a job's call
+	jobResponseWriter struct {
+		header http.Header
+		status int
+		body   bytes.Buffer
+	}
+)
+
+func newJobTable() *jobTable {
+	return &jobTable{
+		jobs:      make(map[string]*Job),
+		retention: DefaultJobRetention,
+	}
+}
+
+// add starts tracking a new job
+func (t *jobTable) add(job *Job) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.prune()
+	t.jobs[job.ID] = job
+}
+
+// prune removes jobs that finished longer ago than the retention. It must be
+// called with the table locked.
+func (t *jobTable) prune() {
+	cutoff := time.Now().Add(-t.retention)
+	for id, job := range t.jobs {
+		if job.Finished != nil && job.Finished.Before(cutoff) {
+			delete(t.jobs, id)
+		}
+	}
+}
+
+// get returns a copy of a job
+func (t *jobTable) get(id string) (*Job, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	job, ok := t.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	j := *job
+	return &j, nil
+}
+
+// update runs a function on a job with the table locked
+func (t *jobTable) update(id string, fn func(*Job) error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	job, ok := t.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	return fn(job)
+}
+
+// acquired records that a job's call took its guest's lock. ErrJobCancelled is
+// returned if the job was cancelled while it waited. Ids of calls that are not
+// jobs are ignored.
+func (t *jobTable) acquired(id string) error {
+	if id == "" {
+		return nil
+	}
+	err := t.update(id, func(job *Job) error {
+		if job.cancelled {
+			return ErrJobCancelled
+		}
+		job.locked = true
+		return nil
+	})
+	if err == ErrJobNotFound {
+		return nil
+	}
+	return err
+}
+
+// released records that a job's call let go of its guest's lock
+func (t *jobTable) released(id string) {
+	if id == "" {
+		return
+	}
+	_ = t.update(id, func(job *Job) error {
+		job.locked = false
+		return nil
+	})
+}
+
+// list returns copies of the jobs matching a request, oldest first
+func (t *jobTable) list(request *ListJobsRequest) []*Job {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.prune()
+
+	jobs := make([]*Job, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		if request.Guest != "" && request.Guest != job.Guest {
+			continue
+		}
+		if request.State != "" && request.State != job.State {
+			continue
+		}
+		j := *job
+		jobs = append(jobs, &j)
+	}
+
+	sort.Sort(jobsByCreated(jobs))
+	return jobs
+}
+
+type jobsByCreated []*Job
+
+func (s jobsByCreated) Len() int           { return len(s) }
+func (s jobsByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s jobsByCreated) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+
+// finish records the outcome of a job from its call's response
+func (t *jobTable) finish(id string, w *jobResponseWriter) {
+	result, rpcErr := rpcOutcome(w.status, w.body.Bytes())
+
+	_ = t.update(id, func(job *Job) error {
+		now := time.Now().UTC()
+		job.Finished = &now
+
+		switch {
+		case rpcErr == "":
+			job.State = JobStateCompleted
+			job.Result = result
+		case job.cancelled:
+			job.State = JobStateCancelled
+			job.Error = rpcErr
+		default:
+			job.State = JobStateFailed
+			job.Error = rpcErr
+		}
+
+		log.WithFields(log.Fields{
+			"job":    job.ID,
+			"method": job.Method,
+			"guest":  job.Guest,
+			"state":  job.State,
+			"error":  job.Error,
+		}).Info("job finished")
+		return nil
+	})
+}
+
+func (w *jobResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *jobResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *jobResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// SetJobRetention sets how long finished jobs are kept
+func (lv *Libvirt) SetJobRetention(retention time.Duration) {
+	lv.jobs.lock.Lock()
+	defer lv.jobs.lock.Unlock()
+
+	lv.jobs.retention = retention
+}
+
+// JobHandler wraps an HTTP handler to run RPC calls made with the query
+// parameter async=true as jobs. The job is returned at once in a JobResponse
+// and the call's response becomes the job's result.
+func (lv *Libvirt) JobHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(jobHeader)
+
+		if r.URL.Path != rpc.RPCPath {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); !async {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		request, err := readRPCRequest(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if JobMethods[request.Method] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		// readRPCRequest left the body in memory
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		job := &Job{
+			ID:      uuid.New(),
+			Method:  request.Method,
+			Guest:   request.guest(),
+			Caller:  Caller(r),
+			State:   JobStateRunning,
+			Created: time.Now().UTC(),
+		}
+		started := *job
+		lv.jobs.add(job)
+
+		log.WithFields(log.Fields{
+			"job":    job.ID,
+			"method": job.Method,
+			"guest":  job.Guest,
+		}).Info("job started")
+
+		// the call outlives this request, so it gets its own copy
+		jr := new(http.Request)
+		*jr = *r
+		jr.Header = make(http.Header, len(r.Header))
+		for k, v := range r.Header {
+			jr.Header[k] = v
+		}
+		jr.Header.Set(jobHeader, job.ID)
+		jr.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		response := &jobResponseWriter{header: make(http.Header), status: http.StatusOK}
+		go func() {
+			handler.ServeHTTP(response, jr)
+			lv.jobs.finish(job.ID, response)
+		}()
+
+		writeRPCResponse(w, http.StatusOK, &JobResponse{Job: &started}, nil, request.ID)
+	})
+}
+
+// JobStatus looks up a job. The progress of a running job for a guest is
+// refreshed from the guest's libvirt domain job, if it has one.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainGetJobInfo
+func (lv *Libvirt) JobStatus(r *http.Request, request *JobRequest, response *JobResponse) error {
+	if request.ID == "" {
+		return syscall.EINVAL
+	}
+
+	job, err := lv.jobs.get(request.ID)
+	if err != nil {
+		return err
+	}
+
+	if job.State == JobStateRunning && job.Guest != "" {
+		if progress := lv.guestJobProgress(job.Guest); progress != nil {
+			_ = lv.jobs.update(job.ID, func(j *Job) error {
+				j.Progress = progress
+				return nil
+			})
+			job.Progress = progress
+		}
+	}
+
+	*response = JobResponse{
+		Job: job,
+	}
+
+	return nil
+}
+
+// guestJobProgress returns the progress of the libvirt job of a guest's
+// domain, or nil if there is none
+func (lv *Libvirt) guestJobProgress(id string) *JobProgress {
+	domain, err := lv.LookupDomainByName(id)
+	if err != nil {
+		return nil
+	}
+	defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": id}, "failed to free domain")
+
+	if active, err := domain.IsActive(); err != nil || !active {
+		return nil
+	}
+
+	progress, err := domain.GetJobProgress()
+	if err != nil {
+		return nil
+	}
+	return progress
+}
+
+// ListJobs lists running and recently finished jobs
+func (lv *Libvirt) ListJobs(r *http.Request, request *ListJobsRequest, response *ListJobsResponse) error {
+	*response = ListJobsResponse{
+		Jobs: lv.jobs.list(request),
+	}
+
+	return nil
+}
+
+// CancelJob cancels a running job for a guest. A job whose call holds the
+// guest's lock is cancelled by aborting the guest's libvirt domain job, such as
+// a migration, and can't be cancelled if there is none. A job still waiting
+// for the lock is marked cancelled and its call fails with ErrJobCancelled
+// instead of starting. Jobs without a guest can't be cancelled.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainAbortJob
+func (lv *Libvirt) CancelJob(r *http.Request, request *JobRequest, response *JobResponse) error {
+	if request.ID == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"job": request.ID,
+	}).Info("Libvirt.CancelJob")
+
+	// the table stays locked while aborting, so the call can't let go of the
+	// guest's lock and another operation's libvirt job be aborted instead
+	err := lv.jobs.update(request.ID, func(j *Job) error {
+		if j.State != JobStateRunning {
+			return ErrJobFinished
+		}
+		if j.Guest == "" {
+			return ErrJobNotCancellable
+		}
+		if !j.locked {
+			j.cancelled = true
+			return nil
+		}
+
+		domain, err := lv.LookupDomainByName(j.Guest)
+		if err != nil {
+			return err
+		}
+		defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": j.Guest}, "failed to free domain")
+
+		if err := domain.AbortJob(); err != nil {
+			return err
+		}
+		j.cancelled = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	job, err := lv.jobs.get(request.ID)
+	if err != nil {
+		return err
+	}
+	*response = JobResponse{
+		Job: job,
+	}
+
+	return nil
+}
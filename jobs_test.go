@@ -0,0 +1,171 @@
+package libvirt_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexzorin/libvirt-go"
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// startJob makes an async call through a job handler and returns the job
+func startJob(t *testing.T, handler http.Handler, method string, guest *client.Guest) *mlibvirt.Job {
+	body, _ := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": []interface{}{rpc.GuestRequest{Guest: guest}},
+		"id":     1,
+	})
+	r, err := http.NewRequest("POST", "http://localhost"+rpc.RPCPath+"?async=true", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("can't create request: %s\n", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	response := struct {
+		Result *mlibvirt.JobResponse `json:"result"`
+		Error  interface{}           `json:"error"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %s: %s\n", w.Body.String(), err.Error())
+	}
+	if response.Error != nil || response.Result == nil || response.Result.Job == nil {
+		t.Fatalf("expected a job, got %s\n", w.Body.String())
+	}
+	return response.Result.Job
+}
+
+// waitJob polls JobStatus until a job is no longer running
+func waitJob(t *testing.T, lv *mlibvirt.Libvirt, id string) *mlibvirt.Job {
+	for i := 0; i < 500; i++ {
+		response := &mlibvirt.JobResponse{}
+		if err := lv.JobStatus(nil, &mlibvirt.JobRequest{ID: id}, response); err != nil {
+			t.Fatalf("JobStatus failed: %s\n", err.Error())
+		}
+		if response.Job.State != mlibvirt.JobStateRunning {
+			return response.Job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish\n", id)
+	return nil
+}
+
+func TestJobs(t *testing.T) {
+	lv, _, guest := fakeSetup(t)
+
+	handler := lv.JobHandler(rpcHandler(map[string]guestRPC{
+		"Libvirt.Run":    lv.Run,
+		"Libvirt.Delete": lv.Delete,
+	}))
+
+	job := startJob(t, handler, "Libvirt.Run", guest)
+	if job.ID == "" || job.Method != "Libvirt.Run" || job.Guest != guest.ID || job.State != mlibvirt.JobStateRunning {
+		t.Fatalf("unexpected job %+v\n", job)
+	}
+
+	job = waitJob(t, lv, job.ID)
+	if job.State != mlibvirt.JobStateCompleted || job.Result == nil || job.Finished == nil {
+		t.Fatalf("expected completed job with a result, got %+v\n", job)
+	}
+	result := &rpc.GuestResponse{}
+	if err := json.Unmarshal(*job.Result, result); err != nil {
+		t.Fatalf("invalid job result %s: %s\n", *job.Result, err.Error())
+	}
+	if result.Guest.State != "running" {
+		t.Fatalf("expected guest to be running, got %s\n", result.Guest.State)
+	}
+
+	missing := &client.Guest{ID: "missing-guest"}
+	failed := waitJob(t, lv, startJob(t, handler, "Libvirt.Delete", missing).ID)
+	if failed.State != mlibvirt.JobStateFailed || failed.Error == "" {
+		t.Fatalf("expected failed job with an error, got %+v\n", failed)
+	}
+
+	list := &mlibvirt.ListJobsResponse{}
+	if err := lv.ListJobs(nil, &mlibvirt.ListJobsRequest{}, list); err != nil {
+		t.Fatalf("ListJobs failed: %s\n", err.Error())
+	}
+	if len(list.Jobs) != 2 || list.Jobs[0].ID != job.ID || list.Jobs[1].ID != failed.ID {
+		t.Fatalf("expected both jobs oldest first, got %+v\n", list.Jobs)
+	}
+
+	if err := lv.ListJobs(nil, &mlibvirt.ListJobsRequest{State: mlibvirt.JobStateFailed}, list); err != nil {
+		t.Fatalf("ListJobs failed: %s\n", err.Error())
+	}
+	if len(list.Jobs) != 1 || list.Jobs[0].ID != failed.ID {
+		t.Fatalf("expected only the failed job, got %+v\n", list.Jobs)
+	}
+
+	if err := lv.CancelJob(nil, &mlibvirt.JobRequest{ID: job.ID}, &mlibvirt.JobResponse{}); err != mlibvirt.ErrJobFinished {
+		t.Fatalf("Expected ErrJobFinished, got %v\n", err)
+	}
+	if err := lv.JobStatus(nil, &mlibvirt.JobRequest{ID: "unknown"}, &mlibvirt.JobResponse{}); err != mlibvirt.ErrJobNotFound {
+		t.Fatalf("Expected ErrJobNotFound, got %v\n", err)
+	}
+
+	// finished jobs expire
+	lv.SetJobRetention(0)
+	if err := lv.ListJobs(nil, &mlibvirt.ListJobsRequest{}, list); err != nil {
+		t.Fatalf("ListJobs failed: %s\n", err.Error())
+	}
+	if len(list.Jobs) != 0 {
+		t.Fatalf("expected finished jobs to expire, got %+v\n", list.Jobs)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	lv, backend, guest := fakeSetup(t)
+	guest = call(t, "Run", lv.Run, guest, "running")
+	backend.IgnoreShutdown(guest.ID, true)
+
+	handler := lv.JobHandler(rpcHandler(map[string]guestRPC{
+		"Libvirt.GracefulShutdown": func(r *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+			shutdown := &mlibvirt.ShutdownRequest{Guest: request.Guest, Timeout: 1, Force: true}
+			return lv.GracefulShutdown(r, shutdown, &mlibvirt.ShutdownResponse{})
+		},
+		"Libvirt.Reboot": lv.Reboot,
+	}))
+
+	// the shutdown times out holding the guest's lock
+	shutdown := startJob(t, handler, "Libvirt.GracefulShutdown", guest)
+	time.Sleep(100 * time.Millisecond)
+
+	// the fake backend never has a libvirt job to abort
+	err := lv.CancelJob(nil, &mlibvirt.JobRequest{ID: shutdown.ID}, &mlibvirt.JobResponse{})
+	expectVirError(t, "CancelJob", err, libvirt.VIR_ERR_OPERATION_INVALID)
+
+	// a job waiting for the lock is skipped without aborting the shutdown
+	reboot := startJob(t, handler, "Libvirt.Reboot", guest)
+	response := &mlibvirt.JobResponse{}
+	if err := lv.CancelJob(nil, &mlibvirt.JobRequest{ID: reboot.ID}, response); err != nil {
+		t.Fatalf("CancelJob of a waiting job failed: %s\n", err.Error())
+	}
+	if response.Job.State != mlibvirt.JobStateRunning {
+		t.Fatalf("expected the cancelled job to still be running, got %+v\n", response.Job)
+	}
+
+	if shutdown = waitJob(t, lv, shutdown.ID); shutdown.State != mlibvirt.JobStateCompleted {
+		t.Fatalf("expected shutdown job to complete, got %+v\n", shutdown)
+	}
+	if reboot = waitJob(t, lv, reboot.ID); reboot.State != mlibvirt.JobStateCancelled || !strings.Contains(reboot.Error, mlibvirt.ErrJobCancelled.Error()) {
+		t.Fatalf("expected reboot job to be cancelled, got %+v\n", reboot)
+	}
+	call(t, "Status", lv.Status, guest, "shutoff")
+
+	// calls without async run synchronously, and can't claim to be a job
+	r, _ := http.NewRequest("POST", "http://localhost"+rpc.RPCPath, strings.NewReader(`{"method": "Libvirt.Reboot", "params": [{"guest": {"id": "fake-guest"}}], "id": 2}`))
+	r.Header.Set("X-Mistify-Job", reboot.ID)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if strings.Contains(w.Body.String(), `"job"`) || strings.Contains(w.Body.String(), mlibvirt.ErrJobCancelled.Error()) {
+		t.Fatalf("expected a synchronous response, got %s\n", w.Body.String())
+	}
+}
@@ -0,0 +1,120 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxRequestSize limits how much of a request body is read to find its method
+const maxRequestSize = 10 << 20
+
+type (
+	// jsonRPCRequest is the envelope of a JSON-RPC request
+	jsonRPCRequest struct {
+		Method string           `json:"method"`
+		Params json.RawMessage  `json:"params"`
+		ID     *json.RawMessage `json:"id"`
+	}
+
+	// jsonRPCResponse is the envelope of a JSON-RPC response
+	jsonRPCResponse struct {
+		Result interface{}      `json:"result"`
+		Error  interface{}      `json:"error"`
+		ID     *json.RawMessage `json:"id"`
+	}
+
+	// jsonRPCGuestParams is the guest of a request's params, if it has one
+	jsonRPCGuestParams []struct {
+		Guest *struct {
+			ID string `json:"id"`
+		} `json:"guest"`
+	}
+
+	// recordingResponseWriter keeps a copy of a response as it is written
+	recordingResponseWriter struct {
+		http.ResponseWriter
+		status int
+		body   bytes.Buffer
+	}
+)
+
+// readRPCRequest parses a JSON-RPC request, leaving its body to be read again
+// by the next handler
+func readRPCRequest(w http.ResponseWriter, r *http.Request) (*jsonRPCRequest, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		return nil, err
+	}
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	request := &jsonRPCRequest{}
+	if err := json.Unmarshal(body, request); err != nil || request.Method == "" {
+		return nil, errors.New("invalid JSON-RPC request")
+	}
+	return request, nil
+}
+
+// guest returns the id of the guest a request is for, or an empty string if
+// its method does not take a guest
+func (r *jsonRPCRequest) guest() string {
+	params := jsonRPCGuestParams{}
+	if err := json.Unmarshal(r.Params, &params); err != nil || len(params) == 0 || params[0].Guest == nil {
+		return ""
+	}
+	return params[0].Guest.ID
+}
+
+// rpcOutcome returns the result and error of a JSON-RPC response. Responses
+// that are not JSON-RPC, such as errors for unknown methods, are errors.
+func rpcOutcome(status int, body []byte) (*json.RawMessage, string) {
+	response := struct {
+		Result *json.RawMessage `json:"result"`
+		Error  interface{}      `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		if text := strings.TrimSpace(string(body)); status >= http.StatusBadRequest && text != "" {
+			return nil, text
+		}
+		return nil, fmt.Sprintf("invalid JSON-RPC response: %d %s", status, http.StatusText(status))
+	}
+	if response.Error != nil {
+		return nil, fmt.Sprint(response.Error)
+	}
+	return response.Result, ""
+}
+
+// writeRPCResponse writes a JSON-RPC response
+func writeRPCResponse(w http.ResponseWriter, status int, result interface{}, rpcErr interface{}, id *json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&jsonRPCResponse{
+		Result: result,
+		Error:  rpcErr,
+		ID:     id,
+	})
+}
+
+func newRecordingResponseWriter(w http.ResponseWriter) *recordingResponseWriter {
+	return &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	_, _ = w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// outcome returns the result and error of the response
+func (w *recordingResponseWriter) outcome() (*json.RawMessage, string) {
+	return rpcOutcome(w.status, w.body.Bytes())
+}
@@ -1,9 +1,12 @@
 package libvirt
 
 import (
-	"fmt"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
 	"syscall"
+	"time"
 
 	"encoding/xml"
 
@@ -26,19 +29,96 @@ var StateNames = map[int]string{
 	libvirt.VIR_DOMAIN_SHUTOFF:     "shutoff",
 }
 
+// Shutdown methods reported by GracefulShutdown
+const (
+	ShutdownMethodNone     = "none"
+	ShutdownMethodShutdown = "shutdown"
+	ShutdownMethodPoweroff = "poweroff"
+)
+
+// DefaultShutdownTimeout is how long GracefulShutdown waits when the request
+// does not specify a timeout, unless changed with SetShutdownTimeout
+const DefaultShutdownTimeout = 60 * time.Second
+
+// DefaultDetachTimeout is how long DetachDisk waits for a running guest to
+// release a disk, unless changed with SetDetachTimeout
+const DefaultDetachTimeout = 30 * time.Second
+
+// ErrShutdownTimeout is returned when a guest does not shut down in time and
+// powering it off was not requested
+var ErrShutdownTimeout = errors.New("timed out waiting for guest to shut down")
+
+// statePollInterval is how often a domain's state is checked while waiting
+var statePollInterval = 500 * time.Millisecond
+
 type (
-	// Connection is a libvirt connection
+	// ShutdownRequest is a request to shut down a guest and wait for it
+	ShutdownRequest struct {
+		Guest *client.Guest `json:"guest"`
+		// Seconds to wait for the guest to shut down
+		Timeout uint `json:"timeout,omitempty"`
+		// Power off the guest if it can't be shut down or does not shut down
+		// in time
+		Force bool `json:"force,omitempty"`
+	}
+
+	// ShutdownResponse is a guest and the method used to shut it down
+	ShutdownResponse struct {
+		Guest  *client.Guest `json:"guest"`
+		Method string        `json:"method"`
+	}
+
+	// ServerConfig is how RunServer serves the API. Only Port is required.
+	ServerConfig struct {
+		// Listen address, all addresses if empty
+		Address string
+		Port    uint
+		// HTTP request read and response write timeouts, none if 0
+		ReadTimeout  time.Duration
+		WriteTimeout time.Duration
+		// HTTPS is served if set
+		TLS *TLSConfig
+		// Calls are authorized by the policy if set, all allowed otherwise
+		Policy *Policy
+		// Mutating calls are recorded in the audit log if set
+		Audit *AuditLog
+	}
+
+	// ListGuestsRequest filters the domains returned by ListGuests. Active and
+	// Inactive match either state, so setting both or neither returns all
+	// domains. Persistent and Autostart must also match when set.
+	ListGuestsRequest struct {
+		Active     bool `json:"active,omitempty"`
+		Inactive   bool `json:"inactive,omitempty"`
+		Persistent bool `json:"persistent,omitempty"`
+		Autostart  bool `json:"autostart,omitempty"`
+	}
+
+	// ListGuestsResponse is the domains found by ListGuests
+	ListGuestsResponse struct {
+		Guests []*VirDomain `json:"guests"`
+	}
+
+	// Connection is a pooled backend connection
 	Connection struct {
-		*libvirt.VirConnection
+		BackendConnection
 		lv *Libvirt
 	}
 
 	// Libvirt is the main struct for interacting with libvirt
 	Libvirt struct {
-		uri         string
-		connections chan *Connection
-		max         int
-		zpool       string
+		uri             string
+		backend         Backend
+		connections     chan *Connection
+		max             int
+		zpool           string
+		zfsCommand      string
+		shutdownTimeout time.Duration
+		detachTimeout   time.Duration
+		locks           *GuestLocks
+		lockTimeout     time.Duration
+		jobs            *jobTable
+		idempotency     *idempotencyCache
 	}
 
 	// Domain is a libvirt domain with running state
@@ -65,19 +145,39 @@ type (
 		Bus    string `xml:"bus,attr" json:"bus"`
 	}
 
+	// DiskFormat http://libvirt.org/formatdomain.html#elementsDisks
+	DiskFormat struct {
+		Type string `xml:"type,attr" json:"type"`
+	}
+
+	// DiskBackingStore http://libvirt.org/formatdomain.html#elementsDisks
+	DiskBackingStore struct {
+		Type         string            `xml:"type,attr,omitempty" json:"type,omitempty"`
+		Format       *DiskFormat       `xml:"format" json:"format,omitempty"`
+		Source       *DiskSource       `xml:"source" json:"source,omitempty"`
+		BackingStore *DiskBackingStore `xml:"backingStore" json:"backing_store,omitempty"`
+	}
+
+	// DiskReadOnly http://libvirt.org/formatdomain.html#elementsDisks
+	DiskReadOnly struct{}
+
 	// Disk http://libvirt.org/formatdomain.html#elementsDisks
 	Disk struct {
-		Type   string     `xml:"type,attr"  json:"type"`
-		Device string     `xml:"device,attr" json:"device"`
-		Driver DiskDriver `xml:"driver"  json:"driver"`
-		Source DiskSource `xml:"source" json:"source"`
-		Target DiskTarget `xml:"target" json:"target"`
+		XMLName      xml.Name          `xml:"disk" json:"-"`
+		Type         string            `xml:"type,attr"  json:"type"`
+		Device       string            `xml:"device,attr" json:"device"`
+		Driver       DiskDriver        `xml:"driver"  json:"driver"`
+		Source       DiskSource        `xml:"source" json:"source"`
+		BackingStore *DiskBackingStore `xml:"backingStore" json:"backing_store,omitempty"`
+		Target       DiskTarget        `xml:"target" json:"target"`
+		ReadOnly     *DiskReadOnly     `xml:"readonly" json:"readonly,omitempty"`
 	}
 
 	// InterfaceSource  http://libvirt.org/formatdomain.html#elementsNICS
 	InterfaceSource struct {
-		Network string `xml:"network,omitempty,attr" json:"network,omitempty"`
-		Bridge  string `xml:"bridge,omitempty,attr" json:"bridge,omitempty"`
+		Network   string `xml:"network,omitempty,attr" json:"network,omitempty"`
+		Bridge    string `xml:"bridge,omitempty,attr" json:"bridge,omitempty"`
+		Portgroup string `xml:"portgroup,omitempty,attr" json:"portgroup,omitempty"`
 	}
 
 	// InterfaceMac http://libvirt.org/formatdomain.html#elementsNICS
@@ -97,6 +197,12 @@ type (
 		Device string `xml:"dev,omitempty,attr" json:"device"`
 	}
 
+	// InterfaceGuest http://libvirt.org/formatdomain.html#elementsNICS
+	InterfaceGuest struct {
+		// Network device name inside the guest
+		Device string `xml:"dev,omitempty,attr" json:"device,omitempty"`
+	}
+
 	// InterfaceAlias http://libvirt.org/formatdomain.html#elementsNICS
 	InterfaceAlias struct {
 		Name string `xml:"name,omitempty,attr" json:"name"`
@@ -122,14 +228,24 @@ type (
 		Model     InterfaceModel  `xml:"model,omitempty" json:"model,omitempty"`
 		FilterRef FilterRef       `xml:"filterref,omitempty" json:"filterref,omitempty"`
 		Target    InterfaceTarget `xml:"target,omitempty" json:"target,omitempty"`
+		Guest     InterfaceGuest  `xml:"guest,omitempty" json:"guest,omitempty"`
 		Alias     InterfaceAlias  `xml:"alias,omitempty" json:"alias,omitempty"`
 	}
 
+	// Controller http://libvirt.org/formatdomain.html#elementsControllers
+	Controller struct {
+		XMLName xml.Name `xml:"controller" json:"-"`
+		Type    string   `xml:"type,attr" json:"type"`
+		Index   int      `xml:"index,attr" json:"index"`
+		Model   string   `xml:"model,attr,omitempty" json:"model,omitempty"`
+	}
+
 	// Device http://libvirt.org/formatdomain.html#elementsDevices
 	Device struct {
-		Disks      []Disk      `xml:"disk,omitempty" json:"disks,omitempty"`
-		Interfaces []Interface `xml:"interface,omitempty" json:"interfaces,omitempty"`
-		Graphics   Graphics    `xml:"graphics" json:"graphics"`
+		Disks       []Disk       `xml:"disk,omitempty" json:"disks,omitempty"`
+		Controllers []Controller `xml:"controller,omitempty" json:"controllers,omitempty"`
+		Interfaces  []Interface  `xml:"interface,omitempty" json:"interfaces,omitempty"`
+		Graphics    Graphics     `xml:"graphics" json:"graphics"`
 	}
 
 	// OsType http://libvirt.org/formatdomain.html#elementsOS
@@ -158,34 +274,77 @@ type (
 
 	// MetadataDisk is metadata about a disk
 	MetadataDisk struct {
-		XMLName xml.Name `xml:"http://mistify.io/xml/device/1 disk"`
-		Device  string   `xml:"device,attr"`
-		Image   string   `xml:"image,attr"`
-		Volume  string   `xml:"volume,attr"`
+		XMLName xml.Name `xml:"http://mistify.io/xml/device/1 disk" json:"-"`
+		Device  string   `xml:"device,attr" json:"device"`
+		Image   string   `xml:"image,attr,omitempty" json:"image,omitempty"`
+		Volume  string   `xml:"volume,attr,omitempty" json:"volume,omitempty"`
 	}
 
 	// MetadataDevice is metadata about disks
 	MetadataDevice struct {
-		XMLName xml.Name       `xml:"http://mistify.io/xml/device/1 device"`
-		Disks   []MetadataDisk `xml:"http://mistify.io/xml/device/1 disk"`
+		XMLName xml.Name       `xml:"http://mistify.io/xml/device/1 device" json:"-"`
+		Disks   []MetadataDisk `xml:"http://mistify.io/xml/device/1 disk" json:"disks,omitempty"`
 	}
 
 	// UserMetadataParameter is an item of metadata about a user
 	UserMetadataParameter struct {
-		Name  string `xml:"name,attr"`
-		Value string `xml:"value,attr"`
+		Name  string `xml:"name,attr" json:"name"`
+		Value string `xml:"value,attr" json:"value"`
 	}
 
 	// UserMetadata is metadata about a use
 	UserMetadata struct {
-		XMLName    xml.Name                `xml:"http://mistify.io/xml/user_metadata/1 user_metadata"`
-		Parameters []UserMetadataParameter `xml:"http://mistify.io/xml/user_metadata/1 parameter"`
+		XMLName    xml.Name                `xml:"http://mistify.io/xml/user_metadata/1 user_metadata" json:"-"`
+		Parameters []UserMetadataParameter `xml:"http://mistify.io/xml/user_metadata/1 parameter" json:"parameters,omitempty"`
 	}
 
 	// Metadata holds all metadata
 	Metadata struct {
-		Device       MetadataDevice `xml:"http://mistify.io/xml/device/1 device"`
-		UserMetadata UserMetadata   `xml:"http://mistify.io/xml/user_metadata/1 user_metadata"`
+		Device       MetadataDevice    `xml:"http://mistify.io/xml/device/1 device" json:"device"`
+		UserMetadata UserMetadata      `xml:"http://mistify.io/xml/user_metadata/1 user_metadata" json:"user_metadata"`
+		Snapshots    MetadataSnapshots `xml:"http://mistify.io/xml/snapshot/1 snapshots" json:"-"`
+	}
+
+	// NetworkBridge http://libvirt.org/formatnetwork.html#elementsConnect
+	NetworkBridge struct {
+		Name string `xml:"name,attr" json:"name"`
+	}
+
+	// NetworkForward http://libvirt.org/formatnetwork.html#elementsConnect
+	NetworkForward struct {
+		Mode string `xml:"mode,attr,omitempty" json:"mode,omitempty"`
+	}
+
+	// NetworkVLANTag http://libvirt.org/formatnetwork.html#elementVlanTag
+	NetworkVLANTag struct {
+		ID int `xml:"id,attr" json:"id"`
+	}
+
+	// NetworkVLAN http://libvirt.org/formatnetwork.html#elementVlanTag
+	NetworkVLAN struct {
+		Tags []NetworkVLANTag `xml:"tag" json:"tags"`
+	}
+
+	// NetworkPortgroup http://libvirt.org/formatnetwork.html#elementsPortgroup
+	NetworkPortgroup struct {
+		Name string       `xml:"name,attr" json:"name"`
+		VLAN *NetworkVLAN `xml:"vlan,omitempty" json:"vlan,omitempty"`
+	}
+
+	// NetworkVirtualPort http://libvirt.org/formatnetwork.html#elementsConnect
+	NetworkVirtualPort struct {
+		Type string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	}
+
+	// VirNetwork http://libvirt.org/formatnetwork.html
+	VirNetwork struct {
+		XMLName     struct{}           `xml:"network" json:"-"`
+		Name        string             `xml:"name" json:"name"`
+		UUID        string             `xml:"uuid,omitempty" json:"uuid,omitempty"`
+		Forward     NetworkForward     `xml:"forward" json:"forward"`
+		Bridge      NetworkBridge      `xml:"bridge" json:"bridge"`
+		VirtualPort NetworkVirtualPort `xml:"virtualport" json:"virtualport"`
+		Portgroups  []NetworkPortgroup `xml:"portgroup" json:"portgroups,omitempty"`
 	}
 
 	// VirDomain http://libvirt.org/formatdomain.html#elementsMetadata
@@ -193,24 +352,39 @@ type (
 		*libvirt.VirDomain `xml:"-" json:"-"`
 		XMLName            struct{} `xml:"domain" json:"-"`
 		Type               string   `xml:"type,attr" json:"type"`
-		UUID               string   `xml:"uuid" json:"uuid"`
+		UUID               string   `xml:"uuid,omitempty" json:"uuid"`
 		Name               string   `xml:"name" json:"name"`
-		Memory             int      `xml:"memory" json:"memory"`
+		Memory             int      `xml:"memory" json:"memory"` // KiB
 		VCPU               int      `xml:"vcpu" json:"vcpu"`
 		Devices            Device   `xml:"devices,omitempty" json:"devices"`
 		Os                 Os       `xml:"os,omitempty" json:"os,omitempty"`
 		State              string   `xml:"-" json:"state"`
-		Metadata           Metadata `xml:"metadata"`
+		Metadata           Metadata `xml:"metadata" json:"metadata"`
 	}
 )
 
-// NewLibvirt creates a new Libvirt object and initializes the connection pool
+// NewLibvirt creates a new Libvirt object using libvirtd and initializes the
+// connection pool
 func NewLibvirt(uri string, zpool string, max int) (*Libvirt, error) {
+	return NewLibvirtWithBackend(&LibvirtBackend{}, uri, zpool, max)
+}
+
+// NewLibvirtWithBackend creates a new Libvirt object using a specific backend
+// and initializes the connection pool
+func NewLibvirtWithBackend(backend Backend, uri string, zpool string, max int) (*Libvirt, error) {
 	lv := &Libvirt{
-		uri:         uri,
-		max:         max,
-		connections: make(chan *Connection, max),
-		zpool:       zpool,
+		uri:             uri,
+		backend:         backend,
+		max:             max,
+		connections:     make(chan *Connection, max),
+		zpool:           zpool,
+		zfsCommand:      DefaultZFSCommand,
+		shutdownTimeout: DefaultShutdownTimeout,
+		detachTimeout:   DefaultDetachTimeout,
+		locks:           NewGuestLocks(),
+		lockTimeout:     DefaultLockTimeout,
+		jobs:            newJobTable(),
+		idempotency:     newIdempotencyCache(),
 	}
 
 	for i := 0; i < max; i++ {
@@ -222,6 +396,18 @@ func NewLibvirt(uri string, zpool string, max int) (*Libvirt, error) {
 	return lv, nil
 }
 
+// SetShutdownTimeout sets how long GracefulShutdown waits when the request does
+// not specify a timeout
+func (lv *Libvirt) SetShutdownTimeout(timeout time.Duration) {
+	lv.shutdownTimeout = timeout
+}
+
+// SetDetachTimeout sets how long DetachDisk waits for a running guest to
+// release a disk
+func (lv *Libvirt) SetDetachTimeout(timeout time.Duration) {
+	lv.detachTimeout = timeout
+}
+
 // Release returns a connection to the pool
 func (c *Connection) Release() {
 	c.lv.connections <- c
@@ -229,14 +415,60 @@ func (c *Connection) Release() {
 
 // RunHTTP runs the HTTP server
 func (lv *Libvirt) RunHTTP(port uint) error {
-	server, err := rpc.NewServer(port)
+	return lv.RunServer(&ServerConfig{Port: port})
+}
+
+// RunHTTPS runs the HTTP server over TLS. Plain HTTP is served if config is
+// nil.
+func (lv *Libvirt) RunHTTPS(port uint, config *TLSConfig) error {
+	return lv.RunServer(&ServerConfig{Port: port, TLS: config})
+}
+
+// RunServer runs the HTTP server with the RPC, events and volumes endpoints,
+// async jobs, idempotency keys, and the policy and audit log of the config
+func (lv *Libvirt) RunServer(config *ServerConfig) error {
+	server, err := rpc.NewServer(config.Port)
 	if err != nil {
 		return err
 	}
+	server.HTTPServer.Addr = net.JoinHostPort(config.Address, strconv.FormatUint(uint64(config.Port), 10))
+	server.HTTPServer.ReadTimeout = config.ReadTimeout
+	server.HTTPServer.WriteTimeout = config.WriteTimeout
 
 	if err := server.RegisterService(lv); err != nil {
 		return err
 	}
+
+	events := lv.NewEventMonitor(DefaultEventBufferSize)
+	if err := events.Start(); err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(events.Stop, nil, "failed to stop event monitor")
+	server.Handle(EventsPath, events)
+	server.Handle(VolumesPath, lv.VolumeHandler())
+
+	handler := server.HTTPServer.Handler
+	if config.Audit != nil {
+		// inside the policy handler, which identifies the caller
+		handler = config.Audit.Handler(handler)
+	}
+
+	// async calls are authorized by the policy before they become jobs, and
+	// audited when the job's call finishes. Retried calls are answered from
+	// the idempotency cache before becoming jobs again.
+	handler = lv.IdempotencyHandler(lv.JobHandler(handler))
+
+	if config.Policy != nil {
+		handler = config.Policy.Handler(handler)
+	}
+
+	// only the policy may name the caller that is audited and namespaces
+	// idempotency keys
+	server.HTTPServer.Handler = CallerHandler(handler)
+
+	if config.TLS != nil {
+		return config.TLS.ListenAndServe(server.HTTPServer)
+	}
 	return server.ListenAndServe()
 }
 
@@ -247,7 +479,7 @@ func (lv *Libvirt) getConnection() (*Connection, error) {
 	conn := <-lv.connections
 
 	// Determine whether a new connection is necessary
-	if conn.VirConnection == nil {
+	if conn.BackendConnection == nil {
 		createNewConn = true
 	} else {
 		alive, err := conn.IsAlive()
@@ -258,10 +490,10 @@ func (lv *Libvirt) getConnection() (*Connection, error) {
 
 	// Make a new connection
 	if createNewConn {
-		var virConn libvirt.VirConnection
-		virConn, err = libvirt.NewVirConnection(lv.uri)
+		var backendConn BackendConnection
+		backendConn, err = lv.backend.Connect(lv.uri)
 		if err == nil {
-			conn.VirConnection = &virConn
+			conn.BackendConnection = backendConn
 		}
 	}
 
@@ -273,72 +505,134 @@ func (lv *Libvirt) getConnection() (*Connection, error) {
 	return conn, nil
 }
 
+// TransientConnection opens a connection to a libvirt uri outside of the
+// connection pool, such as a migration destination. The caller is responsible
+// for closing it.
+func (lv *Libvirt) TransientConnection(uri string) (BackendConnection, error) {
+	return lv.backend.Connect(uri)
+}
+
 // LookupDomainByName retrieves a libvirt domain based on a name string
-func (lv *Libvirt) LookupDomainByName(name string) (*libvirt.VirDomain, error) {
+func (lv *Libvirt) LookupDomainByName(name string) (BackendDomain, error) {
 	conn, err := lv.getConnection()
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Release()
 
-	domain, err := conn.LookupDomainByName(name)
+	return conn.LookupDomainByName(name)
+}
+
+// LookupNetworkByName retrieves a libvirt domain based on a name string
+func (lv *Libvirt) LookupNetworkByName(name string) (BackendNetwork, error) {
+	conn, err := lv.getConnection()
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Release()
 
-	return &domain, err
+	return conn.LookupNetworkByName(name)
 }
 
-// LookupNetworkByName retrieves a libvirt domain based on a name string
-func (lv *Libvirt) LookupNetworkByName(name string) (*libvirt.VirNetwork, error) {
+// NewDomain creates a new libvirt domain from a guest
+func (lv *Libvirt) NewDomain(guest *client.Guest) (BackendDomain, error) {
 	conn, err := lv.getConnection()
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Release()
 
-	network, err := conn.LookupNetworkByName(name)
+	xml, err := lv.DomainXML(guest)
 	if err != nil {
 		return nil, err
 	}
 
-	return &network, err
+	return conn.DomainDefineXML(xml)
 }
 
-// NewDomain creates a new libvirt domain from a guest
-func (lv *Libvirt) NewDomain(guest *client.Guest) (*libvirt.VirDomain, error) {
-	conn, err := lv.getConnection()
+// GetState looks up the running state of a libvirt domain
+func GetState(domain BackendDomain) (int, error) {
+	state, err := domain.GetState()
 	if err != nil {
-		return nil, err
+		return libvirt.VIR_DOMAIN_NOSTATE, err
 	}
-	defer conn.Release()
 
-	xml, err := lv.DomainXML(guest)
+	return state[0], nil
+}
+
+// ParseDomain retrieves and parses the xml description of a libvirt domain
+func ParseDomain(domain BackendDomain) (*VirDomain, error) {
+	xmldesc, err := domain.GetXMLDesc(0)
 	if err != nil {
 		return nil, err
 	}
 
-	domain, err := conn.DomainDefineXML(xml)
-	if err != nil {
+	v := &VirDomain{}
+	if err = xml.Unmarshal([]byte(xmldesc), v); err != nil {
 		return nil, err
 	}
 
-	return &domain, err
+	return v, nil
 }
 
-// GetState looks up the running state of a libvirt domain
-func GetState(domain *libvirt.VirDomain) (int, error) {
-	state, err := domain.GetState()
+// waitForState polls a libvirt domain until it reaches the desired state or
+// the timeout expires, returning the last seen state
+func waitForState(domain BackendDomain, desired int, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := GetState(domain)
+		if err != nil || state == desired || time.Now().After(deadline) {
+			return state, err
+		}
+		time.Sleep(statePollInterval)
+	}
+}
+
+// ParseNetwork retrieves and parses the xml description of a libvirt network
+func ParseNetwork(network BackendNetwork) (*VirNetwork, error) {
+	xmldesc, err := network.GetXMLDesc(0)
 	if err != nil {
-		return libvirt.VIR_DOMAIN_NOSTATE, err
+		return nil, err
 	}
 
-	return state[0], nil
+	v := &VirNetwork{}
+	if err = xml.Unmarshal([]byte(xmldesc), v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// ApplyMetadata copies the mistify metadata stored in a domain into a guest.
+// User metadata replaces the guest's metadata and disk image and volume
+// information is filled in for disks that do not specify it.
+func (v *VirDomain) ApplyMetadata(guest *client.Guest) {
+	if params := v.Metadata.UserMetadata.Parameters; len(params) > 0 {
+		guest.Metadata = make(map[string]string, len(params))
+		for _, p := range params {
+			guest.Metadata[p.Name] = p.Value
+		}
+	}
+
+	for _, m := range v.Metadata.Device.Disks {
+		for i := range guest.Disks {
+			disk := &guest.Disks[i]
+			if disk.Device != m.Device {
+				continue
+			}
+			if disk.Image == "" {
+				disk.Image = m.Image
+			}
+			if disk.Volume == "" {
+				disk.Volume = m.Volume
+			}
+		}
+	}
 }
 
 // DomainWrapper looks up a libvirt domain and state for a request guest, runs a
 // function on it, and updates the guest for the response
-func (lv *Libvirt) DomainWrapper(fn func(*libvirt.VirDomain, int) error) func(*http.Request, *rpc.GuestRequest, *rpc.GuestResponse) error {
+func (lv *Libvirt) DomainWrapper(fn func(BackendDomain, int) error) func(*http.Request, *rpc.GuestRequest, *rpc.GuestResponse) error {
 	return func(r *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
 		if request.Guest == nil || request.Guest.ID == "" {
 			return syscall.EINVAL
@@ -385,21 +679,42 @@ func (lv *Libvirt) Restart(http *http.Request, request *rpc.GuestRequest, respon
 // Poweroff destroys a libvirt domain for a guest. Effectively pulls the (virtual) power cord.
 // https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainDestroy
 func (lv *Libvirt) Poweroff(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
 	log.WithFields(log.Fields{
 		"guest": request.Guest.ID,
 	}).Info("Libvirt.Poweroff")
 
-	return lv.DomainWrapper(func(domain *libvirt.VirDomain, state int) error {
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.DomainWrapper(func(domain BackendDomain, state int) error {
 		return domain.Destroy()
 	})(http, request, response)
 }
 
-// Delete completely removes a libvirt domain for a guest
+// Delete completely removes a libvirt domain for a guest, along with its
+// snapshot metadata and the disk volumes created for it
 func (lv *Libvirt) Delete(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
 	log.WithFields(log.Fields{
 		"guest": request.Guest.ID,
 	}).Info("Libvirt.Delete")
 
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	domain, err := lv.LookupDomainByName(request.Guest.ID)
 	if err != nil {
 		return err
@@ -411,6 +726,11 @@ func (lv *Libvirt) Delete(http *http.Request, request *rpc.GuestRequest, respons
 		return err
 	}
 
+	v, err := ParseDomain(domain)
+	if err != nil {
+		return err
+	}
+
 	if state == libvirt.VIR_DOMAIN_RUNNING || state == libvirt.VIR_DOMAIN_PAUSED {
 		err = domain.Destroy()
 		if err != nil {
@@ -418,7 +738,14 @@ func (lv *Libvirt) Delete(http *http.Request, request *rpc.GuestRequest, respons
 		}
 	}
 
-	err = domain.Undefine()
+	// volumes go before the domain, so a failed Delete can be retried until
+	// none are left behind
+	if err = lv.destroyVolumes(lv.createdVolumes(request.Guest.ID, v)); err != nil {
+		return err
+	}
+
+	// snapshots would keep the domain from being undefined
+	err = domain.UndefineFlags(libvirt.VIR_DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
 	if err != nil {
 		return err
 	}
@@ -450,10 +777,26 @@ func (lv *Libvirt) Delete(http *http.Request, request *rpc.GuestRequest, respons
 
 // Create creates a new libvirt domain for a guest
 func (lv *Libvirt) Create(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
 	log.WithFields(log.Fields{
 		"guest": request.Guest.ID,
 	}).Info("Libvirt.Create")
 
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	unlockVolumes, err := lv.lockVolumes(diskPaths(request.Guest.Disks)...)
+	if err != nil {
+		return err
+	}
+	defer unlockVolumes()
+
 	domain, err := lv.NewDomain(request.Guest)
 	if err != nil {
 		return err
@@ -481,19 +824,23 @@ func (lv *Libvirt) Create(http *http.Request, request *rpc.GuestRequest, respons
 
 // Run creates or resumes a libvirt domain for a guest
 func (lv *Libvirt) Run(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
 	log.WithFields(log.Fields{
 		"guest": request.Guest.ID,
 	}).Info("Libvirt.Run")
 
-	return lv.DomainWrapper(func(domain *libvirt.VirDomain, state int) error {
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-		xmldesc, err := domain.GetXMLDesc(0)
-		if err != nil {
-			return err
-		}
+	return lv.DomainWrapper(func(domain BackendDomain, state int) error {
 
-		v := VirDomain{}
-		err = xml.Unmarshal([]byte(xmldesc), &v)
+		v, err := ParseDomain(domain)
 		if err != nil {
 			return err
 		}
@@ -522,11 +869,21 @@ func (lv *Libvirt) Run(http *http.Request, request *rpc.GuestRequest, response *
 
 // Reboot reboots a libvirt domain for a guest
 func (lv *Libvirt) Reboot(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
 	log.WithFields(log.Fields{
 		"guest": request.Guest.ID,
 	}).Info("Libvirt.Reboot")
 
-	return lv.DomainWrapper(func(domain *libvirt.VirDomain, state int) error {
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.DomainWrapper(func(domain BackendDomain, state int) error {
 		return domain.Reboot(0)
 	})(http, request, response)
 }
@@ -534,11 +891,21 @@ func (lv *Libvirt) Reboot(http *http.Request, request *rpc.GuestRequest, respons
 // Shutdown requests a libvirt domain for a guest to cleanly shutdown.
 // https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainShutdown
 func (lv *Libvirt) Shutdown(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
 	log.WithFields(log.Fields{
 		"guest": request.Guest.ID,
 	}).Info("Libvirt.Shutdown")
 
-	return lv.DomainWrapper(func(domain *libvirt.VirDomain, state int) error {
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.DomainWrapper(func(domain BackendDomain, state int) error {
 
 		switch state {
 		case libvirt.VIR_DOMAIN_SHUTDOWN, libvirt.VIR_DOMAIN_SHUTOFF:
@@ -552,18 +919,240 @@ func (lv *Libvirt) Shutdown(http *http.Request, request *rpc.GuestRequest, respo
 	})(http, request, response)
 }
 
+// Pause suspends a libvirt domain for a guest. The domain keeps its memory but
+// is no longer scheduled.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainSuspend
+func (lv *Libvirt) Pause(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest": request.Guest.ID,
+	}).Info("Libvirt.Pause")
+
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.DomainWrapper(func(domain BackendDomain, state int) error {
+
+		switch state {
+		case libvirt.VIR_DOMAIN_PAUSED:
+			// nothing to do
+
+		default:
+			return domain.Suspend()
+		}
+
+		return nil
+	})(http, request, response)
+}
+
+// Resume resumes a paused libvirt domain for a guest.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainResume
+func (lv *Libvirt) Resume(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest": request.Guest.ID,
+	}).Info("Libvirt.Resume")
+
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.DomainWrapper(func(domain BackendDomain, state int) error {
+
+		switch state {
+		case libvirt.VIR_DOMAIN_PAUSED, libvirt.VIR_DOMAIN_PMSUSPENDED:
+			return domain.Resume()
+
+		default:
+			// nothing to do
+		}
+
+		return nil
+	})(http, request, response)
+}
+
+// GracefulShutdown requests a libvirt domain for a guest to cleanly shutdown
+// and waits for it to reach shutoff. If the shutdown request fails, e.g. for
+// a guest without ACPI, or the guest does not shut down within the timeout, it
+// is powered off with Force. Otherwise the error or ErrShutdownTimeout is
+// returned.
+func (lv *Libvirt) GracefulShutdown(http *http.Request, request *ShutdownRequest, response *ShutdownResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest":   request.Guest.ID,
+		"timeout": request.Timeout,
+		"force":   request.Force,
+	}).Info("Libvirt.GracefulShutdown")
+
+	unlock, err := lv.lockGuest(http, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	domain, err := lv.LookupDomainByName(request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": request.Guest.ID}, "failed to free domain")
+
+	state, err := GetState(domain)
+	if err != nil {
+		return err
+	}
+
+	method := ShutdownMethodNone
+	if state != libvirt.VIR_DOMAIN_SHUTOFF {
+		method = ShutdownMethodShutdown
+		if err = domain.Shutdown(); err != nil {
+			if !request.Force {
+				return err
+			}
+
+			log.WithFields(log.Fields{
+				"guest": request.Guest.ID,
+				"error": err,
+			}).Warn("guest can't be shut down, powering off")
+		} else {
+			timeout := lv.shutdownTimeout
+			if request.Timeout > 0 {
+				timeout = time.Duration(request.Timeout) * time.Second
+			}
+
+			state, err = waitForState(domain, libvirt.VIR_DOMAIN_SHUTOFF, timeout)
+			if err != nil {
+				return err
+			}
+
+			if state != libvirt.VIR_DOMAIN_SHUTOFF {
+				if !request.Force {
+					return ErrShutdownTimeout
+				}
+
+				log.WithFields(log.Fields{
+					"guest": request.Guest.ID,
+				}).Warn("guest did not shut down in time, powering off")
+			}
+		}
+
+		if state != libvirt.VIR_DOMAIN_SHUTOFF {
+			method = ShutdownMethodPoweroff
+			if err = domain.Destroy(); err != nil {
+				return err
+			}
+
+			state, err = GetState(domain)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	*response = ShutdownResponse{
+		Guest:  request.Guest,
+		Method: method,
+	}
+	response.Guest.State = StateNames[state]
+
+	return nil
+}
+
 // Status looks up the running status of a libvirt domain for a guest
 func (lv *Libvirt) Status(http *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
 	log.WithFields(log.Fields{
 		"guest": request.Guest.ID,
 	}).Info("Libvirt.Status")
 
-	return lv.DomainWrapper(func(domain *libvirt.VirDomain, state int) error {
-		// DomainWrapper gets the state already, no need to do anything here
+	return lv.DomainWrapper(func(domain BackendDomain, state int) error {
+		// DomainWrapper gets the state already, only metadata is needed here
+		v, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		v.ApplyMetadata(request.Guest)
 		return nil
 	})(http, request, response)
 }
 
+// ListGuests looks up all libvirt domains on the host matching the request's
+// filters. With no filters set, all domains are returned.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virConnectListAllDomains
+func (lv *Libvirt) ListGuests(r *http.Request, request *ListGuestsRequest, response *ListGuestsResponse) error {
+	log.WithFields(log.Fields{
+		"active":     request.Active,
+		"inactive":   request.Inactive,
+		"persistent": request.Persistent,
+		"autostart":  request.Autostart,
+	}).Info("Libvirt.ListGuests")
+
+	conn, err := lv.getConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var flags uint32
+	if request.Active {
+		flags |= libvirt.VIR_CONNECT_LIST_DOMAINS_ACTIVE
+	}
+	if request.Inactive {
+		flags |= libvirt.VIR_CONNECT_LIST_DOMAINS_INACTIVE
+	}
+	if request.Persistent {
+		flags |= libvirt.VIR_CONNECT_LIST_DOMAINS_PERSISTENT
+	}
+	if request.Autostart {
+		flags |= libvirt.VIR_CONNECT_LIST_DOMAINS_AUTOSTART
+	}
+
+	domains, err := conn.ListAllDomains(flags)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range domains {
+			logx.LogReturnedErr(domains[i].Free, nil, "failed to free domain")
+		}
+	}()
+
+	guests := make([]*VirDomain, 0, len(domains))
+	for _, domain := range domains {
+		v, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		state, err := GetState(domain)
+		if err != nil {
+			return err
+		}
+		v.State = StateNames[state]
+
+		guests = append(guests, v)
+	}
+
+	*response = ListGuestsResponse{
+		Guests: guests,
+	}
+
+	return nil
+}
+
 // CPUMetrics looks up the cpu metrics for a libvirt domain for a guest
 func (lv *Libvirt) CPUMetrics(r *http.Request, request *rpc.GuestMetricsRequest, response *rpc.GuestMetricsResponse) error {
 
@@ -705,8 +1294,24 @@ func (lv *Libvirt) NicMetrics(r *http.Request, request *rpc.GuestMetricsRequest,
 	return nil
 }
 
-// CreateGuest creates disks and defines a new domain and network for a guest
+// CreateGuest creates disks and defines a new domain and network for a guest.
+// Disks are on the virtio bus unless they request scsi, sata or ide, and are
+// given the first free target devices on their buses unless they request one.
+// Disks without a source get a zvol of their size under the zpool, cloned
+// from their image snapshot if they have one, unless their image is a path to
+// attach read-only. If any step fails, everything created so far is removed
+// and a *StepError describing the failed step is returned.
 func (lv *Libvirt) CreateGuest(r *http.Request, request *rpc.GuestRequest, response *rpc.GuestResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
+	unlock, err := lv.lockGuest(r, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	conn, err := lv.getConnection()
 	if err != nil {
 		return err
@@ -719,43 +1324,68 @@ func (lv *Libvirt) CreateGuest(r *http.Request, request *rpc.GuestRequest, respo
 		guest.Type = "kvm"
 	}
 
-	dev := 'a'
+	if err := assignDiskTargets(guest.Disks); err != nil {
+		return err
+	}
+	for i := range guest.Disks {
+		disk := &guest.Disks[i]
+		if err := checkDiskSource(disk); err != nil {
+			return err
+		}
+		if err := lv.checkDiskVolume(disk); err != nil {
+			return err
+		}
+	}
+
+	unlockVolumes, err := lv.lockVolumes(diskPaths(guest.Disks)...)
+	if err != nil {
+		return err
+	}
+	defer unlockVolumes()
+
+	rb := newRollback("CreateGuest")
+
 	for i := range guest.Disks {
 		disk := &guest.Disks[i]
-		// TODO: do we want to support non-virtio??
-		disk.Bus = "virtio"
-		disk.Device = fmt.Sprintf("vd%c", dev)
-		dev++
+		if !needsVolume(disk) {
+			continue
+		}
+
+		if err := lv.createDiskVolume(rb, guest, disk); err != nil {
+			return err
+		}
 	}
 
 	for _, nic := range guest.Nics {
 		n, err := lv.NetworkXML(nic)
 		if err != nil {
-			return err
+			return rb.fail("generate network "+nic.Mac, err)
 		}
 
 		network, err := conn.NetworkDefineXML(n)
 		if err != nil {
-			return err
+			return rb.fail("define network "+nic.Mac, err)
 		}
 		defer logx.LogReturnedErr(network.Free, log.Fields{"networkXML": n}, "failed to free network")
+		rb.add("define network "+nic.Mac, network.Undefine)
 
 		if err = network.SetAutostart(true); err != nil {
-			return err
+			return rb.fail("autostart network "+nic.Mac, err)
 		}
 		if err = network.Create(); err != nil {
-			return err
+			return rb.fail("start network "+nic.Mac, err)
 		}
+		rb.add("start network "+nic.Mac, network.Destroy)
 	}
 
 	x, err := lv.DomainXML(guest)
 	if err != nil {
-		return err
+		return rb.fail("generate domain", err)
 	}
 
 	domain, err := conn.DomainDefineXML(x)
 	if err != nil {
-		return err
+		return rb.fail("define domain", err)
 	}
 	defer logx.LogReturnedErr(domain.Free, log.Fields{"domainXML": x}, "failed to free domain")
 
@@ -763,5 +1393,5 @@ func (lv *Libvirt) CreateGuest(r *http.Request, request *rpc.GuestRequest, respo
 		Guest: guest,
 	}
 
-	return err
+	return nil
 }
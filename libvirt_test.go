@@ -1,12 +1,13 @@
 package libvirt_test
 
 import (
-	"compress/bzip2"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -18,46 +19,66 @@ import (
 	"github.com/pborman/uuid"
 )
 
+// testImageSize is the size in bytes of the generated sparse disk images
+const testImageSize = 64 * 1024 * 1024
+
 type TestClient struct {
 	rpc      *rpc.Client
+	dir      string
 	guest    *client.Guest
 	request  *rpc.GuestRequest
 	response *rpc.GuestResponse
 	metrics  *rpc.GuestMetricsResponse
 }
 
-func setup(t *testing.T, url string, port uint) *TestClient {
-	filename := os.Getenv("GUEST_IMAGE")
-	if filename == "" {
-		filename = "/tmp/libvirt-test.img"
-	}
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		f, err := os.Create(filename)
-		if err != nil {
-			t.Fatalf("can't create image temp file: %s\n", err.Error())
-		}
-		defer logx.LogReturnedErr(f.Close, nil, "failed to close image file")
+// testURI is the libvirt uri the suite runs against. It defaults to the libvirt
+// test driver and may be pointed at a custom test driver xml file with
+// LIBVIRT_TEST_URI=test:///path/to/driver.xml.
+func testURI() string {
+	if uri := os.Getenv("LIBVIRT_TEST_URI"); uri != "" {
+		return uri
+	}
+	return "test:///default"
+}
 
-		// Test image from http://wiki.qemu.org/Testing
-		resp, err := http.Get("https://s3.amazonaws.com/omniti-mystify-artifacts/qemu-images/linux-0.2.img.bz2")
-		if err != nil {
-			t.Fatalf("can't download image file: %s\n", err.Error())
-		}
-		defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close resp body")
+// sparseImage creates a sparse disk image so tests never download one
+func sparseImage(t *testing.T, dir string, name string) string {
+	filename := filepath.Join(dir, name)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("can't create image file: %s\n", err.Error())
+	}
+	defer logx.LogReturnedErr(f.Close, nil, "failed to close image file")
 
-		unzipImg := bzip2.NewReader(resp.Body)
-		_, err = io.Copy(f, unzipImg)
+	if err := f.Truncate(testImageSize); err != nil {
+		t.Fatalf("can't size image file: %s\n", err.Error())
 	}
 
+	return filename
+}
+
+func setup(t *testing.T, url string, port uint) *TestClient {
 	lv, err := libvirt.NewLibvirt(url, "mistify", 1)
 	if err != nil {
 		t.Fatalf("NewLibvirt failed: %s\n", err.Error())
 	}
 
+	return serve(t, lv, port)
+}
+
+// serve runs the RPC server for lv and creates a client and guest for it
+func serve(t *testing.T, lv *libvirt.Libvirt, port uint) *TestClient {
+	dir, err := ioutil.TempDir("", "libvirt-test")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s\n", err.Error())
+	}
+
 	go logx.LogReturnedErr(func() error { return lv.RunHTTP(port) }, nil, "failed to run server")
 	time.Sleep(1 * time.Second)
 
 	cli := new(TestClient)
+	cli.dir = dir
 
 	cli.rpc, err = rpc.NewClient(port, "")
 	if err != nil {
@@ -66,14 +87,15 @@ func setup(t *testing.T, url string, port uint) *TestClient {
 
 	cli.guest = new(client.Guest)
 	cli.guest.ID = uuid.New()
+	cli.guest.Type = "test"
 	cli.guest.Memory = 1024
 	cli.guest.CPU = 1
 
 	disk := client.Disk{
 		Bus:    "sata",
-		Device: "hda",
-		Size:   1024,
-		Source: filename,
+		Device: "sda",
+		Size:   testImageSize / 1024 / 1024,
+		Source: sparseImage(t, dir, cli.guest.ID+".img"),
 	}
 	cli.guest.Disks = append(cli.guest.Disks, disk)
 
@@ -100,10 +122,15 @@ func setup(t *testing.T, url string, port uint) *TestClient {
 	cli.request.Guest = cli.guest
 
 	cli.response = new(rpc.GuestResponse)
+	cli.metrics = new(rpc.GuestMetricsResponse)
 
 	return cli
 }
 
+func teardown(cli *TestClient) {
+	logx.LogReturnedErr(func() error { return os.RemoveAll(cli.dir) }, log.Fields{"dir": cli.dir}, "failed to remove temp dir")
+}
+
 func do(action string, t *testing.T, cli *TestClient, expectedState string) {
 	err := cli.rpc.Do(action, cli.request, cli.response)
 	if err != nil {
@@ -139,41 +166,270 @@ func metric(action string, t *testing.T, cli *TestClient) {
 		t.Fatalf("Error running %s: %s\n", action, err.Error())
 	}
 
+	guest := cli.request.Guest
+	switch action {
+	case "Libvirt.CPUMetrics":
+		if len(cli.metrics.CPU) != int(guest.CPU) {
+			t.Fatalf("After %s, expected metrics for %d cpus, got %+v\n", action, guest.CPU, cli.metrics.CPU)
+		}
+	case "Libvirt.DiskMetrics":
+		if _, ok := cli.metrics.Disk[guest.Disks[0].Device]; !ok {
+			t.Fatalf("After %s, expected metrics for disk %s, got %+v\n", action, guest.Disks[0].Device, cli.metrics.Disk)
+		}
+	case "Libvirt.NicMetrics":
+		if _, ok := cli.metrics.Nic[guest.Nics[0].Name]; !ok {
+			t.Fatalf("After %s, expected metrics for nic %s, got %+v\n", action, guest.Nics[0].Name, cli.metrics.Nic)
+		}
+	}
+
 	t.Logf("Ran %s\n", action)
 }
 
+func snapshot(action string, t *testing.T, cli *TestClient, name string, expected int) {
+	request := &libvirt.SnapshotRequest{
+		Guest: cli.guest,
+		Name:  name,
+	}
+	response := &libvirt.SnapshotResponse{}
+
+	err := cli.rpc.Do(action, request, response)
+	if err != nil {
+		t.Fatalf("Error running %s: %s\n", action, err.Error())
+	}
+
+	if len(response.Snapshots) != expected {
+		t.Fatalf("After %s, expected %d root snapshots, got %d\n", action, expected, len(response.Snapshots))
+	}
+
+	t.Logf("Ran %s, state is now %s\n", action, response.Guest.State)
+}
+
+func shutdown(t *testing.T, cli *TestClient, expectedMethod string) {
+	request := &libvirt.ShutdownRequest{
+		Guest:   cli.guest,
+		Timeout: 10,
+		Force:   true,
+	}
+	response := &libvirt.ShutdownResponse{}
+
+	err := cli.rpc.Do("Libvirt.GracefulShutdown", request, response)
+	if err != nil {
+		t.Fatalf("Error running Libvirt.GracefulShutdown: %s\n", err.Error())
+	}
+
+	if response.Guest.State != "shutoff" {
+		t.Fatalf("After Libvirt.GracefulShutdown, expected state shutoff, got state %s\n", response.Guest.State)
+	}
+
+	if response.Method != expectedMethod {
+		t.Fatalf("After Libvirt.GracefulShutdown, expected method %s, got method %s\n", expectedMethod, response.Method)
+	}
+
+	t.Logf("Ran Libvirt.GracefulShutdown, method was %s\n", response.Method)
+}
+
+func events(t *testing.T, cli *TestClient, port uint, expectedEvent string) {
+	url := fmt.Sprintf("http://localhost:%d%s?timeout=1", port, libvirt.EventsPath)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error getting events: %s\n", err.Error())
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close resp body")
+
+	var events []libvirt.Event
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatalf("Error decoding events: %s\n", err.Error())
+	}
+
+	for _, e := range events {
+		if e.GuestID == cli.guest.ID && e.Event == expectedEvent {
+			t.Logf("Got event %s, state is %s\n", e.Event, e.State)
+			return
+		}
+	}
+
+	t.Fatalf("Expected event %s for guest %s, got %+v\n", expectedEvent, cli.guest.ID, events)
+}
+
+func list(t *testing.T, cli *TestClient, request *libvirt.ListGuestsRequest, expectedState string) {
+	response := &libvirt.ListGuestsResponse{}
+
+	err := cli.rpc.Do("Libvirt.ListGuests", request, response)
+	if err != nil {
+		t.Fatalf("Error running Libvirt.ListGuests: %s\n", err.Error())
+	}
+
+	for _, guest := range response.Guests {
+		if guest.Name == cli.guest.ID {
+			if guest.State != expectedState {
+				t.Fatalf("After Libvirt.ListGuests, expected state %s, got state %s\n", expectedState, guest.State)
+			}
+			t.Logf("Ran Libvirt.ListGuests, found guest in state %s\n", guest.State)
+			return
+		}
+	}
+
+	if expectedState != "" {
+		t.Fatalf("After Libvirt.ListGuests, guest %s not found\n", cli.guest.ID)
+	}
+}
+
+func reconcile(t *testing.T, cli *TestClient) {
+	request := &libvirt.ReconcileRequest{
+		Guests: []*client.Guest{cli.guest},
+	}
+	response := &libvirt.ReconcileResponse{}
+
+	err := cli.rpc.Do("Libvirt.Reconcile", request, response)
+	if err != nil {
+		t.Fatalf("Error running Libvirt.Reconcile: %s\n", err.Error())
+	}
+
+	for _, name := range response.UnknownDomains {
+		if name == cli.guest.ID {
+			t.Fatalf("After Libvirt.Reconcile, guest %s reported as unknown\n", cli.guest.ID)
+		}
+	}
+
+	if len(response.MissingDomains) != 0 {
+		t.Fatalf("After Libvirt.Reconcile, expected no missing domains, got %v\n", response.MissingDomains)
+	}
+
+	t.Logf("Ran Libvirt.Reconcile, %d unknown domains\n", len(response.UnknownDomains))
+}
+
 func TestDummy(t *testing.T) {
-	cli := setup(t, "test:///default", 9001)
-	cli.guest.Type = "test"
+	cli := setup(t, testURI(), 9001)
+	defer teardown(cli)
+	cli.guest.Metadata = map[string]string{"owner": "mistify & co"}
 
 	do("Libvirt.Create", t, cli, "running")
+
+	cli.request.Guest.Metadata = nil
+	do("Libvirt.Status", t, cli, "running")
+	if owner := cli.response.Guest.Metadata["owner"]; owner != "mistify & co" {
+		t.Fatalf("Expected owner metadata to be persisted, got %q\n", owner)
+	}
+	events(t, cli, 9001, "started")
+	list(t, cli, &libvirt.ListGuestsRequest{}, "running")
+	list(t, cli, &libvirt.ListGuestsRequest{Active: true}, "running")
+	list(t, cli, &libvirt.ListGuestsRequest{Inactive: true}, "")
+	reconcile(t, cli)
+	do("Libvirt.Pause", t, cli, "paused")
+	do("Libvirt.Pause", t, cli, "paused")
+	do("Libvirt.Resume", t, cli, "running")
+	do("Libvirt.Resume", t, cli, "running")
+	snapshot("Libvirt.CreateSnapshot", t, cli, "first", 1)
+	snapshot("Libvirt.CreateSnapshot", t, cli, "second", 1)
+	snapshot("Libvirt.ListSnapshots", t, cli, "", 1)
+	snapshot("Libvirt.RevertSnapshot", t, cli, "first", 1)
+	snapshot("Libvirt.DeleteSnapshot", t, cli, "first", 1)
+	snapshot("Libvirt.DeleteSnapshot", t, cli, "second", 0)
 	do("Libvirt.Shutdown", t, cli, "shutoff")
 	do("Libvirt.Run", t, cli, "running")
 	do("Libvirt.Reboot", t, cli, "running")
+	shutdown(t, cli, libvirt.ShutdownMethodShutdown)
+	shutdown(t, cli, libvirt.ShutdownMethodNone)
 	do("Libvirt.Delete", t, cli, "")
 }
 
-func TestQemu(t *testing.T) {
-	cli := setup(t, "qemu:///system", 9002)
-	cli.guest.Type = "qemu"
+func TestCreateGuestRollback(t *testing.T) {
+	cli := setup(t, testURI(), 9004)
+	defer teardown(cli)
+	cli.guest.Type = "bogus"
+
+	err := cli.rpc.Do("Libvirt.CreateGuest", cli.request, cli.response)
+	if err == nil {
+		t.Fatalf("Expected Libvirt.CreateGuest to fail for type %s\n", cli.guest.Type)
+	}
+	t.Logf("Libvirt.CreateGuest failed as expected: %s\n", err.Error())
+
+	request := &libvirt.ReconcileRequest{
+		Guests: []*client.Guest{cli.guest},
+	}
+	response := &libvirt.ReconcileResponse{}
+	if err := cli.rpc.Do("Libvirt.Reconcile", request, response); err != nil {
+		t.Fatalf("Error running Libvirt.Reconcile: %s\n", err.Error())
+	}
+
+	if len(response.MissingNetworks) != len(cli.guest.Nics) {
+		t.Fatalf("Expected networks %v to be rolled back, missing %v\n", cli.guest.Nics, response.MissingNetworks)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	cli := setup(t, testURI(), 9002)
+	defer teardown(cli)
 
 	do("Libvirt.CreateGuest", t, cli, "shutoff")
+	do("Libvirt.Status", t, cli, "shutoff")
+	do("Libvirt.Create", t, cli, "running")
+	do("Libvirt.Poweroff", t, cli, "shutoff")
 	do("Libvirt.Run", t, cli, "running")
 	do("Libvirt.Reboot", t, cli, "running")
+	do("Libvirt.Shutdown", t, cli, "shutoff")
+	do("Libvirt.Run", t, cli, "running")
+	do("Libvirt.Poweroff", t, cli, "shutoff")
 	do("Libvirt.Delete", t, cli, "")
 }
 
+// TestMetrics runs against the fake backend, as the libvirt test driver does
+// not support all of the stats calls
 func TestMetrics(t *testing.T) {
-	cli := setup(t, "qemu:///system", 9003)
-	cli.guest.Type = "qemu"
+	lv, err := libvirt.NewLibvirtWithBackend(libvirt.NewFakeBackend(), fakeURI, "mistify", 1)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+	cli := serve(t, lv, 9003)
+	defer teardown(cli)
 
 	do("Libvirt.CreateGuest", t, cli, "shutoff")
 	do("Libvirt.Run", t, cli, "running")
+	// a second Run picks up the nic devices of the running domain
+	do("Libvirt.Run", t, cli, "running")
 
 	metric("Libvirt.CPUMetrics", t, cli)
 	metric("Libvirt.DiskMetrics", t, cli)
 	metric("Libvirt.NicMetrics", t, cli)
 
+	do("Libvirt.Poweroff", t, cli, "shutoff")
+	do("Libvirt.Delete", t, cli, "")
+}
+
+func TestCustomDriver(t *testing.T) {
+	driver, err := filepath.Abs(filepath.Join("testdata", "driver.xml"))
+	if err != nil {
+		t.Fatalf("can't find test driver xml: %s\n", err.Error())
+	}
+
+	cli := setup(t, "test://"+driver, 9005)
+	defer teardown(cli)
+
+	do("Libvirt.CreateGuest", t, cli, "shutoff")
+	do("Libvirt.Run", t, cli, "running")
+	do("Libvirt.Shutdown", t, cli, "shutoff")
+	do("Libvirt.Delete", t, cli, "")
+}
+
+// TestQemu needs a real hypervisor and is only run when LIBVIRT_QEMU_URI is
+// set, e.g. to qemu:///system
+func TestQemu(t *testing.T) {
+	uri := os.Getenv("LIBVIRT_QEMU_URI")
+	if uri == "" {
+		t.Skip("LIBVIRT_QEMU_URI not set")
+	}
+
+	cli := setup(t, uri, 9006)
+	defer teardown(cli)
+	cli.guest.Type = "qemu"
+
+	do("Libvirt.CreateGuest", t, cli, "shutoff")
+	do("Libvirt.Run", t, cli, "running")
+	do("Libvirt.Reboot", t, cli, "running")
+	metric("Libvirt.CPUMetrics", t, cli)
+	metric("Libvirt.DiskMetrics", t, cli)
+	metric("Libvirt.NicMetrics", t, cli)
+	do("Libvirt.Poweroff", t, cli, "shutoff")
 	do("Libvirt.Delete", t, cli, "")
 }
 
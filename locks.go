@@ -0,0 +1,151 @@
+package libvirt
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// volumeLockPrefix distinguishes volume locks, keyed by path, from guest locks
+const volumeLockPrefix = "volume:"
+
+// DefaultLockTimeout is how long a mutating RPC waits for another operation on
+// the same guest to finish, unless changed with SetLockTimeout
+const DefaultLockTimeout = 10 * time.Second
+
+// ErrGuestBusy is returned when another operation on a guest does not finish
+// within the lock timeout
+var ErrGuestBusy = errors.New("guest is busy with another operation")
+
+type (
+	// GuestLocks serializes operations on a guest while letting operations on
+	// different guests run in parallel
+	GuestLocks struct {
+		lock   sync.Mutex
+		guests map[string]*guestLock
+	}
+
+	// guestLock is held by one operation at a time. waiters counts the
+	// operations holding or waiting for it, so it can be removed when unused.
+	guestLock struct {
+		held    chan struct{}
+		waiters int
+	}
+)
+
+// NewGuestLocks creates a new lock manager
+func NewGuestLocks() *GuestLocks {
+	return &GuestLocks{
+		guests: make(map[string]*guestLock),
+	}
+}
+
+// Lock waits up to timeout for the lock of a guest and returns a function that
+// releases it. ErrGuestBusy is returned if the lock is not acquired in time.
+func (l *GuestLocks) Lock(id string, timeout time.Duration) (func(), error) {
+	l.lock.Lock()
+	gl, ok := l.guests[id]
+	if !ok {
+		gl = &guestLock{held: make(chan struct{}, 1)}
+		l.guests[id] = gl
+	}
+	gl.waiters++
+	l.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case gl.held <- struct{}{}:
+	case <-timer.C:
+		l.done(id, gl)
+		return nil, ErrGuestBusy
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-gl.held
+			l.done(id, gl)
+		})
+	}, nil
+}
+
+// done removes a guest's lock once no operation holds or waits for it
+func (l *GuestLocks) done(id string, gl *guestLock) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	gl.waiters--
+	if gl.waiters == 0 {
+		delete(l.guests, id)
+	}
+}
+
+// SetLockTimeout sets how long mutating RPCs wait for other operations on the
+// same guest
+func (lv *Libvirt) SetLockTimeout(timeout time.Duration) {
+	lv.lockTimeout = timeout
+}
+
+// lockGuest serializes mutating operations on a guest. If the request is for
+// a job, the job is recorded as holding the lock until it is unlocked, and
+// ErrJobCancelled is returned if it was cancelled while waiting.
+func (lv *Libvirt) lockGuest(r *http.Request, id string) (func(), error) {
+	unlock, err := lv.locks.Lock(id, lv.lockTimeout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guest":   id,
+			"timeout": lv.lockTimeout,
+		}).Warn("guest is busy")
+		return nil, err
+	}
+
+	var jobID string
+	if r != nil {
+		jobID = r.Header.Get(jobHeader)
+	}
+	if err := lv.jobs.acquired(jobID); err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		lv.jobs.released(jobID)
+		unlock()
+	}, nil
+}
+
+// lockVolumes serializes using volumes, by path, as guest disks with uploading
+// to or deleting them. The locks are taken in path order, so operations on
+// several volumes can't deadlock, and ErrVolumeBusy is returned if one is not
+// acquired in time.
+func (lv *Libvirt) lockVolumes(paths ...string) (func(), error) {
+	sort.Strings(paths)
+
+	unlocks := make([]func(), 0, len(paths))
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for i, path := range paths {
+		if path == "" || (i > 0 && path == paths[i-1]) {
+			continue
+		}
+		unlock, err := lv.locks.Lock(volumeLockPrefix+path, lv.lockTimeout)
+		if err != nil {
+			unlockAll()
+			log.WithFields(log.Fields{
+				"volume":  path,
+				"timeout": lv.lockTimeout,
+			}).Warn("volume is busy")
+			return nil, ErrVolumeBusy
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
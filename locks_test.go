@@ -0,0 +1,82 @@
+package libvirt_test
+
+import (
+	"testing"
+	"time"
+
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+func TestGuestLocks(t *testing.T) {
+	locks := mlibvirt.NewGuestLocks()
+
+	unlockA, err := locks.Lock("a", time.Second)
+	if err != nil {
+		t.Fatalf("Lock failed: %s\n", err.Error())
+	}
+
+	if _, err = locks.Lock("a", 10*time.Millisecond); err != mlibvirt.ErrGuestBusy {
+		t.Fatalf("Expected ErrGuestBusy, got %v\n", err)
+	}
+
+	// other guests are not blocked
+	unlockB, err := locks.Lock("b", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Lock of another guest failed: %s\n", err.Error())
+	}
+	unlockB()
+
+	// waiters get the lock once it is released
+	acquired := make(chan error)
+	go func() {
+		unlock, err := locks.Lock("a", time.Second)
+		if err == nil {
+			unlock()
+		}
+		acquired <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	unlockA()
+	// releasing twice is harmless
+	unlockA()
+
+	if err = <-acquired; err != nil {
+		t.Fatalf("Waiting Lock failed: %s\n", err.Error())
+	}
+}
+
+func TestGuestLockedRPCs(t *testing.T) {
+	lv, backend, guest := fakeSetup(t)
+	lv.SetLockTimeout(50 * time.Millisecond)
+
+	guest = call(t, "Run", lv.Run, guest, "running")
+	backend.IgnoreShutdown(guest.ID, true)
+
+	// hold the guest's lock with a shutdown that times out
+	done := make(chan error)
+	go func() {
+		request := &mlibvirt.ShutdownRequest{Guest: guest, Timeout: 1, Force: true}
+		done <- lv.GracefulShutdown(nil, request, &mlibvirt.ShutdownResponse{})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := lv.Delete(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != mlibvirt.ErrGuestBusy {
+		t.Fatalf("Expected ErrGuestBusy, got %v\n", err)
+	}
+
+	// read only calls and other guests are not blocked
+	call(t, "Status", lv.Status, guest, "running")
+	other := &client.Guest{ID: "other-guest", Type: "test", Memory: 256, CPU: 1}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: other}, &rpc.GuestResponse{}); err != nil {
+		t.Fatalf("CreateGuest of another guest failed: %s\n", err.Error())
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("GracefulShutdown failed: %s\n", err.Error())
+	}
+
+	call(t, "Delete", lv.Delete, guest, "shutoff")
+}
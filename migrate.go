@@ -0,0 +1,172 @@
+package libvirt
+
+import (
+	"net/http"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+	"github.com/mistifyio/mistify-agent/client"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// JobTypeNames maps libvirt job types to common name strings
+var JobTypeNames = map[int]string{
+	libvirt.VIR_DOMAIN_JOB_NONE:      "none",
+	libvirt.VIR_DOMAIN_JOB_BOUNDED:   "bounded",
+	libvirt.VIR_DOMAIN_JOB_UNBOUNDED: "unbounded",
+	libvirt.VIR_DOMAIN_JOB_COMPLETED: "completed",
+	libvirt.VIR_DOMAIN_JOB_FAILED:    "failed",
+	libvirt.VIR_DOMAIN_JOB_CANCELLED: "cancelled",
+}
+
+// migrationPollInterval is how often migration progress is checked
+var migrationPollInterval = time.Second
+
+type (
+	// MigrateRequest is a request to live migrate a guest to another host
+	MigrateRequest struct {
+		Guest *client.Guest `json:"guest"`
+		// Destination libvirt uri, e.g. qemu+tcp://host2/system
+		URI string `json:"uri"`
+		// Copy non-shared storage to the destination
+		CopyStorage bool `json:"copy_storage,omitempty"`
+		// Bandwidth cap in MiB/s, 0 for unlimited
+		Bandwidth uint64 `json:"bandwidth,omitempty"`
+		// Maximum tolerable downtime in milliseconds, 0 for the default
+		MaxDowntime uint64 `json:"max_downtime,omitempty"`
+	}
+
+	// MigrateResponse is a migrated guest and the final state of the job
+	MigrateResponse struct {
+		Guest *client.Guest `json:"guest"`
+		Job   *JobProgress  `json:"job"`
+	}
+
+	// JobProgress is the progress of a long running libvirt domain job
+	// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainJobInfo
+	JobProgress struct {
+		Type          string `json:"type"`
+		TimeElapsed   uint64 `json:"time_elapsed"`
+		TimeRemaining uint64 `json:"time_remaining"`
+		DataTotal     uint64 `json:"data_total"`
+		DataProcessed uint64 `json:"data_processed"`
+		DataRemaining uint64 `json:"data_remaining"`
+	}
+)
+
+// Migrate live migrates a libvirt domain for a guest to another host using
+// peer to peer migration. The domain is persisted on the destination and
+// undefined on the source.
+// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainMigrate
+func (lv *Libvirt) Migrate(r *http.Request, request *MigrateRequest, response *MigrateResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" || request.URI == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest": request.Guest.ID,
+		"uri":   request.URI,
+	}).Info("Libvirt.Migrate")
+
+	unlock, err := lv.lockGuest(r, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	domain, err := lv.LookupDomainByName(request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": request.Guest.ID}, "failed to free domain")
+
+	dconn, err := lv.TransientConnection(request.URI)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(dconn.Close, log.Fields{"uri": request.URI}, "failed to close connection")
+
+	flags := uint32(libvirt.VIR_MIGRATE_LIVE |
+		libvirt.VIR_MIGRATE_PEER2PEER |
+		libvirt.VIR_MIGRATE_PERSIST_DEST |
+		libvirt.VIR_MIGRATE_UNDEFINE_SOURCE)
+	if request.CopyStorage {
+		flags |= libvirt.VIR_MIGRATE_NON_SHARED_DISK
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		migrated, err := domain.Migrate(dconn, flags, "", "", request.Bandwidth)
+		if err == nil {
+			logx.LogReturnedErr(migrated.Free, log.Fields{"guestID": request.Guest.ID}, "failed to free domain")
+		}
+		done <- err
+	}()
+
+	var progress *JobProgress
+	downtimeSet := request.MaxDowntime == 0
+	ticker := time.NewTicker(migrationPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err = <-done:
+			if err != nil {
+				return err
+			}
+
+			if progress == nil {
+				progress = &JobProgress{}
+			}
+			progress.Type = JobTypeNames[libvirt.VIR_DOMAIN_JOB_COMPLETED]
+			progress.TimeRemaining = 0
+			progress.DataRemaining = 0
+
+			*response = MigrateResponse{
+				Guest: request.Guest,
+				Job:   progress,
+			}
+
+			migrated, err := dconn.LookupDomainByName(request.Guest.ID)
+			if err != nil {
+				return err
+			}
+			defer logx.LogReturnedErr(migrated.Free, log.Fields{"guestID": request.Guest.ID}, "failed to free domain")
+
+			state, err := GetState(migrated)
+			if err != nil {
+				return err
+			}
+			response.Guest.State = StateNames[state]
+
+			return nil
+
+		case <-ticker.C:
+			p, err := domain.GetJobProgress()
+			if err != nil {
+				// the job may have finished between ticks
+				continue
+			}
+			progress = p
+
+			if !downtimeSet && p.Type != JobTypeNames[libvirt.VIR_DOMAIN_JOB_NONE] {
+				if err := domain.MigrateSetMaxDowntime(request.MaxDowntime, 0); err != nil {
+					log.WithFields(log.Fields{
+						"guest": request.Guest.ID,
+						"error": err,
+					}).Error("failed to set migration max downtime")
+				}
+				downtimeSet = true
+			}
+
+			log.WithFields(log.Fields{
+				"guest":          request.Guest.ID,
+				"data_processed": p.DataProcessed,
+				"data_remaining": p.DataRemaining,
+				"data_total":     p.DataTotal,
+			}).Info("Libvirt.Migrate progress")
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package libvirt
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+	"github.com/mistifyio/mistify-agent/client"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// guestNetworkName matches the names of the per-nic networks created by
+// CreateGuest, which are named by mac address
+var guestNetworkName = regexp.MustCompile(`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`)
+
+type (
+	// ReconcileRequest is the authoritative list of guests on this host
+	ReconcileRequest struct {
+		Guests []*client.Guest `json:"guests"`
+		// Remove unknown domains and networks
+		Remove bool `json:"remove,omitempty"`
+	}
+
+	// Divergence is a libvirt object whose definition differs from the one
+	// that would be generated for its guest
+	Divergence struct {
+		Name        string   `json:"name"`
+		Differences []string `json:"differences"`
+	}
+
+	// ReconcileResponse is the difference between the guests on this host and
+	// the authoritative list
+	ReconcileResponse struct {
+		UnknownDomains   []string     `json:"unknown_domains"`
+		MissingDomains   []string     `json:"missing_domains"`
+		DivergedDomains  []Divergence `json:"diverged_domains"`
+		UnknownNetworks  []string     `json:"unknown_networks"`
+		MissingNetworks  []string     `json:"missing_networks"`
+		DivergedNetworks []Divergence `json:"diverged_networks"`
+		RemovedDomains   []string     `json:"removed_domains"`
+		RemovedNetworks  []string     `json:"removed_networks"`
+	}
+)
+
+// Reconcile compares the domains and per-nic networks on this host with an
+// authoritative list of guests. Domains and networks that are not part of any
+// guest are reported as unknown and, if requested, removed along with the
+// volumes created for them. Missing and diverged objects are only reported.
+func (lv *Libvirt) Reconcile(r *http.Request, request *ReconcileRequest, response *ReconcileResponse) error {
+	log.WithFields(log.Fields{
+		"guests": len(request.Guests),
+		"remove": request.Remove,
+	}).Info("Libvirt.Reconcile")
+
+	*response = ReconcileResponse{
+		UnknownDomains:   []string{},
+		MissingDomains:   []string{},
+		DivergedDomains:  []Divergence{},
+		UnknownNetworks:  []string{},
+		MissingNetworks:  []string{},
+		DivergedNetworks: []Divergence{},
+		RemovedDomains:   []string{},
+		RemovedNetworks:  []string{},
+	}
+
+	guests := make(map[string]*client.Guest)
+	nics := make(map[string]client.Nic)
+	for _, guest := range request.Guests {
+		guests[guest.ID] = guest
+		for _, nic := range guest.Nics {
+			nics[nic.Mac] = nic
+		}
+	}
+
+	conn, err := lv.getConnection()
+	if err != nil {
+		return err
+	}
+	err = lv.reconcileDomains(conn, guests, response)
+	conn.Release()
+	if err != nil {
+		return err
+	}
+
+	// like any other call, removal takes the guest lock without holding a
+	// pooled connection
+	if request.Remove {
+		for _, name := range response.UnknownDomains {
+			if err = lv.removeUnknownDomain(r, name); err != nil {
+				return err
+			}
+			response.RemovedDomains = append(response.RemovedDomains, name)
+		}
+	}
+
+	conn, err = lv.getConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if err = lv.reconcileNetworks(conn, nics, request.Remove, response); err != nil {
+		return err
+	}
+
+	sort.Strings(response.MissingDomains)
+	sort.Strings(response.MissingNetworks)
+
+	return nil
+}
+
+func (lv *Libvirt) reconcileDomains(conn *Connection, guests map[string]*client.Guest, response *ReconcileResponse) error {
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range domains {
+			logx.LogReturnedErr(domains[i].Free, nil, "failed to free domain")
+		}
+	}()
+
+	found := make(map[string]bool)
+	for _, domain := range domains {
+		actual, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		guest, ok := guests[actual.Name]
+		if !ok {
+			response.UnknownDomains = append(response.UnknownDomains, actual.Name)
+			continue
+		}
+		found[actual.Name] = true
+
+		if differences := diffDomains(GuestDomain(guest), actual); len(differences) > 0 {
+			response.DivergedDomains = append(response.DivergedDomains, Divergence{
+				Name:        actual.Name,
+				Differences: differences,
+			})
+		}
+	}
+
+	for id := range guests {
+		if !found[id] {
+			response.MissingDomains = append(response.MissingDomains, id)
+		}
+	}
+
+	return nil
+}
+
+func (lv *Libvirt) reconcileNetworks(conn *Connection, nics map[string]client.Nic, remove bool, response *ReconcileResponse) error {
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range networks {
+			logx.LogReturnedErr(networks[i].Free, nil, "failed to free network")
+		}
+	}()
+
+	found := make(map[string]bool)
+	for _, network := range networks {
+		actual, err := ParseNetwork(network)
+		if err != nil {
+			return err
+		}
+
+		// only consider networks created for guest nics
+		if !guestNetworkName.MatchString(actual.Name) {
+			continue
+		}
+
+		nic, ok := nics[actual.Name]
+		if !ok {
+			response.UnknownNetworks = append(response.UnknownNetworks, actual.Name)
+			if remove {
+				if err = removeNetwork(network); err != nil {
+					return err
+				}
+				response.RemovedNetworks = append(response.RemovedNetworks, actual.Name)
+			}
+			continue
+		}
+		found[actual.Name] = true
+
+		if differences := diffNetworks(GuestNetwork(nic), actual); len(differences) > 0 {
+			response.DivergedNetworks = append(response.DivergedNetworks, Divergence{
+				Name:        actual.Name,
+				Differences: differences,
+			})
+		}
+	}
+
+	for mac := range nics {
+		if !found[mac] {
+			response.MissingNetworks = append(response.MissingNetworks, mac)
+		}
+	}
+
+	return nil
+}
+
+// removeUnknownDomain removes a domain reported by Reconcile under its guest
+// lock. A domain that is gone by then is left alone.
+func (lv *Libvirt) removeUnknownDomain(r *http.Request, name string) error {
+	unlock, err := lv.lockGuest(r, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	domain, err := lv.LookupDomainByName(name)
+	if virError, ok := err.(libvirt.VirError); ok && virError.Code == libvirt.VIR_ERR_NO_DOMAIN {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": name}, "failed to free domain")
+
+	return lv.removeDomain(domain)
+}
+
+// removeDomain destroys a domain if it is active, destroys the volumes created
+// for it as Delete does, and undefines it
+func (lv *Libvirt) removeDomain(domain BackendDomain) error {
+	v, err := ParseDomain(domain)
+	if err != nil {
+		return err
+	}
+
+	if active, err := domain.IsActive(); err != nil {
+		return err
+	} else if active {
+		if err = domain.Destroy(); err != nil {
+			return err
+		}
+	}
+
+	if err = lv.destroyVolumes(lv.createdVolumes(v.Name, v)); err != nil {
+		return err
+	}
+
+	if persistent, err := domain.IsPersistent(); err != nil {
+		return err
+	} else if !persistent {
+		// transient domains disappear once destroyed
+		return nil
+	}
+
+	return domain.UndefineFlags(libvirt.VIR_DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
+}
+
+// removeNetwork destroys a network if it is active and undefines it
+func removeNetwork(network BackendNetwork) error {
+	if active, err := network.IsActive(); err != nil {
+		return err
+	} else if active {
+		if err = network.Destroy(); err != nil {
+			return err
+		}
+	}
+
+	return network.Undefine()
+}
+
+// diffDomains compares the parts of a domain definition that are generated
+// from a guest
+func diffDomains(expected, actual *VirDomain) []string {
+	differences := make([]string, 0)
+
+	if expected.Type != actual.Type {
+		differences = append(differences, fmt.Sprintf("type: expected %s, got %s", expected.Type, actual.Type))
+	}
+	if expected.Memory != actual.Memory {
+		differences = append(differences, fmt.Sprintf("memory: expected %d KiB, got %d KiB", expected.Memory, actual.Memory))
+	}
+	if expected.VCPU != actual.VCPU {
+		differences = append(differences, fmt.Sprintf("vcpu: expected %d, got %d", expected.VCPU, actual.VCPU))
+	}
+
+	if len(expected.Devices.Disks) != len(actual.Devices.Disks) {
+		differences = append(differences, fmt.Sprintf("disks: expected %d, got %d", len(expected.Devices.Disks), len(actual.Devices.Disks)))
+	} else {
+		for i, e := range expected.Devices.Disks {
+			a := actual.Devices.Disks[i]
+			if e.Source != a.Source || e.Target != a.Target {
+				differences = append(differences, fmt.Sprintf("disk %d: expected %+v %+v, got %+v %+v", i, e.Source, e.Target, a.Source, a.Target))
+			}
+		}
+	}
+
+	if len(expected.Devices.Interfaces) != len(actual.Devices.Interfaces) {
+		differences = append(differences, fmt.Sprintf("interfaces: expected %d, got %d", len(expected.Devices.Interfaces), len(actual.Devices.Interfaces)))
+	} else {
+		for i, e := range expected.Devices.Interfaces {
+			a := actual.Devices.Interfaces[i]
+			if e.Source.Network != a.Source.Network {
+				differences = append(differences, fmt.Sprintf("interface %d network: expected %s, got %s", i, e.Source.Network, a.Source.Network))
+			}
+			// mac and model are filled in by libvirt when not specified
+			if e.Mac.Address != "" && e.Mac.Address != a.Mac.Address {
+				differences = append(differences, fmt.Sprintf("interface %d mac: expected %s, got %s", i, e.Mac.Address, a.Mac.Address))
+			}
+			if e.Model.Type != "" && e.Model.Type != a.Model.Type {
+				differences = append(differences, fmt.Sprintf("interface %d model: expected %s, got %s", i, e.Model.Type, a.Model.Type))
+			}
+		}
+	}
+
+	return differences
+}
+
+// diffNetworks compares the parts of a network definition that are generated
+// from a guest nic
+func diffNetworks(expected, actual *VirNetwork) []string {
+	differences := make([]string, 0)
+
+	if expected.Bridge.Name != actual.Bridge.Name {
+		differences = append(differences, fmt.Sprintf("bridge: expected %s, got %s", expected.Bridge.Name, actual.Bridge.Name))
+	}
+	if expected.Forward.Mode != actual.Forward.Mode {
+		differences = append(differences, fmt.Sprintf("forward: expected %s, got %s", expected.Forward.Mode, actual.Forward.Mode))
+	}
+	if !reflect.DeepEqual(portgroupVLANs(expected), portgroupVLANs(actual)) {
+		differences = append(differences, fmt.Sprintf("vlans: expected %v, got %v", portgroupVLANs(expected), portgroupVLANs(actual)))
+	}
+
+	return differences
+}
+
+// portgroupVLANs returns the sorted vlan tags of each portgroup of a network
+func portgroupVLANs(network *VirNetwork) map[string][]int {
+	vlans := make(map[string][]int)
+	for _, pg := range network.Portgroups {
+		tags := make([]int, 0)
+		if pg.VLAN != nil {
+			for _, tag := range pg.VLAN.Tags {
+				tags = append(tags, tag.ID)
+			}
+		}
+		sort.Ints(tags)
+		vlans[pg.Name] = tags
+	}
+	return vlans
+}
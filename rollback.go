@@ -0,0 +1,86 @@
+package libvirt
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type (
+	// StepError is returned when a step of a multi-step operation fails.
+	// Everything done by earlier steps has been rolled back; any failures
+	// while doing so are listed in RollbackErrors.
+	StepError struct {
+		Operation      string
+		Step           string
+		Err            error
+		RollbackErrors []error
+	}
+
+	// rollbackStep undoes a completed step
+	rollbackStep struct {
+		name string
+		undo func() error
+	}
+
+	// rollback tracks completed steps of an operation so they can be undone
+	// in reverse order if a later step fails
+	rollback struct {
+		operation string
+		steps     []rollbackStep
+	}
+)
+
+// Error describes the failed step and any rollback failures
+func (e *StepError) Error() string {
+	msg := fmt.Sprintf("%s failed at step %q: %s", e.Operation, e.Step, e.Err)
+	if len(e.RollbackErrors) > 0 {
+		errs := make([]string, len(e.RollbackErrors))
+		for i, err := range e.RollbackErrors {
+			errs[i] = err.Error()
+		}
+		msg = fmt.Sprintf("%s; rollback failed: %s", msg, strings.Join(errs, "; "))
+	}
+	return msg
+}
+
+func newRollback(operation string) *rollback {
+	return &rollback{
+		operation: operation,
+		steps:     make([]rollbackStep, 0),
+	}
+}
+
+// add records a completed step and how to undo it
+func (rb *rollback) add(name string, undo func() error) {
+	rb.steps = append(rb.steps, rollbackStep{
+		name: name,
+		undo: undo,
+	})
+}
+
+// fail undoes all completed steps in reverse order and returns a StepError
+// for the failed step
+func (rb *rollback) fail(step string, err error) error {
+	stepErr := &StepError{
+		Operation: rb.operation,
+		Step:      step,
+		Err:       err,
+	}
+
+	for i := len(rb.steps) - 1; i >= 0; i-- {
+		s := rb.steps[i]
+		if undoErr := s.undo(); undoErr != nil {
+			log.WithFields(log.Fields{
+				"operation": rb.operation,
+				"step":      s.name,
+				"error":     undoErr,
+			}).Error("failed to roll back step")
+			stepErr.RollbackErrors = append(stepErr.RollbackErrors, fmt.Errorf("undo %s: %s", s.name, undoErr))
+		}
+	}
+	rb.steps = nil
+
+	return stepErr
+}
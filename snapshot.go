@@ -0,0 +1,401 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"net/http"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+	"github.com/mistifyio/mistify-agent/client"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// SnapshotNamespace is the xml namespace used for snapshot metadata
+const SnapshotNamespace = "http://mistify.io/xml/snapshot/1"
+
+type (
+	// SnapshotRequest is a request to create, revert, or delete a guest snapshot
+	SnapshotRequest struct {
+		Guest       *client.Guest     `json:"guest"`
+		Name        string            `json:"name"`
+		Description string            `json:"description,omitempty"`
+		DiskOnly    bool              `json:"disk_only,omitempty"`
+		Recursive   bool              `json:"recursive,omitempty"`
+		Metadata    map[string]string `json:"metadata,omitempty"`
+	}
+
+	// SnapshotResponse is a guest and its snapshot tree
+	SnapshotResponse struct {
+		Guest     *client.Guest `json:"guest"`
+		Snapshots []*Snapshot   `json:"snapshots"`
+	}
+
+	// Snapshot is a node in a guest's snapshot tree
+	Snapshot struct {
+		Name         string            `json:"name"`
+		Description  string            `json:"description,omitempty"`
+		State        string            `json:"state"`
+		External     bool              `json:"external"`
+		CreationTime int64             `json:"creation_time"`
+		Metadata     map[string]string `json:"metadata,omitempty"`
+		Children     []*Snapshot       `json:"children,omitempty"`
+	}
+
+	// SnapshotParent http://libvirt.org/formatsnapshot.html
+	SnapshotParent struct {
+		Name string `xml:"name"`
+	}
+
+	// SnapshotMemory http://libvirt.org/formatsnapshot.html
+	SnapshotMemory struct {
+		Snapshot string `xml:"snapshot,attr,omitempty"`
+	}
+
+	// SnapshotDisk http://libvirt.org/formatsnapshot.html
+	SnapshotDisk struct {
+		Name     string `xml:"name,attr"`
+		Snapshot string `xml:"snapshot,attr,omitempty"`
+	}
+
+	// SnapshotDisks http://libvirt.org/formatsnapshot.html
+	SnapshotDisks struct {
+		Disks []SnapshotDisk `xml:"disk"`
+	}
+
+	// VirDomainSnapshot http://libvirt.org/formatsnapshot.html
+	VirDomainSnapshot struct {
+		XMLName      struct{}        `xml:"domainsnapshot"`
+		Name         string          `xml:"name"`
+		Description  string          `xml:"description,omitempty"`
+		State        string          `xml:"state,omitempty"`
+		CreationTime int64           `xml:"creationTime,omitempty"`
+		Parent       *SnapshotParent `xml:"parent,omitempty"`
+		Memory       *SnapshotMemory `xml:"memory,omitempty"`
+		Disks        *SnapshotDisks  `xml:"disks,omitempty"`
+	}
+
+	// MetadataSnapshot is metadata about a snapshot
+	MetadataSnapshot struct {
+		XMLName    xml.Name                `xml:"http://mistify.io/xml/snapshot/1 snapshot"`
+		Name       string                  `xml:"name,attr"`
+		Parameters []UserMetadataParameter `xml:"http://mistify.io/xml/snapshot/1 parameter"`
+	}
+
+	// MetadataSnapshots is metadata about all snapshots of a domain
+	MetadataSnapshots struct {
+		XMLName   xml.Name           `xml:"http://mistify.io/xml/snapshot/1 snapshots"`
+		Snapshots []MetadataSnapshot `xml:"http://mistify.io/xml/snapshot/1 snapshot"`
+	}
+)
+
+// External reports whether any part of the snapshot is stored outside of the
+// domain's disk images
+func (s *VirDomainSnapshot) External() bool {
+	if s.Memory != nil && s.Memory.Snapshot == "external" {
+		return true
+	}
+	if s.Disks == nil {
+		return false
+	}
+	for _, disk := range s.Disks.Disks {
+		if disk.Snapshot == "external" {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSnapshotMetadata replaces the mistify snapshot metadata of a libvirt domain
+func SetSnapshotMetadata(domain BackendDomain, metadata MetadataSnapshots) error {
+	x, err := xml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	return domain.SetMetadata(libvirt.VIR_DOMAIN_METADATA_ELEMENT, string(x), "mistify-snapshot", SnapshotNamespace, affectFlags(domain))
+}
+
+// SnapshotTree builds the snapshot tree of a libvirt domain
+func SnapshotTree(domain BackendDomain) ([]*Snapshot, error) {
+	v, err := ParseDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]map[string]string)
+	for _, m := range v.Metadata.Snapshots.Snapshots {
+		params := make(map[string]string)
+		for _, p := range m.Parameters {
+			params[p.Name] = p.Value
+		}
+		metadata[m.Name] = params
+	}
+
+	snapshots, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*Snapshot)
+	parents := make(map[string]string)
+	order := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		xmldesc, err := snapshot.GetXMLDesc(0)
+		logx.LogReturnedErr(snapshot.Free, nil, "failed to free snapshot")
+		if err != nil {
+			return nil, err
+		}
+
+		s := VirDomainSnapshot{}
+		if err = xml.Unmarshal([]byte(xmldesc), &s); err != nil {
+			return nil, err
+		}
+
+		nodes[s.Name] = &Snapshot{
+			Name:         s.Name,
+			Description:  s.Description,
+			State:        s.State,
+			External:     s.External(),
+			CreationTime: s.CreationTime,
+			Metadata:     metadata[s.Name],
+		}
+		if s.Parent != nil {
+			parents[s.Name] = s.Parent.Name
+		}
+		order = append(order, s.Name)
+	}
+
+	tree := make([]*Snapshot, 0)
+	for _, name := range order {
+		parent, ok := nodes[parents[name]]
+		if !ok {
+			tree = append(tree, nodes[name])
+			continue
+		}
+		parent.Children = append(parent.Children, nodes[name])
+	}
+
+	return tree, nil
+}
+
+// snapshotNames returns the names of all snapshots in a snapshot tree
+func snapshotNames(tree []*Snapshot, names map[string]bool) map[string]bool {
+	for _, s := range tree {
+		names[s.Name] = true
+		snapshotNames(s.Children, names)
+	}
+	return names
+}
+
+// SnapshotWrapper looks up a libvirt domain for a snapshot request, runs a
+// function on it, and responds with the guest state and snapshot tree
+func (lv *Libvirt) SnapshotWrapper(fn func(BackendDomain, *SnapshotRequest) error) func(*http.Request, *SnapshotRequest, *SnapshotResponse) error {
+	return func(r *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+		if request.Guest == nil || request.Guest.ID == "" {
+			return syscall.EINVAL
+		}
+
+		domain, err := lv.LookupDomainByName(request.Guest.ID)
+		if err != nil {
+			return err
+		}
+		defer logx.LogReturnedErr(domain.Free, log.Fields{"guestID": request.Guest.ID}, "failed to free domain")
+
+		if fn != nil {
+			if err = fn(domain, request); err != nil {
+				return err
+			}
+		}
+
+		tree, err := SnapshotTree(domain)
+		if err != nil {
+			return err
+		}
+
+		state, err := GetState(domain)
+		if err != nil {
+			return err
+		}
+
+		*response = SnapshotResponse{
+			Guest:     request.Guest,
+			Snapshots: tree,
+		}
+		response.Guest.State = StateNames[state]
+
+		return nil
+	}
+}
+
+// CreateSnapshot creates a snapshot of a libvirt domain for a guest. Disk only
+// snapshots are external; all others are internal and include memory state.
+// https://libvirt.org/html/libvirt-libvirt-domain-snapshot.html#virDomainSnapshotCreateXML
+func (lv *Libvirt) CreateSnapshot(r *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" || request.Name == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest":    request.Guest.ID,
+		"snapshot": request.Name,
+	}).Info("Libvirt.CreateSnapshot")
+
+	unlock, err := lv.lockGuest(r, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.SnapshotWrapper(func(domain BackendDomain, request *SnapshotRequest) error {
+		x, err := xml.Marshal(VirDomainSnapshot{
+			Name:        request.Name,
+			Description: request.Description,
+		})
+		if err != nil {
+			return err
+		}
+
+		flags := uint32(libvirt.VIR_DOMAIN_SNAPSHOT_CREATE_ATOMIC)
+		if request.DiskOnly {
+			flags |= libvirt.VIR_DOMAIN_SNAPSHOT_CREATE_DISK_ONLY
+		}
+
+		snapshot, err := domain.CreateSnapshotXML(string(x), flags)
+		if err != nil {
+			return err
+		}
+		defer logx.LogReturnedErr(snapshot.Free, log.Fields{"snapshot": request.Name}, "failed to free snapshot")
+
+		v, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		m := MetadataSnapshot{
+			Name: request.Name,
+		}
+		for name, value := range request.Metadata {
+			m.Parameters = append(m.Parameters, UserMetadataParameter{
+				Name:  name,
+				Value: value,
+			})
+		}
+
+		metadata := v.Metadata.Snapshots
+		metadata.Snapshots = append(metadata.Snapshots, m)
+
+		return SetSnapshotMetadata(domain, metadata)
+	})(r, request, response)
+}
+
+// ListSnapshots looks up the snapshot tree of a libvirt domain for a guest
+func (lv *Libvirt) ListSnapshots(r *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest": request.Guest.ID,
+	}).Info("Libvirt.ListSnapshots")
+
+	return lv.SnapshotWrapper(nil)(r, request, response)
+}
+
+// RevertSnapshot reverts a libvirt domain for a guest to a snapshot. Snapshot
+// metadata is preserved across the revert.
+// https://libvirt.org/html/libvirt-libvirt-domain-snapshot.html#virDomainRevertToSnapshot
+func (lv *Libvirt) RevertSnapshot(r *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" || request.Name == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest":    request.Guest.ID,
+		"snapshot": request.Name,
+	}).Info("Libvirt.RevertSnapshot")
+
+	unlock, err := lv.lockGuest(r, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.SnapshotWrapper(func(domain BackendDomain, request *SnapshotRequest) error {
+		snapshot, err := domain.SnapshotLookupByName(request.Name, 0)
+		if err != nil {
+			return err
+		}
+		defer logx.LogReturnedErr(snapshot.Free, log.Fields{"snapshot": request.Name}, "failed to free snapshot")
+
+		// the domain definition is replaced by the one stored with the
+		// snapshot, which may not know about newer snapshots
+		v, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		if err = snapshot.RevertToSnapshot(0); err != nil {
+			return err
+		}
+
+		return SetSnapshotMetadata(domain, v.Metadata.Snapshots)
+	})(r, request, response)
+}
+
+// DeleteSnapshot deletes a snapshot, and optionally its children, of a libvirt
+// domain for a guest
+// https://libvirt.org/html/libvirt-libvirt-domain-snapshot.html#virDomainSnapshotDelete
+func (lv *Libvirt) DeleteSnapshot(r *http.Request, request *SnapshotRequest, response *SnapshotResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" || request.Name == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"guest":    request.Guest.ID,
+		"snapshot": request.Name,
+	}).Info("Libvirt.DeleteSnapshot")
+
+	unlock, err := lv.lockGuest(r, request.Guest.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lv.SnapshotWrapper(func(domain BackendDomain, request *SnapshotRequest) error {
+		snapshot, err := domain.SnapshotLookupByName(request.Name, 0)
+		if err != nil {
+			return err
+		}
+		defer logx.LogReturnedErr(snapshot.Free, log.Fields{"snapshot": request.Name}, "failed to free snapshot")
+
+		var flags uint32
+		if request.Recursive {
+			flags |= libvirt.VIR_DOMAIN_SNAPSHOT_DELETE_CHILDREN
+		}
+
+		if err = snapshot.Delete(flags); err != nil {
+			return err
+		}
+
+		tree, err := SnapshotTree(domain)
+		if err != nil {
+			return err
+		}
+		names := snapshotNames(tree, make(map[string]bool))
+
+		v, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		metadata := MetadataSnapshots{}
+		for _, m := range v.Metadata.Snapshots.Snapshots {
+			if names[m.Name] {
+				metadata.Snapshots = append(metadata.Snapshots, m)
+			}
+		}
+
+		return SetSnapshotMetadata(domain, metadata)
+	})(r, request, response)
+}
@@ -0,0 +1,621 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexzorin/libvirt-go"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// VolumesPath is the HTTP path of the volume upload and download endpoint
+const VolumesPath = "/_mistify_volumes_"
+
+// Method names used to authorize volume uploads and downloads
+const (
+	UploadVolumeMethod   = "Libvirt.UploadVolume"
+	DownloadVolumeMethod = "Libvirt.DownloadVolume"
+)
+
+// ErrVolumeInUse is returned when deleting or uploading to a volume that is a
+// disk of a guest
+var ErrVolumeInUse = errors.New("volume is in use by a guest")
+
+// ErrVolumeBusy is returned when another operation using or changing a volume
+// does not finish within the lock timeout
+var ErrVolumeBusy = errors.New("volume is busy with another operation")
+
+// filePoolTypes are the storage pool types whose volumes are files and may
+// have a format such as qcow2
+var filePoolTypes = map[string]bool{
+	"dir":   true,
+	"fs":    true,
+	"netfs": true,
+}
+
+type (
+	// ListStoragePoolsRequest filters the pools returned by ListStoragePools.
+	// All pools are returned if neither filter is set.
+	ListStoragePoolsRequest struct {
+		Active   bool `json:"active,omitempty"`
+		Inactive bool `json:"inactive,omitempty"`
+	}
+
+	// ListStoragePoolsResponse is the pools found by ListStoragePools
+	ListStoragePoolsResponse struct {
+		Pools []*VirStoragePool `json:"pools"`
+	}
+
+	// StoragePoolRequest is a request for a storage pool by name
+	StoragePoolRequest struct {
+		Pool string `json:"pool"`
+	}
+
+	// StoragePoolResponse is a storage pool and its volumes
+	StoragePoolResponse struct {
+		Pool    *VirStoragePool  `json:"pool"`
+		Volumes []*VirStorageVol `json:"volumes"`
+	}
+
+	// VolumeRequest is a request to create, resize, or delete a volume.
+	// Capacity is in bytes, and Format is only used for volumes in file based
+	// pools.
+	VolumeRequest struct {
+		Pool     string `json:"pool"`
+		Name     string `json:"name"`
+		Capacity uint64 `json:"capacity,omitempty"`
+		Format   string `json:"format,omitempty"`
+	}
+
+	// VolumeResponse is a volume
+	VolumeResponse struct {
+		Volume *VirStorageVol `json:"volume"`
+	}
+
+	// StorageFormat http://libvirt.org/formatstorage.html
+	StorageFormat struct {
+		Type string `xml:"type,attr" json:"type"`
+	}
+
+	// StorageSourceDevice http://libvirt.org/formatstorage.html#StoragePoolSource
+	StorageSourceDevice struct {
+		Path string `xml:"path,attr" json:"path"`
+	}
+
+	// StoragePoolSource http://libvirt.org/formatstorage.html#StoragePoolSource
+	StoragePoolSource struct {
+		Name    string                `xml:"name,omitempty" json:"name,omitempty"`
+		Devices []StorageSourceDevice `xml:"device" json:"devices,omitempty"`
+	}
+
+	// StorageTarget http://libvirt.org/formatstorage.html#StoragePoolTarget
+	StorageTarget struct {
+		Path   string         `xml:"path,omitempty" json:"path,omitempty"`
+		Format *StorageFormat `xml:"format,omitempty" json:"format,omitempty"`
+	}
+
+	// VirStoragePool http://libvirt.org/formatstorage.html#StoragePool
+	// Sizes are in bytes.
+	VirStoragePool struct {
+		XMLName    struct{}          `xml:"pool" json:"-"`
+		Type       string            `xml:"type,attr" json:"type"`
+		Name       string            `xml:"name" json:"name"`
+		UUID       string            `xml:"uuid,omitempty" json:"uuid"`
+		Capacity   uint64            `xml:"capacity" json:"capacity"`
+		Allocation uint64            `xml:"allocation" json:"allocation"`
+		Available  uint64            `xml:"available" json:"available"`
+		Source     StoragePoolSource `xml:"source" json:"source"`
+		Target     StorageTarget     `xml:"target" json:"target"`
+		State      string            `xml:"-" json:"state"`
+	}
+
+	// VirStorageVol http://libvirt.org/formatstorage.html#StorageVol
+	// Sizes are in bytes.
+	VirStorageVol struct {
+		XMLName    struct{}      `xml:"volume" json:"-"`
+		Type       string        `xml:"type,attr,omitempty" json:"type"`
+		Name       string        `xml:"name" json:"name"`
+		Key        string        `xml:"key,omitempty" json:"key"`
+		Capacity   uint64        `xml:"capacity" json:"capacity"`
+		Allocation uint64        `xml:"allocation" json:"allocation"`
+		Target     StorageTarget `xml:"target" json:"target"`
+	}
+)
+
+// ParseStoragePool parses the xml of a storage pool and sets its state
+func ParseStoragePool(pool BackendStoragePool) (*VirStoragePool, error) {
+	xmldesc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &VirStoragePool{}
+	if err = xml.Unmarshal([]byte(xmldesc), v); err != nil {
+		return nil, err
+	}
+
+	active, err := pool.IsActive()
+	if err != nil {
+		return nil, err
+	}
+	v.State = "inactive"
+	if active {
+		v.State = "running"
+	}
+
+	return v, nil
+}
+
+// ParseStorageVol parses the xml of a storage volume
+func ParseStorageVol(vol BackendStorageVol) (*VirStorageVol, error) {
+	xmldesc, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &VirStorageVol{}
+	if err = xml.Unmarshal([]byte(xmldesc), v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// ListStoragePools lists storage pools with their capacity and allocation
+func (lv *Libvirt) ListStoragePools(r *http.Request, request *ListStoragePoolsRequest, response *ListStoragePoolsResponse) error {
+	log.WithFields(log.Fields{
+		"active":   request.Active,
+		"inactive": request.Inactive,
+	}).Info("Libvirt.ListStoragePools")
+
+	conn, err := lv.getConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var flags uint32
+	if request.Active {
+		flags |= libvirt.VIR_CONNECT_LIST_STORAGE_POOLS_ACTIVE
+	}
+	if request.Inactive {
+		flags |= libvirt.VIR_CONNECT_LIST_STORAGE_POOLS_INACTIVE
+	}
+
+	pools, err := conn.ListAllStoragePools(flags)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range pools {
+			logx.LogReturnedErr(pools[i].Free, nil, "failed to free storage pool")
+		}
+	}()
+
+	list := make([]*VirStoragePool, 0, len(pools))
+	for _, pool := range pools {
+		v, err := ParseStoragePool(pool)
+		if err != nil {
+			return err
+		}
+		list = append(list, v)
+	}
+
+	*response = ListStoragePoolsResponse{
+		Pools: list,
+	}
+
+	return nil
+}
+
+// ListVolumes refreshes a storage pool and lists its volumes
+func (lv *Libvirt) ListVolumes(r *http.Request, request *StoragePoolRequest, response *StoragePoolResponse) error {
+	if request.Pool == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"pool": request.Pool,
+	}).Info("Libvirt.ListVolumes")
+
+	conn, err := lv.getConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	pool, err := conn.LookupStoragePoolByName(request.Pool)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(pool.Free, log.Fields{"pool": request.Pool}, "failed to free storage pool")
+
+	if active, err := pool.IsActive(); err != nil {
+		return err
+	} else if active {
+		if err := pool.Refresh(0); err != nil {
+			return err
+		}
+	}
+
+	p, err := ParseStoragePool(pool)
+	if err != nil {
+		return err
+	}
+
+	vols, err := pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range vols {
+			logx.LogReturnedErr(vols[i].Free, nil, "failed to free storage volume")
+		}
+	}()
+
+	list := make([]*VirStorageVol, 0, len(vols))
+	for _, vol := range vols {
+		v, err := ParseStorageVol(vol)
+		if err != nil {
+			return err
+		}
+		list = append(list, v)
+	}
+
+	*response = StoragePoolResponse{
+		Pool:    p,
+		Volumes: list,
+	}
+
+	return nil
+}
+
+// CreateVolume creates a volume of a capacity in bytes in a storage pool.
+// Volumes in file based pools are sparse and raw unless another format is
+// given; volumes in other pools, such as logical and zfs, are fully allocated.
+func (lv *Libvirt) CreateVolume(r *http.Request, request *VolumeRequest, response *VolumeResponse) error {
+	if request.Pool == "" || request.Name == "" || request.Capacity == 0 {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"pool":     request.Pool,
+		"volume":   request.Name,
+		"capacity": request.Capacity,
+		"format":   request.Format,
+	}).Info("Libvirt.CreateVolume")
+
+	conn, err := lv.getConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	pool, err := conn.LookupStoragePoolByName(request.Pool)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(pool.Free, log.Fields{"pool": request.Pool}, "failed to free storage pool")
+
+	p, err := ParseStoragePool(pool)
+	if err != nil {
+		return err
+	}
+
+	v := &VirStorageVol{
+		Name:       request.Name,
+		Capacity:   request.Capacity,
+		Allocation: request.Capacity,
+	}
+	if filePoolTypes[p.Type] {
+		v.Allocation = 0
+		format := request.Format
+		if format == "" {
+			format = "raw"
+		}
+		v.Target.Format = &StorageFormat{Type: format}
+	} else if request.Format != "" {
+		return syscall.EINVAL
+	}
+
+	x, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	vol, err := pool.StorageVolCreateXML(string(x), 0)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(vol.Free, log.Fields{"volume": request.Name}, "failed to free storage volume")
+
+	if v, err = ParseStorageVol(vol); err != nil {
+		return err
+	}
+
+	*response = VolumeResponse{
+		Volume: v,
+	}
+
+	return nil
+}
+
+// ResizeVolume changes the capacity of a volume to a number of bytes. Volumes
+// can only grow.
+func (lv *Libvirt) ResizeVolume(r *http.Request, request *VolumeRequest, response *VolumeResponse) error {
+	if request.Pool == "" || request.Name == "" || request.Capacity == 0 {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"pool":     request.Pool,
+		"volume":   request.Name,
+		"capacity": request.Capacity,
+	}).Info("Libvirt.ResizeVolume")
+
+	return lv.volumeWrapper(request.Pool, request.Name, response, func(conn *Connection, vol BackendStorageVol, v *VirStorageVol) error {
+		return vol.Resize(request.Capacity, 0)
+	})
+}
+
+// DeleteVolume deletes a volume that is not a disk of any guest
+func (lv *Libvirt) DeleteVolume(r *http.Request, request *VolumeRequest, response *VolumeResponse) error {
+	if request.Pool == "" || request.Name == "" {
+		return syscall.EINVAL
+	}
+
+	log.WithFields(log.Fields{
+		"pool":   request.Pool,
+		"volume": request.Name,
+	}).Info("Libvirt.DeleteVolume")
+
+	return lv.volumeWrapper(request.Pool, request.Name, response, func(conn *Connection, vol BackendStorageVol, v *VirStorageVol) error {
+		unlock, err := lv.lockVolumes(v.Target.Path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if err := checkVolumeUnused(conn, v); err != nil {
+			return err
+		}
+		return vol.Delete(0)
+	})
+}
+
+// volumeWrapper looks up a volume, runs a function on it, and sets the
+// response to the volume as it was before the function if it was deleted, or
+// as it is after
+func (lv *Libvirt) volumeWrapper(poolName string, name string, response *VolumeResponse, fn func(*Connection, BackendStorageVol, *VirStorageVol) error) error {
+	conn, err := lv.getConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(pool.Free, log.Fields{"pool": poolName}, "failed to free storage pool")
+
+	vol, err := pool.LookupStorageVolByName(name)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(vol.Free, log.Fields{"volume": name}, "failed to free storage volume")
+
+	v, err := ParseStorageVol(vol)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(conn, vol, v); err != nil {
+		return err
+	}
+
+	if after, err := ParseStorageVol(vol); err == nil {
+		v = after
+	} else if virError, ok := err.(libvirt.VirError); !ok || virError.Code != libvirt.VIR_ERR_NO_STORAGE_VOL {
+		return err
+	}
+
+	*response = VolumeResponse{
+		Volume: v,
+	}
+
+	return nil
+}
+
+// checkVolumeUnused returns ErrVolumeInUse if a volume is the source of a disk
+// of any guest
+func checkVolumeUnused(conn *Connection, v *VirStorageVol) error {
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range domains {
+			logx.LogReturnedErr(domains[i].Free, nil, "failed to free domain")
+		}
+	}()
+
+	for _, domain := range domains {
+		d, err := ParseDomain(domain)
+		if err != nil {
+			return err
+		}
+		for _, disk := range d.Devices.Disks {
+			if disk.Source.File == v.Target.Path || disk.Source.Device == v.Target.Path {
+				log.WithFields(log.Fields{
+					"volume": v.Name,
+					"guest":  d.Name,
+				}).Warn("volume is in use")
+				return ErrVolumeInUse
+			}
+		}
+	}
+
+	return nil
+}
+
+// VolumeHandler serves the contents of volumes at VolumesPath. The pool and
+// volume query parameters name the volume; GET downloads it and PUT uploads
+// the request body to it, which must not be in use by a guest. The offset and
+// length query parameters, in bytes, limit the transfer to part of the
+// volume.
+// https://libvirt.org/html/libvirt-libvirt-storage.html#virStorageVolUpload
+func (lv *Libvirt) VolumeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		poolName, name := query.Get("pool"), query.Get("volume")
+		if poolName == "" || name == "" {
+			http.Error(w, "pool and volume are required", http.StatusBadRequest)
+			return
+		}
+
+		var offset, length uint64
+		if o := query.Get("offset"); o != "" {
+			var err error
+			if offset, err = strconv.ParseUint(o, 10, 64); err != nil {
+				http.Error(w, "invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+		if l := query.Get("length"); l != "" {
+			var err error
+			if length, err = strconv.ParseUint(l, 10, 64); err != nil {
+				http.Error(w, "invalid length", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if r.Method != "GET" && r.Method != "PUT" {
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		method := DownloadVolumeMethod
+		if r.Method == "PUT" {
+			method = UploadVolumeMethod
+		}
+		log.WithFields(log.Fields{
+			"pool":   poolName,
+			"volume": name,
+			"offset": offset,
+			"length": length,
+		}).Info(method)
+
+		if err := lv.streamVolume(w, r, poolName, name, offset, length); err != nil {
+			log.WithFields(log.Fields{
+				"pool":   poolName,
+				"volume": name,
+				"error":  err,
+			}).Error(method + " failed")
+		}
+	})
+}
+
+// streamVolume uploads or downloads a volume for VolumeHandler. Errors before
+// the transfer starts are sent to the client, and errors are returned to be
+// logged.
+func (lv *Libvirt) streamVolume(w http.ResponseWriter, r *http.Request, poolName string, name string, offset uint64, length uint64) error {
+	conn, err := lv.getConnection()
+	if err != nil {
+		return volumeError(w, err)
+	}
+	defer conn.Release()
+
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return volumeError(w, err)
+	}
+	defer logx.LogReturnedErr(pool.Free, log.Fields{"pool": poolName}, "failed to free storage pool")
+
+	vol, err := pool.LookupStorageVolByName(name)
+	if err != nil {
+		return volumeError(w, err)
+	}
+	defer logx.LogReturnedErr(vol.Free, log.Fields{"volume": name}, "failed to free storage volume")
+
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return volumeError(w, err)
+	}
+	defer logx.LogReturnedErr(stream.Free, log.Fields{"volume": name}, "failed to free stream")
+
+	if r.Method == "GET" {
+		if err = vol.Download(stream, offset, length, 0); err != nil {
+			return volumeError(w, err)
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err = io.Copy(w, stream); err != nil {
+			logx.LogReturnedErr(stream.Abort, log.Fields{"volume": name}, "failed to abort stream")
+			return err
+		}
+		return stream.Finish()
+	}
+
+	v, err := ParseStorageVol(vol)
+	if err != nil {
+		return volumeError(w, err)
+	}
+
+	// no guest may start using the volume until the upload has finished
+	unlock, err := lv.lockVolumes(v.Target.Path)
+	if err != nil {
+		return volumeError(w, err)
+	}
+	defer unlock()
+
+	if err = checkVolumeUnused(conn, v); err != nil {
+		return volumeError(w, err)
+	}
+
+	if length == 0 && r.ContentLength > 0 {
+		length = uint64(r.ContentLength)
+	}
+	if err = vol.Upload(stream, offset, length, 0); err != nil {
+		return volumeError(w, err)
+	}
+
+	if _, err = io.Copy(stream, r.Body); err != nil {
+		logx.LogReturnedErr(stream.Abort, log.Fields{"volume": name}, "failed to abort stream")
+		return volumeError(w, err)
+	}
+	if err = stream.Finish(); err != nil {
+		return volumeError(w, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// volumeError sends an error response for a volume transfer and returns the
+// error
+func volumeError(w http.ResponseWriter, err error) error {
+	status := http.StatusInternalServerError
+	switch e := err.(type) {
+	case libvirt.VirError:
+		switch e.Code {
+		case libvirt.VIR_ERR_NO_STORAGE_POOL, libvirt.VIR_ERR_NO_STORAGE_VOL:
+			status = http.StatusNotFound
+		case libvirt.VIR_ERR_INVALID_ARG:
+			status = http.StatusBadRequest
+		}
+	default:
+		if err == ErrVolumeInUse || err == ErrVolumeBusy {
+			status = http.StatusConflict
+		}
+	}
+
+	http.Error(w, err.Error(), status)
+	return err
+}
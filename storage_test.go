@@ -0,0 +1,187 @@
+package libvirt_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alexzorin/libvirt-go"
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+func storageSetup(t *testing.T) *mlibvirt.Libvirt {
+	backend := mlibvirt.NewFakeBackend()
+	lv, err := mlibvirt.NewLibvirtWithBackend(backend, fakeURI, "", 2)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+
+	backend.DefineStoragePool(fakeURI, &mlibvirt.VirStoragePool{
+		Type:     "dir",
+		Name:     "default",
+		Capacity: 1 << 30,
+		Target:   mlibvirt.StorageTarget{Path: "/var/lib/libvirt/images"},
+	}, true)
+	backend.DefineStoragePool(fakeURI, &mlibvirt.VirStoragePool{
+		Type:     "logical",
+		Name:     "vg",
+		Capacity: 100 << 20,
+		Source:   mlibvirt.StoragePoolSource{Name: "vg"},
+		Target:   mlibvirt.StorageTarget{Path: "/dev/vg"},
+	}, true)
+	backend.DefineStoragePool(fakeURI, &mlibvirt.VirStoragePool{
+		Type:     "zfs",
+		Name:     "tank",
+		Capacity: 1 << 30,
+		Source:   mlibvirt.StoragePoolSource{Name: "tank"},
+		Target:   mlibvirt.StorageTarget{Path: "/dev/zvol/tank"},
+	}, false)
+
+	return lv
+}
+
+func createVolume(t *testing.T, lv *mlibvirt.Libvirt, request *mlibvirt.VolumeRequest) *mlibvirt.VirStorageVol {
+	response := &mlibvirt.VolumeResponse{}
+	if err := lv.CreateVolume(nil, request, response); err != nil {
+		t.Fatalf("CreateVolume failed: %s\n", err.Error())
+	}
+	return response.Volume
+}
+
+// transferVolume makes a volume upload or download request
+func transferVolume(lv *mlibvirt.Libvirt, method string, query string, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, "http://localhost"+mlibvirt.VolumesPath+"?"+query, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	lv.VolumeHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestStoragePools(t *testing.T) {
+	lv := storageSetup(t)
+
+	pools := &mlibvirt.ListStoragePoolsResponse{}
+	if err := lv.ListStoragePools(nil, &mlibvirt.ListStoragePoolsRequest{}, pools); err != nil {
+		t.Fatalf("ListStoragePools failed: %s\n", err.Error())
+	}
+	if len(pools.Pools) != 3 || pools.Pools[0].Name != "default" || pools.Pools[1].State != "inactive" {
+		t.Fatalf("unexpected pools %+v\n", pools.Pools)
+	}
+	if err := lv.ListStoragePools(nil, &mlibvirt.ListStoragePoolsRequest{Active: true}, pools); err != nil {
+		t.Fatalf("ListStoragePools failed: %s\n", err.Error())
+	}
+	if len(pools.Pools) != 2 {
+		t.Fatalf("expected only active pools, got %+v\n", pools.Pools)
+	}
+
+	file := createVolume(t, lv, &mlibvirt.VolumeRequest{Pool: "default", Name: "disk.qcow2", Capacity: 1 << 20, Format: "qcow2"})
+	if file.Type != "file" || file.Target.Format.Type != "qcow2" || file.Allocation != 0 || file.Target.Path != "/var/lib/libvirt/images/disk.qcow2" {
+		t.Fatalf("unexpected file volume %+v\n", file)
+	}
+
+	lvol := createVolume(t, lv, &mlibvirt.VolumeRequest{Pool: "vg", Name: "data", Capacity: 64 << 20})
+	if lvol.Type != "block" || lvol.Allocation != 64<<20 {
+		t.Fatalf("unexpected logical volume %+v\n", lvol)
+	}
+
+	err := lv.CreateVolume(nil, &mlibvirt.VolumeRequest{Pool: "vg", Name: "big", Capacity: 64 << 20}, &mlibvirt.VolumeResponse{})
+	expectVirError(t, "CreateVolume", err, libvirt.VIR_ERR_OPERATION_FAILED)
+	if err := lv.CreateVolume(nil, &mlibvirt.VolumeRequest{Pool: "vg", Name: "qcow", Capacity: 1 << 20, Format: "qcow2"}, &mlibvirt.VolumeResponse{}); err != syscall.EINVAL {
+		t.Fatalf("expected EINVAL for a format in a logical pool, got %v\n", err)
+	}
+	err = lv.CreateVolume(nil, &mlibvirt.VolumeRequest{Pool: "tank", Name: "zvol", Capacity: 1 << 20}, &mlibvirt.VolumeResponse{})
+	expectVirError(t, "CreateVolume", err, libvirt.VIR_ERR_OPERATION_INVALID)
+
+	list := &mlibvirt.StoragePoolResponse{}
+	if err := lv.ListVolumes(nil, &mlibvirt.StoragePoolRequest{Pool: "vg"}, list); err != nil {
+		t.Fatalf("ListVolumes failed: %s\n", err.Error())
+	}
+	if len(list.Volumes) != 1 || list.Pool.Allocation != 64<<20 || list.Pool.Available != 36<<20 {
+		t.Fatalf("unexpected pool %+v with volumes %+v\n", list.Pool, list.Volumes)
+	}
+
+	resized := &mlibvirt.VolumeResponse{}
+	if err := lv.ResizeVolume(nil, &mlibvirt.VolumeRequest{Pool: "vg", Name: "data", Capacity: 80 << 20}, resized); err != nil {
+		t.Fatalf("ResizeVolume failed: %s\n", err.Error())
+	}
+	if resized.Volume.Capacity != 80<<20 {
+		t.Fatalf("expected volume to grow, got %+v\n", resized.Volume)
+	}
+	err = lv.ResizeVolume(nil, &mlibvirt.VolumeRequest{Pool: "vg", Name: "data", Capacity: 1 << 20}, resized)
+	expectVirError(t, "ResizeVolume", err, libvirt.VIR_ERR_INVALID_ARG)
+
+	deleted := &mlibvirt.VolumeResponse{}
+	if err := lv.DeleteVolume(nil, &mlibvirt.VolumeRequest{Pool: "vg", Name: "data"}, deleted); err != nil {
+		t.Fatalf("DeleteVolume failed: %s\n", err.Error())
+	}
+	if deleted.Volume == nil || deleted.Volume.Name != "data" {
+		t.Fatalf("expected the deleted volume, got %+v\n", deleted.Volume)
+	}
+	err = lv.DeleteVolume(nil, &mlibvirt.VolumeRequest{Pool: "vg", Name: "data"}, deleted)
+	expectVirError(t, "DeleteVolume", err, libvirt.VIR_ERR_NO_STORAGE_VOL)
+}
+
+func TestVolumeTransfer(t *testing.T) {
+	lv := storageSetup(t)
+	vol := createVolume(t, lv, &mlibvirt.VolumeRequest{Pool: "default", Name: "disk.img", Capacity: 16})
+
+	if w := transferVolume(lv, "PUT", "pool=default&volume=disk.img&offset=4", "mistify"); w.Code != http.StatusNoContent {
+		t.Fatalf("upload failed: %d %s\n", w.Code, w.Body.String())
+	}
+
+	w := transferVolume(lv, "GET", "pool=default&volume=disk.img&offset=4&length=7", "")
+	if w.Code != http.StatusOK || w.Body.String() != "mistify" {
+		t.Fatalf("expected uploaded data, got %d %q\n", w.Code, w.Body.String())
+	}
+	if w = transferVolume(lv, "GET", "pool=default&volume=disk.img", ""); w.Body.Len() != 16 {
+		t.Fatalf("expected the whole volume, got %d bytes\n", w.Body.Len())
+	}
+
+	if w = transferVolume(lv, "PUT", "pool=default&volume=disk.img&offset=12", "too long"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected upload past the capacity to fail, got %d\n", w.Code)
+	}
+	if w = transferVolume(lv, "GET", "pool=default&volume=missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing volume, got %d\n", w.Code)
+	}
+	if w = transferVolume(lv, "GET", "pool=default", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a volume, got %d\n", w.Code)
+	}
+
+	// guests can't start using a volume while it is uploaded to
+	body, pw := io.Pipe()
+	uploaded := make(chan *httptest.ResponseRecorder)
+	go func() {
+		r, _ := http.NewRequest("PUT", "http://localhost"+mlibvirt.VolumesPath+"?pool=default&volume=disk.img", body)
+		w := httptest.NewRecorder()
+		lv.VolumeHandler().ServeHTTP(w, r)
+		uploaded <- w
+	}()
+	if _, err := pw.Write([]byte("data")); err != nil {
+		t.Fatalf("can't write upload: %s\n", err.Error())
+	}
+	lv.SetLockTimeout(10 * time.Millisecond)
+	guest := &client.Guest{ID: "storage-guest", Type: "test", Disks: []client.Disk{{Source: vol.Target.Path}}}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != mlibvirt.ErrVolumeBusy {
+		t.Fatalf("expected ErrVolumeBusy, got %v\n", err)
+	}
+	_ = pw.Close()
+	if w = <-uploaded; w.Code != http.StatusNoContent {
+		t.Fatalf("upload failed: %d %s\n", w.Code, w.Body.String())
+	}
+
+	// volumes used by a guest can't be overwritten or deleted
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != nil {
+		t.Fatalf("CreateGuest failed: %s\n", err.Error())
+	}
+	if w = transferVolume(lv, "PUT", "pool=default&volume=disk.img", "data"); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 uploading to a volume in use, got %d\n", w.Code)
+	}
+	if err := lv.DeleteVolume(nil, &mlibvirt.VolumeRequest{Pool: "default", Name: "disk.img"}, &mlibvirt.VolumeResponse{}); err != mlibvirt.ErrVolumeInUse {
+		t.Fatalf("expected ErrVolumeInUse, got %v\n", err)
+	}
+}
@@ -0,0 +1,119 @@
+package libvirt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TLSConfig configures HTTPS serving of the API with optional client
+// certificate authentication
+type TLSConfig struct {
+	// Server certificate and key, PEM encoded
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CA bundle used to verify client certificates. Clients must present a
+	// certificate signed by one of these CAs when set.
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+	// Common names of the client certificates that are allowed. Any verified
+	// client is allowed when empty.
+	AllowedSubjects []string `json:"allowed_subjects,omitempty"`
+}
+
+// Validate checks that the settings are consistent
+func (c *TLSConfig) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("tls requires a certificate and a key")
+	}
+	if len(c.AllowedSubjects) > 0 && c.ClientCAFile == "" {
+		return errors.New("allowed subjects require a client ca")
+	}
+	return nil
+}
+
+// ServerConfig loads the certificates and builds the tls.Config for the HTTP
+// server
+func (c *TLSConfig) ServerConfig() (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// Handler wraps an HTTP handler to reject clients whose certificate common name
+// is not one of the allowed subjects
+func (c *TLSConfig) Handler(handler http.Handler) http.Handler {
+	if len(c.AllowedSubjects) == 0 {
+		return handler
+	}
+
+	allowed := make(map[string]bool, len(c.AllowedSubjects))
+	for _, subject := range c.AllowedSubjects {
+		allowed[subject] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject := ClientSubject(r)
+		if !allowed[subject] {
+			log.WithFields(log.Fields{
+				"subject": subject,
+				"remote":  r.RemoteAddr,
+				"path":    r.URL.Path,
+			}).Warn("client certificate subject not allowed")
+			http.Error(w, "client certificate subject not allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves an HTTP server over TLS
+func (c *TLSConfig) ListenAndServe(server *http.Server) error {
+	config, err := c.ServerConfig()
+	if err != nil {
+		return err
+	}
+
+	server.TLSConfig = config
+	server.Handler = c.Handler(server.Handler)
+
+	return server.ListenAndServeTLS(c.CertFile, c.KeyFile)
+}
+
+// ClientSubject returns the common name of a request's verified client
+// certificate, or an empty string if there is none
+func ClientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,186 @@
+package libvirt_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-agent-libvirt"
+)
+
+// testCert is a certificate and key signed by a test CA
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %s\n", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("can't create certificate: %s\n", err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("can't parse certificate: %s\n", err.Error())
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key as PEM files
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644); err != nil {
+		t.Fatalf("can't write %s: %s\n", certFile, err.Error())
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("can't marshal key: %s\n", err.Error())
+	}
+	keyFile := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("can't write %s: %s\n", keyFile, err.Error())
+	}
+
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		config *libvirt.TLSConfig
+		valid  bool
+	}{
+		{&libvirt.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}, true},
+		{&libvirt.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", ClientCAFile: "ca.pem", AllowedSubjects: []string{"a"}}, true},
+		{&libvirt.TLSConfig{CertFile: "cert.pem"}, false},
+		{&libvirt.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", AllowedSubjects: []string{"a"}}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Fatalf("config %d: expected valid %t, got %v\n", i, test.valid, err)
+		}
+	}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mistify-libvirt-tls")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s\n", err.Error())
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	ca := newTestCert(t, "test-ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, "127.0.0.1", ca)
+	certFile, keyFile := server.write(t, dir, "server")
+
+	config := &libvirt.TLSConfig{
+		CertFile:        certFile,
+		KeyFile:         keyFile,
+		ClientCAFile:    caFile,
+		AllowedSubjects: []string{"allowed"},
+	}
+	tlsConfig, err := config.ServerConfig()
+	if err != nil {
+		t.Fatalf("ServerConfig failed: %s\n", err.Error())
+	}
+
+	ts := httptest.NewUnstartedServer(config.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(libvirt.ClientSubject(r)))
+	})))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+			},
+		}
+		return client.Get(ts.URL)
+	}
+
+	// no client certificate
+	if _, err := get(); err == nil {
+		t.Fatalf("expected request without a client certificate to fail\n")
+	}
+
+	// certificate from another CA
+	other := newTestCert(t, "allowed", newTestCert(t, "other-ca", nil))
+	if _, err := get(other.tlsCertificate()); err == nil {
+		t.Fatalf("expected request with an untrusted client certificate to fail\n")
+	}
+
+	// subject not allowed
+	resp, err := get(newTestCert(t, "denied", ca).tlsCertificate())
+	if err != nil {
+		t.Fatalf("request failed: %s\n", err.Error())
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d for a subject not allowed, got %d\n", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// allowed subject
+	resp, err = get(newTestCert(t, "allowed", ca).tlsCertificate())
+	if err != nil {
+		t.Fatalf("request failed: %s\n", err.Error())
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("can't read response: %s\n", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "allowed" {
+		t.Fatalf("expected status %d and subject allowed, got %d %q\n", http.StatusOK, resp.StatusCode, body)
+	}
+}
@@ -1,90 +1,191 @@
 package libvirt
 
 import (
-	"bytes"
-	"text/template"
+	"encoding/xml"
+	"sort"
 
 	"github.com/mistifyio/mistify-agent/client"
 )
 
-var domainTemplate *template.Template
-var networkTemplate *template.Template
-
-func init() {
-	const domainXML = `
-<domain type="{{.Type}}">
-  <name>{{.ID}}</name>
-  <memory unit="MiB">{{.Memory}}</memory>
-  <vcpu>{{.CPU}}</vcpu>
-
-  {{if .Metadata}}
-  <metadata>
-    {{range .Metadata}}
-    {{end}}
-  </metadata>
-  {{end}}
-
-  <os>
-    <type>hvm</type>
-  </os>
-  <devices>
-    {{range .Nics}}
-    <interface type="network">
-      <source network='{{.Mac}}' portgroup='vlan-all' />
-	  {{if .Name}}<guest dev="{{.Name}}" />{{end}}
-      {{if .Mac}}<mac address="{{.Mac}}" />{{end}}
-      {{if .Model}}<model type="{{.Model}}" />{{end}}
-    </interface>
-    {{end}}
-
-    {{range .Disks}}
-    <disk type="block" device="disk">
-      <driver name="qemu" type="raw" />
-      <source dev="{{.Source}}" />
-      <target dev="{{.Device}}" bus="{{.Bus}}" />
-    </disk>
-    {{end}}
-  </devices>
-</domain>
-`
-	domainTemplate = template.Must(template.New("domainXML").Parse(domainXML))
-
-	const networkXML = `
-<network>
-	<name>{{.Mac}}</name>
-	<forward mode='bridge' />
-	<bridge name='{{.Network}}' />
-	<virtualport type='openvswitch' />
-	<portgroup name='vlan-all'>
-		<vlan>
-		{{range .VLANs}}
-			<tag id ='{{.}}' />
-		{{end}}
-		</vlan>
-	</portgroup>
-</network>
-`
-	networkTemplate = template.Must(template.New("networkXML").Parse(networkXML))
+// GuestDomain builds a libvirt domain definition from guest properties. Guest
+// metadata and disk image and volume information are stored in the mistify
+// metadata namespaces so they survive agent restarts. Disks are built by
+// GuestDisk.
+func GuestDomain(guest *client.Guest) *VirDomain {
+	v := &VirDomain{
+		Type:   guest.Type,
+		Name:   guest.ID,
+		Memory: int(guest.Memory) * 1024,
+		VCPU:   int(guest.CPU),
+		Os: Os{
+			Type: OsType{Type: "hvm"},
+		},
+	}
+
+	for _, nic := range guest.Nics {
+		v.Devices.Interfaces = append(v.Devices.Interfaces, Interface{
+			Type: "network",
+			Source: InterfaceSource{
+				Network:   nic.Mac,
+				Portgroup: "vlan-all",
+			},
+			Guest: InterfaceGuest{Device: nic.Name},
+			Mac:   InterfaceMac{Address: nic.Mac},
+			Model: InterfaceModel{Type: nic.Model},
+		})
+	}
+
+	for _, disk := range guest.Disks {
+		v.Metadata.Device.Disks = append(v.Metadata.Device.Disks, MetadataDisk{
+			Device: disk.Device,
+			Image:  disk.Image,
+			Volume: disk.Volume,
+		})
+
+		v.Devices.Disks = append(v.Devices.Disks, GuestDisk(disk))
+	}
+	v.Devices.Controllers = diskControllers(guest.Disks)
+
+	keys := make([]string, 0, len(guest.Metadata))
+	for key := range guest.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v.Metadata.UserMetadata.Parameters = append(v.Metadata.UserMetadata.Parameters, UserMetadataParameter{
+			Name:  key,
+			Value: guest.Metadata[key],
+		})
+	}
+
+	return v
 }
 
-// DomainXML populates a libvirt domain xml template with guest properties
+// GuestNetwork builds a libvirt network definition from guest nic properties.
+// Each nic gets its own network, named by mac address, bridged to the nic's
+// network with a portgroup carrying its vlans.
+func GuestNetwork(nic client.Nic) *VirNetwork {
+	pg := NetworkPortgroup{
+		Name: "vlan-all",
+	}
+	if len(nic.VLANs) > 0 {
+		pg.VLAN = &NetworkVLAN{}
+		for _, vlan := range nic.VLANs {
+			pg.VLAN.Tags = append(pg.VLAN.Tags, NetworkVLANTag{ID: vlan})
+		}
+	}
+
+	return &VirNetwork{
+		Name:        nic.Mac,
+		Forward:     NetworkForward{Mode: "bridge"},
+		Bridge:      NetworkBridge{Name: nic.Network},
+		VirtualPort: NetworkVirtualPort{Type: "openvswitch"},
+		Portgroups:  []NetworkPortgroup{pg},
+	}
+}
+
+// DomainXML generates libvirt domain xml with guest properties
 func (lv *Libvirt) DomainXML(guest *client.Guest) (string, error) {
-	buf := new(bytes.Buffer)
-	err := domainTemplate.Execute(buf, guest)
+	x, err := xml.MarshalIndent(GuestDomain(guest), "", "  ")
 	if err != nil {
 		return "", err
 	}
 
-	return buf.String(), nil
+	return string(x), nil
 }
 
-// NetworkXML populates a libvirt network xml template with guest properties
+// NetworkXML generates libvirt network xml with guest nic properties
 func (lv *Libvirt) NetworkXML(nic client.Nic) (string, error) {
-	buf := new(bytes.Buffer)
-	err := networkTemplate.Execute(buf, nic)
+	x, err := xml.MarshalIndent(GuestNetwork(nic), "", "  ")
 	if err != nil {
 		return "", err
 	}
 
-	return buf.String(), nil
+	return string(x), nil
+}
+
+// marshalOptional encodes v as an element unless it is empty. Callers pass a
+// type without a MarshalXML method to avoid recursing.
+func marshalOptional(e *xml.Encoder, start xml.StartElement, v interface{}, empty bool) error {
+	if empty {
+		return nil
+	}
+	return e.EncodeElement(v, start)
+}
+
+// MarshalXML omits the element when no address is set
+func (m InterfaceMac) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain InterfaceMac
+	return marshalOptional(e, start, plain(m), m == InterfaceMac{})
+}
+
+// MarshalXML omits the element when no model is set
+func (m InterfaceModel) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain InterfaceModel
+	return marshalOptional(e, start, plain(m), m == InterfaceModel{})
+}
+
+// MarshalXML omits the element when no target device is set
+func (t InterfaceTarget) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain InterfaceTarget
+	return marshalOptional(e, start, plain(t), t == InterfaceTarget{})
+}
+
+// MarshalXML omits the element when no guest device is set
+func (g InterfaceGuest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain InterfaceGuest
+	return marshalOptional(e, start, plain(g), g == InterfaceGuest{})
+}
+
+// MarshalXML omits the element when no alias is set
+func (a InterfaceAlias) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain InterfaceAlias
+	return marshalOptional(e, start, plain(a), a == InterfaceAlias{})
+}
+
+// MarshalXML omits the element when no filter is set
+func (f FilterRef) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain FilterRef
+	return marshalOptional(e, start, plain(f), f.Filter == "" && len(f.Parameters) == 0)
+}
+
+// MarshalXML omits the element when no graphics type is set
+func (g Graphics) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain Graphics
+	return marshalOptional(e, start, plain(g), g == Graphics{})
+}
+
+// MarshalXML omits the element when no boot device is set
+func (b OsBoot) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain OsBoot
+	return marshalOptional(e, start, plain(b), b == OsBoot{})
+}
+
+// MarshalXML omits the metadata element, and each kind of metadata in it,
+// when empty
+func (m Metadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	parts := make([]interface{}, 0, 3)
+	if len(m.Device.Disks) > 0 {
+		parts = append(parts, m.Device)
+	}
+	if len(m.UserMetadata.Parameters) > 0 {
+		parts = append(parts, m.UserMetadata)
+	}
+	if len(m.Snapshots.Snapshots) > 0 {
+		parts = append(parts, m.Snapshots)
+	}
+
+	if len(parts) == 0 {
+		return nil
+	}
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := e.Encode(part); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
 }
@@ -0,0 +1,246 @@
+package libvirt_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+var (
+	update   = flag.Bool("update", false, "rewrite golden files with the current output")
+	validate = flag.Bool("validate", false, "validate generated xml against libvirt's RelaxNG schemas")
+)
+
+// schemaDir is where libvirt installs its RelaxNG schemas. It may be
+// overridden with LIBVIRT_SCHEMA_DIR.
+func schemaDir() string {
+	if dir := os.Getenv("LIBVIRT_SCHEMA_DIR"); dir != "" {
+		return dir
+	}
+	return "/usr/share/libvirt/schemas"
+}
+
+// golden compares xml with a golden file in testdata/golden, rewriting it
+// instead with -update
+func golden(t *testing.T, name string, x string) {
+	filename := filepath.Join("testdata", "golden", name+".xml")
+
+	if *update {
+		if err := ioutil.WriteFile(filename, []byte(x+"\n"), 0644); err != nil {
+			t.Fatalf("can't write golden file %s: %s\n", filename, err.Error())
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("can't read golden file %s: %s\n", filename, err.Error())
+	}
+
+	if string(expected) != x+"\n" {
+		t.Fatalf("%s does not match %s\nexpected:\n%s\ngot:\n%s\n", name, filename, expected, x)
+	}
+}
+
+// validateSchema checks xml against a libvirt RelaxNG schema with xmllint.
+// It only runs with -validate and does nothing when the schemas or xmllint are
+// not installed.
+func validateSchema(t *testing.T, schema string, name string, x string) {
+	if !*validate {
+		return
+	}
+
+	rng := filepath.Join(schemaDir(), schema+".rng")
+	if _, err := os.Stat(rng); err != nil {
+		t.Logf("schema %s not found, not validating %s\n", rng, name)
+		return
+	}
+
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Logf("xmllint not found, not validating %s\n", name)
+		return
+	}
+
+	f, err := ioutil.TempFile("", name)
+	if err != nil {
+		t.Fatalf("can't create temp file: %s\n", err.Error())
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err = f.WriteString(x); err != nil {
+		t.Fatalf("can't write temp file: %s\n", err.Error())
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("can't close temp file: %s\n", err.Error())
+	}
+
+	out, err := exec.Command(xmllint, "--noout", "--relaxng", rng, f.Name()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s is not a valid %s: %s\n%s\n", name, schema, err.Error(), out)
+	}
+}
+
+func TestDomainXML(t *testing.T) {
+	lv := new(libvirt.Libvirt)
+
+	tests := []struct {
+		name  string
+		guest *client.Guest
+		// reason the output is known not to validate
+		invalid string
+	}{
+		{
+			name: "domain-minimal",
+			guest: &client.Guest{
+				ID:     "minimal",
+				Type:   "kvm",
+				Memory: 256,
+				CPU:    1,
+			},
+		},
+		{
+			name: "domain-disks",
+			guest: &client.Guest{
+				ID:     "disks",
+				Type:   "kvm",
+				Memory: 1024,
+				CPU:    2,
+				Disks: []client.Disk{
+					{Bus: "virtio", Device: "vda", Source: "/dev/zvol/guests/disks/disk-0", Image: "ubuntu-14.04", Volume: "guests/disks/disk-0"},
+					{Bus: "virtio", Device: "vdb", Source: "/dev/zvol/guests/disks/disk-1", Volume: "guests/disks/disk-1"},
+					{Bus: "virtio", Device: "vdc", Source: "/dev/zvol/guests/disks/disk-2"},
+				},
+			},
+		},
+		{
+			name: "domain-file-disks",
+			guest: &client.Guest{
+				ID:     "file-disks",
+				Type:   "kvm",
+				Memory: 1024,
+				CPU:    1,
+				Disks: []client.Disk{
+					{Bus: "virtio", Device: "vda", Source: "/var/lib/mistify/guests/file-disks-vda.qcow2", Image: "/var/lib/mistify/images/ubuntu.qcow2"},
+					{Bus: "virtio", Device: "vdb", Source: "/var/lib/mistify/guests/file-disks-vdb.img"},
+					{Bus: "virtio", Device: "vdc", Source: "/var/lib/mistify/guests/file-disks-vdc.qcow2", Image: "/dev/zvol/tank/images/centos"},
+					{Bus: "virtio", Device: "vdd", Image: "/var/lib/mistify/images/tools.iso"},
+				},
+			},
+		},
+		{
+			name: "domain-buses",
+			guest: &client.Guest{
+				ID:     "buses",
+				Type:   "kvm",
+				Memory: 1024,
+				CPU:    1,
+				Disks: []client.Disk{
+					{Bus: "ide", Device: "hda", Source: "/dev/zvol/guests/buses/disk-0"},
+					{Bus: "sata", Device: "sda", Source: "/dev/zvol/guests/buses/disk-1"},
+					{Bus: "scsi", Device: "sdb", Source: "/dev/zvol/guests/buses/disk-2"},
+					{Bus: "virtio", Device: "vdaa", Source: "/dev/zvol/guests/buses/disk-3"},
+				},
+			},
+		},
+		{
+			name: "domain-nics",
+			guest: &client.Guest{
+				ID:     "nics",
+				Type:   "kvm",
+				Memory: 512,
+				CPU:    1,
+				Nics: []client.Nic{
+					{Name: "eth0", Model: "virtio", Mac: "02:00:00:00:00:01", Network: "mistify0", VLANs: []int{1}},
+					{Mac: "02:00:00:00:00:02", Network: "mistify0"},
+					{Name: "eth2", Model: "e1000", Mac: "02:00:00:00:00:03", Network: "mistify1", VLANs: []int{10, 20, 30}},
+				},
+			},
+		},
+		{
+			name: "domain-nic-no-mac",
+			guest: &client.Guest{
+				ID:     "nic-no-mac",
+				Type:   "kvm",
+				Memory: 512,
+				CPU:    1,
+				Nics: []client.Nic{
+					{Name: "eth0", Network: "mistify0"},
+				},
+			},
+			invalid: "nics are attached to networks named by mac",
+		},
+		{
+			name: "domain-metadata",
+			guest: &client.Guest{
+				ID:     "metadata",
+				Type:   "qemu",
+				Memory: 128,
+				CPU:    1,
+				Metadata: map[string]string{
+					"owner":   "mistify & co",
+					"purpose": `<"quoted">`,
+					"empty":   "",
+				},
+				Disks: []client.Disk{
+					{Bus: "virtio", Device: "vda", Source: "/dev/zvol/guests/metadata/disk-0", Image: "centos-7"},
+				},
+				Nics: []client.Nic{
+					{Name: "eth0", Model: "e1000", Mac: "02:00:00:00:00:04", Network: "mistify0"},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		x, err := lv.DomainXML(test.guest)
+		if err != nil {
+			t.Fatalf("DomainXML failed for %s: %s\n", test.name, err.Error())
+		}
+
+		golden(t, test.name, x)
+		if test.invalid == "" {
+			validateSchema(t, "domain", test.name, x)
+		}
+	}
+}
+
+func TestNetworkXML(t *testing.T) {
+	lv := new(libvirt.Libvirt)
+
+	tests := []struct {
+		name string
+		nic  client.Nic
+	}{
+		{
+			name: "network-no-vlans",
+			nic:  client.Nic{Mac: "02:00:00:00:00:01", Network: "mistify0"},
+		},
+		{
+			name: "network-vlan",
+			nic:  client.Nic{Name: "eth0", Mac: "02:00:00:00:00:02", Network: "mistify0", VLANs: []int{1}},
+		},
+		{
+			name: "network-vlans",
+			nic:  client.Nic{Name: "eth1", Model: "virtio", Mac: "02:00:00:00:00:03", Network: "mistify1", VLANs: []int{10, 20, 30}},
+		},
+	}
+
+	for _, test := range tests {
+		x, err := lv.NetworkXML(test.nic)
+		if err != nil {
+			t.Fatalf("NetworkXML failed for %s: %s\n", test.name, err.Error())
+		}
+
+		golden(t, test.name, x)
+		validateSchema(t, "network", test.name, x)
+	}
+}
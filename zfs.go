@@ -0,0 +1,162 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+// DefaultZFSCommand is the zfs command used to manage guest disk volumes,
+// unless changed with SetZFSCommand
+const DefaultZFSCommand = "zfs"
+
+// ErrNoZpool is returned when a disk volume is needed but no zpool is
+// configured
+var ErrNoZpool = errors.New("no zpool configured for disk volumes")
+
+// SetZFSCommand sets the zfs command used to manage guest disk volumes
+func (lv *Libvirt) SetZFSCommand(command string) {
+	lv.zfsCommand = command
+}
+
+// zfs runs a zfs command, returning its output in the error if it fails
+func (lv *Libvirt) zfs(args ...string) error {
+	out, err := exec.Command(lv.zfsCommand, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("zfs %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// diskVolume returns the name of the zvol created for a guest disk
+func (lv *Libvirt) diskVolume(guest *client.Guest, disk *client.Disk) string {
+	return fmt.Sprintf("%s/guests/%s-%s", lv.zpool, guest.ID, disk.Device)
+}
+
+// createdVolume returns whether a disk's volume is the one the agent creates
+// for it on a guest. Only those volumes are ever destroyed.
+func (lv *Libvirt) createdVolume(guestID string, disk MetadataDisk) bool {
+	return lv.zpool != "" && disk.Volume != "" &&
+		disk.Volume == lv.diskVolume(&client.Guest{ID: guestID}, &client.Disk{Device: disk.Device})
+}
+
+// createdVolumes returns the volumes the agent created for the disks of a
+// guest's domain
+func (lv *Libvirt) createdVolumes(guestID string, v *VirDomain) []string {
+	volumes := make([]string, 0, len(v.Metadata.Device.Disks))
+	for _, disk := range v.Metadata.Device.Disks {
+		if lv.createdVolume(guestID, disk) {
+			volumes = append(volumes, disk.Volume)
+		}
+	}
+	return volumes
+}
+
+// imageSnapshot returns whether an image names a snapshot of a dataset under
+// the zpool, the only images volumes are cloned from. Names that could be
+// taken for zfs options or climb out of the zpool are refused.
+func (lv *Libvirt) imageSnapshot(image string) bool {
+	parts := strings.Split(image, "@")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], lv.zpool+"/") {
+		return false
+	}
+	for _, name := range append(strings.Split(parts[0], "/"), parts[1]) {
+		if name == "" || name == "." || name == ".." || strings.HasPrefix(name, "-") {
+			return false
+		}
+	}
+	return !strings.Contains(image, "..")
+}
+
+// checkDiskVolume checks that a disk without a source can have a volume
+// created for it: it needs a size or an image snapshot under the zpool to
+// clone. A volume sent by the client is cleared, so only volumes the agent
+// creates are recorded.
+func (lv *Libvirt) checkDiskVolume(disk *client.Disk) error {
+	disk.Volume = ""
+	if !needsVolume(disk) {
+		return nil
+	}
+	if lv.zpool == "" {
+		return ErrNoZpool
+	}
+	if disk.Image == "" && disk.Size == 0 {
+		return syscall.EINVAL
+	}
+	if disk.Image != "" && !lv.imageSnapshot(disk.Image) {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// createVolume creates a zvol of a size in MiB, or clones it from an image
+// snapshot if one is given
+func (lv *Libvirt) createVolume(volume string, image string, size uint64) error {
+	log.WithFields(log.Fields{
+		"volume": volume,
+		"image":  image,
+		"size":   size,
+	}).Info("creating disk volume")
+
+	if image != "" {
+		return lv.zfs("clone", "-p", image, volume)
+	}
+	return lv.zfs("create", "-p", "-V", fmt.Sprintf("%dM", size), volume)
+}
+
+// createDiskVolume creates the zvol for a guest disk, resized to the disk's
+// size if cloned from an image, and sets the disk's volume and source to it.
+// Its removal is added to the rollback, and a failure rolls back.
+func (lv *Libvirt) createDiskVolume(rb *rollback, guest *client.Guest, disk *client.Disk) error {
+	volume := lv.diskVolume(guest, disk)
+	if err := lv.createVolume(volume, disk.Image, disk.Size); err != nil {
+		return rb.fail("create volume "+volume, err)
+	}
+	rb.add("create volume "+volume, func() error {
+		return lv.destroyVolume(volume)
+	})
+
+	if disk.Image != "" && disk.Size > 0 {
+		if err := lv.resizeVolume(volume, disk.Size); err != nil {
+			return rb.fail("resize volume "+volume, err)
+		}
+	}
+
+	disk.Volume = volume
+	disk.Source = "/dev/zvol/" + volume
+	return nil
+}
+
+// resizeVolume sets the size of a zvol in MiB
+func (lv *Libvirt) resizeVolume(volume string, size uint64) error {
+	return lv.zfs("set", fmt.Sprintf("volsize=%dM", size), volume)
+}
+
+// destroyVolume destroys a guest disk volume and its snapshots. Volumes that do
+// not exist are ignored.
+func (lv *Libvirt) destroyVolume(volume string) error {
+	log.WithFields(log.Fields{
+		"volume": volume,
+	}).Info("destroying disk volume")
+
+	err := lv.zfs("destroy", "-r", volume)
+	if err != nil && strings.Contains(err.Error(), "does not exist") {
+		return nil
+	}
+	return err
+}
+
+// destroyVolumes destroys guest disk volumes, stopping at the first failure
+func (lv *Libvirt) destroyVolumes(volumes []string) error {
+	for _, volume := range volumes {
+		if err := lv.destroyVolume(volume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package libvirt_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	mlibvirt "github.com/mistifyio/mistify-agent-libvirt"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// fakeZFS is a zfs command that logs its arguments and fails for bogus
+// datasets, and for all datasets while FAKE_ZFS_BUSY is set
+const fakeZFS = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/zfs.log"
+case "$*" in
+*bogus*)
+	echo "cannot open 'bogus': dataset does not exist" >&2
+	exit 1
+	;;
+esac
+if [ -n "$FAKE_ZFS_BUSY" ]; then
+	echo "cannot destroy: dataset is busy" >&2
+	exit 1
+fi
+`
+
+// zfsSetup creates a Libvirt using the fake backend and a fake zfs command,
+// and returns a function to read the commands run
+func zfsSetup(t *testing.T, backend *mlibvirt.FakeBackend) (*mlibvirt.Libvirt, func() []string, func()) {
+	dir, err := ioutil.TempDir("", "mistify-libvirt-zfs")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s\n", err.Error())
+	}
+	zfs := filepath.Join(dir, "zfs")
+	if err := ioutil.WriteFile(zfs, []byte(fakeZFS), 0755); err != nil {
+		t.Fatalf("can't write fake zfs: %s\n", err.Error())
+	}
+
+	lv, err := mlibvirt.NewLibvirtWithBackend(backend, fakeURI, "tank", 2)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+	lv.SetZFSCommand(zfs)
+
+	commands := func() []string {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "zfs.log"))
+		_ = os.Remove(filepath.Join(dir, "zfs.log"))
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+	return lv, commands, func() { _ = os.RemoveAll(dir) }
+}
+
+func expectCommands(t *testing.T, action string, commands []string, expected ...string) {
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("%s: expected zfs commands %q, got %q\n", action, expected, commands)
+	}
+}
+
+func TestZFSVolumes(t *testing.T) {
+	lv, commands, cleanup := zfsSetup(t, mlibvirt.NewFakeBackend())
+	defer cleanup()
+
+	guest := &client.Guest{
+		ID:     "zfs-guest",
+		Type:   "test",
+		Memory: 256,
+		CPU:    1,
+		Disks: []client.Disk{
+			{Size: 1024},
+			{Image: "tank/images/ubuntu@base", Size: 2048},
+			{Source: "/dev/sdb", Volume: "tank/guests/db1-vda"},
+		},
+	}
+	response := &rpc.GuestResponse{}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, response); err != nil {
+		t.Fatalf("CreateGuest failed: %s\n", err.Error())
+	}
+	expectCommands(t, "CreateGuest", commands(),
+		"create -p -V 1024M tank/guests/zfs-guest-vda",
+		"clone -p tank/images/ubuntu@base tank/guests/zfs-guest-vdb",
+		"set volsize=2048M tank/guests/zfs-guest-vdb",
+	)
+
+	disks := response.Guest.Disks
+	if disks[0].Volume != "tank/guests/zfs-guest-vda" || disks[0].Source != "/dev/zvol/tank/guests/zfs-guest-vda" {
+		t.Fatalf("unexpected disk %+v\n", disks[0])
+	}
+	if disks[2].Volume != "" || disks[2].Source != "/dev/sdb" {
+		t.Fatalf("expected disk with a source to be left alone, got %+v\n", disks[2])
+	}
+
+	// volumes are destroyed before the domain is undefined, so a failed
+	// Delete leaves the guest to retry it
+	if err := os.Setenv("FAKE_ZFS_BUSY", "1"); err != nil {
+		t.Fatalf("can't set FAKE_ZFS_BUSY: %s\n", err.Error())
+	}
+	err := lv.Delete(nil, &rpc.GuestRequest{Guest: &client.Guest{ID: guest.ID}}, response)
+	_ = os.Unsetenv("FAKE_ZFS_BUSY")
+	if err == nil {
+		t.Fatalf("expected Delete to fail while volumes are busy\n")
+	}
+	expectCommands(t, "Delete", commands(), "destroy -r tank/guests/zfs-guest-vda")
+	if _, err = lv.LookupDomainByName(guest.ID); err != nil {
+		t.Fatalf("expected the domain to be kept after a failed Delete: %s\n", err.Error())
+	}
+
+	// volumes are found from the domain's metadata
+	if err := lv.Delete(nil, &rpc.GuestRequest{Guest: &client.Guest{ID: guest.ID}}, response); err != nil {
+		t.Fatalf("Delete failed: %s\n", err.Error())
+	}
+	expectCommands(t, "Delete", commands(),
+		"destroy -r tank/guests/zfs-guest-vda",
+		"destroy -r tank/guests/zfs-guest-vdb",
+	)
+
+	// only the volumes created for the guest are destroyed, whatever the
+	// metadata of a domain defined without CreateGuest says
+	guest = &client.Guest{
+		ID:   "foreign-guest",
+		Type: "test",
+		Disks: []client.Disk{
+			{Device: "vda", Source: "/dev/zvol/tank/guests/db1-vda", Volume: "tank/guests/db1-vda"},
+			{Device: "vdb", Source: "/dev/zvol/tank/guests/foreign-guest-vdb", Volume: "tank/guests/foreign-guest-vdb"},
+		},
+	}
+	if err := lv.Create(nil, &rpc.GuestRequest{Guest: guest}, response); err != nil {
+		t.Fatalf("Create failed: %s\n", err.Error())
+	}
+	if err := lv.Delete(nil, &rpc.GuestRequest{Guest: &client.Guest{ID: guest.ID}}, response); err != nil {
+		t.Fatalf("Delete failed: %s\n", err.Error())
+	}
+	expectCommands(t, "Delete", commands(), "destroy -r tank/guests/foreign-guest-vdb")
+}
+
+func TestZFSVolumesReconcile(t *testing.T) {
+	lv, commands, cleanup := zfsSetup(t, mlibvirt.NewFakeBackend())
+	defer cleanup()
+
+	guest := &client.Guest{
+		ID:   "stray",
+		Type: "test",
+		Disks: []client.Disk{
+			{Device: "vda", Source: "/dev/zvol/tank/guests/stray-vda", Volume: "tank/guests/stray-vda"},
+			{Device: "vdb", Source: "/dev/zvol/tank/guests/db1-vda", Volume: "tank/guests/db1-vda"},
+		},
+	}
+	if err := lv.Create(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != nil {
+		t.Fatalf("Create failed: %s\n", err.Error())
+	}
+
+	// unknown domains are removed with the volumes created for them
+	response := &mlibvirt.ReconcileResponse{}
+	if err := lv.Reconcile(nil, &mlibvirt.ReconcileRequest{Remove: true}, response); err != nil {
+		t.Fatalf("Reconcile failed: %s\n", err.Error())
+	}
+	if len(response.RemovedDomains) != 1 || response.RemovedDomains[0] != guest.ID {
+		t.Fatalf("expected %s to be removed, got %+v\n", guest.ID, response)
+	}
+	expectCommands(t, "Reconcile", commands(), "destroy -r tank/guests/stray-vda")
+}
+
+func TestZFSVolumesRollback(t *testing.T) {
+	lv, commands, cleanup := zfsSetup(t, mlibvirt.NewFakeBackend())
+	defer cleanup()
+
+	guest := &client.Guest{
+		ID:   "zfs-guest",
+		Type: "test",
+		Disks: []client.Disk{
+			{Size: 1024},
+			{Image: "tank/images/bogus@base"},
+		},
+	}
+	err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{})
+	if stepErr, ok := err.(*mlibvirt.StepError); !ok || stepErr.Step != "create volume tank/guests/zfs-guest-vdb" {
+		t.Fatalf("expected StepError for the second volume, got %v\n", err)
+	}
+	expectCommands(t, "CreateGuest", commands(),
+		"create -p -V 1024M tank/guests/zfs-guest-vda",
+		"clone -p tank/images/bogus@base tank/guests/zfs-guest-vdb",
+		"destroy -r tank/guests/zfs-guest-vda",
+	)
+
+	invalid := []client.Disk{
+		{},
+		{Image: "tank/images/ubuntu"},
+		{Image: "rpool/images/ubuntu@base"},
+		{Image: "tankx/images/ubuntu@base"},
+		{Image: "tank@base"},
+		{Image: "tank/images/../../rpool/ubuntu@base"},
+		{Image: "tank/images/ubuntu@base..x"},
+		{Image: "tank/-images/ubuntu@base"},
+		{Image: "tank/images/ubuntu@-base"},
+		{Image: "tank/images/ubuntu@base@again"},
+		{Image: "tank//ubuntu@base"},
+		{Image: "-o@base"},
+	}
+	for _, disk := range invalid {
+		guest.Disks = []client.Disk{disk}
+		if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != syscall.EINVAL {
+			t.Fatalf("expected EINVAL for disk %+v, got %v\n", disk, err)
+		}
+	}
+
+	lv, err = mlibvirt.NewLibvirtWithBackend(mlibvirt.NewFakeBackend(), fakeURI, "", 2)
+	if err != nil {
+		t.Fatalf("NewLibvirtWithBackend failed: %s\n", err.Error())
+	}
+	guest.Disks = []client.Disk{{Size: 1024}}
+	if err := lv.CreateGuest(nil, &rpc.GuestRequest{Guest: guest}, &rpc.GuestResponse{}); err != mlibvirt.ErrNoZpool {
+		t.Fatalf("expected ErrNoZpool, got %v\n", err)
+	}
+}